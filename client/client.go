@@ -2,13 +2,17 @@ package chclient
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -22,6 +26,8 @@ type Config struct {
 	shared           *chshare.Config
 	Fingerprint      string
 	Auth             string
+	Token            string
+	OIDC             OIDCConfig
 	KeepAlive        time.Duration
 	MaxRetryCount    int
 	MaxRetryInterval time.Duration
@@ -29,6 +35,80 @@ type Config struct {
 	HTTPProxy        string
 	Remotes          []string
 	HostHeader       string
+	//ID identifies the client to the server, see the server's --reverse-reservations
+	ID string
+	//Transport carries the tunnel: "websocket", "h2" or "poll", or by
+	//default a websocket, falling back to polling when it's refused
+	Transport string
+	//Servers are further server URLs, failed over to in order
+	//when the server (or the one before) is unreachable
+	Servers []string
+	//Discover is the DNS name of the SRV records of the servers,
+	//in place of Server and Servers, see Client.discover
+	Discover string
+	//Failback is how often a client connected to one of the Servers probes
+	//the servers before it, reconnecting to the first healthy one (0 never)
+	Failback time.Duration
+	//SSHAlgorithms restricts the ciphers, key exchanges and MACs of the ssh connection
+	SSHAlgorithms chshare.SSHAlgorithms
+	//Control is the unix socket path (or loopback host:port) of
+	//the control API, which adds and removes remotes, see control
+	Control string
+	//ServerRemotes lets the server open and close remotes (via its
+	//admin API), which may then reach any address the client can
+	ServerRemotes bool
+	//UDP configures the flows of udp remotes
+	UDP chshare.UDPOptions
+	//Stdio is the host:port to which stdin and stdout are piped once
+	//connected (as an ssh ProxyCommand), after which the client stops
+	Stdio string
+	//SocksAuth is the <user>:<pass> required of the SOCKS5
+	//clients of reverse socks remotes (none when empty)
+	SocksAuth string
+	//SocksAllow is the access list of the destinations of
+	//reverse socks remotes (any when empty)
+	SocksAllow []string
+	//TUN is the address (like 10.8.0.2/24) of the TUN device whose
+	//packets are routed through the server's, see the server's --tun
+	TUN string
+	//TUNRoutes are the networks routed through the TUN device
+	TUNRoutes []string
+	//PAC is the URL (or path) of the proxy auto-config file choosing the
+	//proxy of each server when there's no HTTPProxy, which otherwise is
+	//that of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables
+	PAC string
+	//TLS verifies the certificates of https:// and tls:// servers
+	TLS TLSConfig
+	//Fingerprints are further fingerprints accepted along with
+	//Fingerprint, as while the server's host key is rotated
+	Fingerprints []string
+	//KnownHosts is the path of a known_hosts file recording the host
+	//keys of servers trusted on first use, in place of Fingerprint,
+	//after which their keys must match those recorded, see knownHosts
+	KnownHosts string
+	//OnConnect, OnDisconnect and OnReconnecting are called as the
+	//client's state changes (see Client.States) with the server's URL,
+	//the error of the lost connection (nil for a clean disconnect),
+	//and the number of the next attempt, the delay before it and the
+	//error of the last one. They're called by the connection loop,
+	//so they mustn't block
+	OnConnect      func(server string)
+	OnDisconnect   func(server string, err error)
+	OnReconnecting func(attempt int, delay time.Duration, err error)
+	//RetryDelay is the delay before the first retry (100ms when 0), which
+	//is multiplied by the RetryMultiplier (2 when 0) for each further
+	//retry, up to the MaxRetryInterval
+	RetryDelay      time.Duration
+	RetryMultiplier float64
+	//RetryJitter is the fraction (0 to 1) of each delay by which it's
+	//shortened at random, so that clients disconnected together (as by
+	//a server's restart) don't all retry at once
+	RetryJitter float64
+	//GiveUp is what the client does after MaxRetryCount retries: "exit"
+	//(the default) stops it, "fail" stops it with an error (returned by
+	//Wait), and "restart" waits for the MaxRetryInterval, then retries
+	//from the RetryDelay again
+	GiveUp string
 }
 
 //Client represents a client instance
@@ -37,37 +117,91 @@ type Client struct {
 	config       *Config
 	sshConfig    *ssh.ClientConfig
 	sshConn      ssh.Conn
-	httpProxyURL *url.URL
+	proxy        *proxyDialer
+	currentProxy *proxyDialer
 	server       string
+	raw          bool
+	poll         bool
+	servers      []serverURL
+	current      int
+	failures     int
+	failbackTo   int32
 	running      bool
 	runningc     chan error
 	connStats    chshare.ConnStats
+	oidc         *oidcLogin
+	ctl          *control
+	//mut guards the remotes, which may be added and
+	//removed while running, see AddRemote
+	mut     sync.Mutex
+	ctx     context.Context
+	proxies map[*chshare.Remote]context.CancelFunc
+	//stdio is served once, see Config.Stdio
+	stdio     *chshare.TCPProxy
+	stdioOnce sync.Once
+	//socks serves reverse socks remotes, see socksServer
+	socks      *chshare.SocksServer
+	socksErr   error
+	socksOnce  sync.Once
+	socksAllow []*chshare.ACLRule
+	//tun relays the packets of the TUN device, see Config.TUN
+	tun *tunClient
+	//tls is the TLS config of https:// and tls:// servers, see tlsConfig
+	tls *tls.Config
+	//fingerprints are those pinned, or else the server's key
+	//is verified by the knownHosts, if any
+	fingerprints []string
+	knownHosts   *knownHosts
+	//state is published on states, see setState
+	state    State
+	stateMut sync.Mutex
+	states   chan StateChange
+	//retries delays reconnections, see newBackoff
+	retries *backoff.Backoff
+	random  *rand.Rand
 }
 
 //NewClient creates a new client instance
 func NewClient(config *Config) (*Client, error) {
-	//apply default scheme
-	if !strings.HasPrefix(config.Server, "http") {
-		config.Server = "http://" + config.Server
-	}
 	if config.MaxRetryInterval < time.Second {
 		config.MaxRetryInterval = 5 * time.Minute
 	}
-	u, err := url.Parse(config.Server)
-	if err != nil {
-		return nil, err
+	var servers []serverURL
+	if config.Discover != "" && (config.Server != "" || len(config.Servers) > 0) {
+		return nil, errors.New("Servers can't be given along with discovery")
+	} else if config.Discover == "" {
+		for _, server := range append([]string{config.Server}, config.Servers...) {
+			u, err := parseServer(server)
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers, u)
+		}
 	}
-	//apply default port
-	if !regexp.MustCompile(`:\d+$`).MatchString(u.Host) {
-		if u.Scheme == "https" || u.Scheme == "wss" {
-			u.Host = u.Host + ":443"
-		} else {
-			u.Host = u.Host + ":80"
+	switch config.Transport {
+	case "", "websocket", "h2", "poll":
+	default:
+		return nil, fmt.Errorf("Invalid transport '%s' (expected websocket, h2 or poll)", config.Transport)
+	}
+	var proxy *proxyDialer
+	if p := config.HTTPProxy; p != "" {
+		u, err := url.Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL (%s)", err)
+		}
+		if proxy, err = newProxyDialer(u); err != nil {
+			return nil, err
+		}
+		if config.PAC != "" {
+			return nil, errors.New("A proxy and a PAC file can't both be given")
+		}
+	}
+	for _, u := range servers {
+		if u.raw && (config.Transport == "h2" || config.Transport == "poll" || proxy.viaHTTP()) {
+			return nil, fmt.Errorf("%s servers can't be reached by HTTP (--transport or --proxy)", u.scheme)
 		}
 	}
-	//swap to websockets scheme
-	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
-	shared := &chshare.Config{}
+	shared := &chshare.Config{ClientID: config.ID}
 	for _, s := range config.Remotes {
 		r, err := chshare.DecodeRemote(s)
 		if err != nil {
@@ -75,20 +209,61 @@ func NewClient(config *Config) (*Client, error) {
 		}
 		shared.Remotes = append(shared.Remotes, r)
 	}
+	if config.Stdio != "" {
+		r, err := chshare.DecodeRemote(config.Stdio)
+		if err != nil || r.Reverse || r.Socks || r.UDP || r.LocalSocket != "" || r.RemoteSocket != "" {
+			return nil, fmt.Errorf("Invalid stdio address '%s' (expected <host>:<port>)", config.Stdio)
+		}
+		r.Stdio, r.LocalHost, r.LocalPort = true, "", ""
+		shared.Remotes = append(shared.Remotes, r)
+	}
 	config.shared = shared
 	client := &Client{
-		Logger:   chshare.NewLogger("client"),
-		config:   config,
-		server:   u.String(),
-		running:  true,
-		runningc: make(chan error, 1),
+		Logger:     chshare.NewLogger("client"),
+		config:     config,
+		proxy:      proxy,
+		servers:    servers,
+		failbackTo: -1,
+		proxies:    map[*chshare.Remote]context.CancelFunc{},
+		running:    true,
+		runningc:   make(chan error, 1),
+		states:     make(chan StateChange, 16),
 	}
 	client.Info = true
+	if len(servers) > 0 {
+		client.use(0)
+	}
 
-	if p := config.HTTPProxy; p != "" {
-		client.httpProxyURL, err = url.Parse(p)
+	var err error
+	if config.SocksAuth != "" {
+		if user, _ := chshare.ParseAuth(config.SocksAuth); user == "" {
+			return nil, errors.New("Invalid SOCKS5 auth (expected <user>:<pass>)")
+		}
+	}
+	if client.socksAllow, err = chshare.ParseAddrs(config.SocksAllow); err != nil {
+		return nil, fmt.Errorf("Invalid SOCKS5 access list: %s", err)
+	}
+
+	if client.retries, err = client.newBackoff(); err != nil {
+		return nil, err
+	}
+
+	if client.tls, err = newTLSConfig(config.TLS); err != nil {
+		return nil, err
+	}
+
+	if client.tun, err = newTunClient(client.Logger, config.TUN, config.TUNRoutes); err != nil {
+		return nil, err
+	}
+
+	if client.ctl, err = newControl(config.Control, client); err != nil {
+		return nil, err
+	}
+
+	if config.OIDC.Issuer != "" {
+		client.oidc, err = newOIDCLogin(config.OIDC, client.Logger)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid proxy URL (%s)", err)
+			return nil, err
 		}
 	}
 
@@ -101,6 +276,27 @@ func NewClient(config *Config) (*Client, error) {
 		HostKeyCallback: client.verifyServer,
 		Timeout:         30 * time.Second,
 	}
+	if err := config.SSHAlgorithms.Apply(&client.sshConfig.Config); err != nil {
+		return nil, err
+	}
+	if err := config.UDP.Validate(); err != nil {
+		return nil, err
+	}
+	for _, f := range append([]string{config.Fingerprint}, config.Fingerprints...) {
+		if f == "" {
+			continue
+		}
+		if chshare.FIPS() && !strings.HasPrefix(f, "SHA256:") {
+			return nil, fmt.Errorf("FIPS mode requires a SHA256 fingerprint (like SHA256:k8Zr...)")
+		}
+		client.fingerprints = append(client.fingerprints, f)
+	}
+	if config.KnownHosts != "" {
+		if len(client.fingerprints) > 0 {
+			return nil, errors.New("A fingerprint and a known hosts file can't both be given")
+		}
+		client.knownHosts = &knownHosts{path: config.KnownHosts}
+	}
 
 	return client, nil
 }
@@ -116,37 +312,71 @@ func (c *Client) Run() error {
 }
 
 func (c *Client) verifyServer(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	expect := c.config.Fingerprint
 	got := chshare.FingerprintKey(key)
-	if expect != "" && !strings.HasPrefix(got, expect) {
-		return fmt.Errorf("Invalid fingerprint (%s)", got)
+	if len(c.fingerprints) > 0 {
+		matched := false
+		for _, expect := range c.fingerprints {
+			if chshare.MatchFingerprint(key, expect) {
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("Invalid fingerprint (%s)", got)
+		}
+	} else if c.knownHosts != nil {
+		host := knownHostName(c.server)
+		added, err := c.knownHosts.verify(host, key)
+		if err != nil {
+			return err
+		}
+		if added {
+			c.Infof("Trusting the host key of %s on first use, recorded in %s", host, c.knownHosts.path)
+		}
 	}
 	//overwrite with complete fingerprint
-	c.Infof("Fingerprint %s", got)
+	c.Infof("Fingerprint %s (%s)", got, chshare.FingerprintKeySHA256(key))
 	return nil
 }
 
 //Start client and does not block
 func (c *Client) Start(ctx context.Context) error {
 	via := ""
-	if c.httpProxyURL != nil {
-		via = " via " + c.httpProxyURL.String()
+	if c.proxy != nil {
+		via = " via " + c.proxy.url.String()
 	}
 	//prepare non-reverse proxies
+	c.mut.Lock()
+	c.ctx = ctx
 	for i, r := range c.config.shared.Remotes {
-		if !r.Reverse {
-			proxy := chshare.NewTCPProxy(c.Logger, func() ssh.Conn { return c.sshConn }, i, r)
-			if err := proxy.Start(ctx); err != nil {
+		if r.Stdio {
+			c.stdio = chshare.NewTCPProxy(c.Logger, func() ssh.Conn { return c.sshConn }, i, r)
+		} else if !r.Reverse {
+			if err := c.startProxy(i, r); err != nil {
+				c.mut.Unlock()
 				return err
 			}
 		}
 	}
-	c.Infof("Connecting to %s%s\n", c.server, via)
+	c.mut.Unlock()
+	//optional control api
+	if err := c.ctl.start(ctx); err != nil {
+		return err
+	}
+	//optional tun device
+	if err := c.tun.start(ctx, c.config.TUN, c.config.TUNRoutes); err != nil {
+		return err
+	}
+	if c.config.Discover != "" {
+		c.Infof("Discovering servers at %s%s\n", c.config.Discover, via)
+	} else {
+		c.Infof("Connecting to %s%s\n", c.server, via)
+	}
 	//optional keepalive loop
 	if c.config.KeepAlive > 0 {
 		go c.keepAliveLoop()
 	}
 	//connection loop
+	c.setState(StateChange{State: StateConnecting, Server: c.server})
 	go c.connectionLoop()
 	return nil
 }
@@ -163,12 +393,18 @@ func (c *Client) keepAliveLoop() {
 func (c *Client) connectionLoop() {
 	//connection loop!
 	var connerr error
-	b := &backoff.Backoff{Max: c.config.MaxRetryInterval}
+	gaveUp := false
+	b := c.retries
 	for c.running {
+		if connerr != nil && c.failover() {
+			c.Infof("Connection error: %s, failing over to %s", connerr, c.server)
+			c.setState(StateChange{State: StateReconnecting, Server: c.server, Err: connerr, Attempt: 1})
+			connerr = nil
+		}
 		if connerr != nil {
 			attempt := int(b.Attempt())
 			maxAttempt := c.config.MaxRetryCount
-			d := b.Duration()
+			d := c.jitter(b.Duration())
 			//show error and attempt counts
 			msg := fmt.Sprintf("Connection error: %s", connerr)
 			if attempt > 0 {
@@ -181,39 +417,98 @@ func (c *Client) connectionLoop() {
 			c.Debugf(msg)
 			//give up?
 			if maxAttempt >= 0 && attempt >= maxAttempt {
-				break
+				if c.config.GiveUp != "restart" {
+					gaveUp = true
+					break
+				}
+				//wait out the longest delay, then start over
+				c.Infof("Gave up after %d attempts, starting over", attempt)
+				b.Reset()
+				attempt = 0
+				d = c.jitter(c.config.MaxRetryInterval)
 			}
 			c.Infof("Retrying in %s...", d)
+			c.setState(StateChange{State: StateReconnecting, Server: c.server, Err: connerr, Attempt: attempt + 1, Delay: d})
 			connerr = nil
 			chshare.SleepSignal(d)
 		}
+		if len(c.servers) == 0 {
+			if connerr = c.discover(); connerr != nil {
+				continue
+			}
+		}
 		d := websocket.Dialer{
 			ReadBufferSize:   1024,
 			WriteBufferSize:  1024,
 			HandshakeTimeout: 45 * time.Second,
 			Subprotocols:     []string{chshare.ProtocolVersion},
+			TLSClientConfig:  c.tlsConfig(),
 		}
-		//optionally CONNECT proxy
-		if c.httpProxyURL != nil {
-			d.Proxy = func(*http.Request) (*url.URL, error) {
-				return c.httpProxyURL, nil
+		//optionally CONNECT (or SOCKS5) proxy
+		c.currentProxy = c.proxyFor(c.servers[c.current])
+		if c.currentProxy != nil {
+			d.NetDialContext = c.currentProxy.DialContext
+			if c.currentProxy != c.proxy {
+				c.Debugf("Connecting to %s via %s", c.server, c.currentProxy.url.Redacted())
 			}
 		}
 		wsHeaders := http.Header{}
 		if c.config.HostHeader != "" {
-			wsHeaders = http.Header{
-				"Host": {c.config.HostHeader},
+			wsHeaders.Set("Host", c.config.HostHeader)
+		}
+		token := c.config.Token
+		if c.oidc != nil {
+			t, err := c.oidc.Token()
+			if err != nil {
+				connerr = err
+				continue
+			}
+			token = t
+		}
+		if token != "" {
+			wsHeaders.Set("Authorization", "Bearer "+token)
+		}
+		fingerprints := c.fingerprints
+		if c.knownHosts != nil {
+			fingerprints = c.knownHosts.fingerprints(knownHostName(c.server))
+		}
+		if len(fingerprints) > 0 {
+			wsHeaders.Set(chshare.FingerprintHeader, strings.Join(fingerprints, ","))
+		}
+		var conn net.Conn
+		var err error
+		sshConfig := c.sshConfig
+		if c.raw {
+			conn, err = c.dialRaw()
+			//without headers, the token is the password
+			if token != "" {
+				sc := *c.sshConfig
+				sc.Auth = []ssh.AuthMethod{ssh.Password(token)}
+				sshConfig = &sc
+			}
+		} else if c.config.Transport == "h2" {
+			conn, err = c.dialH2(wsHeaders)
+		} else if c.poll {
+			conn, err = c.dialPoll(wsHeaders)
+		} else {
+			var wsConn *websocket.Conn
+			var res *http.Response
+			if wsConn, res, err = d.Dial(c.server, wsHeaders); err == nil {
+				conn = chshare.NewWebSocketConn(wsConn)
+			} else if err == websocket.ErrBadHandshake && c.config.Transport == "" && !isBusy(res) {
+				//the upgrade was refused, likely by a proxy
+				c.Infof("Websocket refused, falling back to polling")
+				c.poll = true
+				conn, err = c.dialPoll(wsHeaders)
 			}
 		}
-		wsConn, _, err := d.Dial(c.server, wsHeaders)
 		if err != nil {
 			connerr = err
 			continue
 		}
-		conn := chshare.NewWebSocketConn(wsConn)
 		// perform SSH handshake on net.Conn
 		c.Debugf("Handshaking...")
-		sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", c.sshConfig)
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", sshConfig)
 		if err != nil {
 			if strings.Contains(err.Error(), "unable to authenticate") {
 				c.Infof("Authentication failed")
@@ -221,39 +516,95 @@ func (c *Client) connectionLoop() {
 			} else {
 				c.Infof(err.Error())
 			}
+			connerr = err
 			break
 		}
+		//remotes added from here on are sent to the server (see AddRemote)
+		c.mut.Lock()
 		c.config.shared.Version = chshare.BuildVersion
 		conf, _ := chshare.EncodeConfig(c.config.shared)
 		c.Debugf("Sending config")
 		t0 := time.Now()
 		_, configerr, err := sshConn.SendRequest("config", true, conf)
+		if err == nil && len(configerr) == 0 {
+			c.sshConn = sshConn
+		}
+		c.mut.Unlock()
 		if err != nil {
 			c.Infof("Config verification failed")
+			connerr = err
 			break
 		}
 		if len(configerr) > 0 {
 			c.Infof(string(configerr))
+			//servers in maintenance are retried (with backoff)
+			if strings.Contains(string(configerr), chshare.MaintenanceError) {
+				sshConn.Close()
+				connerr = errors.New("server in maintenance")
+				continue
+			}
+			connerr = errors.New(string(configerr))
 			break
 		}
 		c.Infof("Connected (Latency %s)", time.Since(t0))
+		c.setState(StateChange{State: StateConnected, Server: c.server})
 		//connected
 		b.Reset()
-		c.sshConn = sshConn
-		go ssh.DiscardRequests(reqs)
+		c.failures = 0
+		go c.handleRequests(reqs)
 		go c.connectStreams(chans)
+		go c.tun.connect(sshConn)
+		if c.stdio != nil {
+			c.stdioOnce.Do(func() { go c.serveStdio() })
+		}
+		done := make(chan struct{})
+		if c.current > 0 && c.config.Failback > 0 {
+			go c.failback(sshConn, c.current, done)
+		}
 		err = sshConn.Wait()
+		close(done)
 		//disconnected
 		c.sshConn = nil
-		if err != nil && err != io.EOF {
+		if err == io.EOF {
+			err = nil
+		}
+		c.setState(StateChange{State: StateDisconnected, Server: c.server, Err: err})
+		if i := atomic.SwapInt32(&c.failbackTo, -1); i >= 0 {
+			c.use(int(i))
+			c.Infof("Failing back to %s", c.server)
+			continue
+		}
+		if err != nil {
 			connerr = err
 			continue
 		}
 		c.Infof("Disconnected\n")
 	}
+	//closed, rather than given up
+	if !c.running {
+		connerr = nil
+	}
+	c.setState(StateChange{State: StateStopped, Server: c.server, Err: connerr})
+	if gaveUp && c.config.GiveUp == "fail" {
+		c.runningc <- fmt.Errorf("Gave up connecting: %s", connerr)
+	}
+	c.ctl.close()
 	close(c.runningc)
 }
 
+// serveStdio pipes stdin and stdout through the
+// tunnel, stopping the client once they're closed
+func (c *Client) serveStdio() {
+	c.stdio.ServeStdio()
+	c.Close()
+}
+
+// isBusy reports whether the server denied the upgrade for
+// now (when it's full or draining), rather than refusing it
+func isBusy(res *http.Response) bool {
+	return res != nil && (res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable)
+}
+
 //Wait blocks while the client is running.
 //Can only be called once.
 func (c *Client) Wait() error {
@@ -271,7 +622,15 @@ func (c *Client) Close() error {
 
 func (c *Client) connectStreams(chans <-chan ssh.NewChannel) {
 	for ch := range chans {
-		remote := string(ch.ExtraData())
+		requested := string(ch.ExtraData())
+		//only the remotes of reverse remotes are dialed, whichever
+		//address the server asks for (socks streams are checked below)
+		if requested != "socks" && !c.reverseRemote(requested) {
+			c.Debugf("Denied stream to '%s', which isn't a reverse remote", requested)
+			ch.Reject(ssh.Prohibited, "not a reverse remote")
+			continue
+		}
+		remote := chshare.DNSStreamRemote(requested)
 		stream, reqs, err := ch.Accept()
 		if err != nil {
 			c.Debugf("Failed to accept stream: %s", err)
@@ -279,6 +638,35 @@ func (c *Client) connectStreams(chans <-chan ssh.NewChannel) {
 		}
 		go ssh.DiscardRequests(reqs)
 		l := c.Logger.Fork("conn#%d", c.connStats.New())
-		go chshare.HandleTCPStream(l, &c.connStats, stream, remote)
+		if remote == "socks" {
+			//only reverse socks remotes are served
+			if !c.reverseSocks() {
+				l.Debugf("Denied socks stream without a reverse socks remote")
+				stream.Close()
+				continue
+			}
+			go c.handleSocksStream(l.Fork("socks"), stream)
+		} else if addr, udp := chshare.UDPRemote(remote); udp {
+			go chshare.HandleUDPStream(l, &c.connStats, stream, addr, c.config.UDP)
+		} else {
+			go chshare.HandleTCPStream(l, &c.connStats, stream, remote)
+		}
+	}
+}
+
+// reverseRemote reports whether the remote of a stream (see
+// Remote.Remote) is that of one of the client's reverse remotes
+func (c *Client) reverseRemote(remote string) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, r := range c.config.shared.Remotes {
+		if !r.Reverse {
+			continue
+		}
+		//dns remotes stream queries by either protocol
+		if r.Remote() == remote || r.DNS && r.Remote()+"/udp" == remote {
+			return true
+		}
 	}
+	return false
 }
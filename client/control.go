@@ -0,0 +1,158 @@
+package chclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// control serves the client's control API on a unix socket or a
+// loopback address, adding and removing remotes while running:
+//
+//	GET /remotes  lists the remotes
+//	POST /remotes  adds the remote given by the body
+//	DELETE /remotes  removes the remote given by the body (or its name)
+type control struct {
+	client  *Client
+	network string
+	addr    string
+	server  *http.Server
+}
+
+// newControl returns the control API of the address, or nil
+func newControl(addr string, client *Client) (*control, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	network, err := controlNetwork(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &control{client: client, network: network, addr: addr}, nil
+}
+
+// controlNetwork returns "unix" for a socket path,
+// or "tcp" for a loopback host:port
+func controlNetwork(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "unix", nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("Invalid control address '%s' (expected a socket path or a loopback address)", addr)
+	}
+	return "tcp", nil
+}
+
+func (ctl *control) start(ctx context.Context) error {
+	if ctl == nil {
+		return nil
+	}
+	if ctl.network == "unix" {
+		//remove the socket of a previous run
+		if fi, err := os.Stat(ctl.addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(ctl.addr)
+		}
+	}
+	l, err := net.Listen(ctl.network, ctl.addr)
+	if err != nil {
+		return fmt.Errorf("Control API: %s", err)
+	}
+	if ctl.network == "unix" {
+		if err := os.Chmod(ctl.addr, 0600); err != nil {
+			l.Close()
+			return fmt.Errorf("Control API: %s", err)
+		}
+	}
+	ctl.client.Infof("Control API listening on %s", ctl.addr)
+	ctl.server = &http.Server{Handler: http.HandlerFunc(ctl.handle)}
+	go ctl.server.Serve(l)
+	go func() {
+		<-ctx.Done()
+		ctl.close()
+	}()
+	return nil
+}
+
+// close stops serving, removing the socket
+func (ctl *control) close() {
+	if ctl != nil && ctl.server != nil {
+		ctl.server.Close()
+	}
+}
+
+func (ctl *control) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/remotes" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found\n"))
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ctl.client.Remotes())
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	remote := strings.TrimSpace(string(b))
+	switch r.Method {
+	case http.MethodPost:
+		_, err = ctl.client.AddRemote(remote)
+	case http.MethodDelete:
+		_, err = ctl.client.RemoveRemote(remote)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
+
+// ControlRequest sends a request to the control API of the client
+// at addr (see Config.Control), returning the body of its reply
+func ControlRequest(addr, method, remote string) (string, error) {
+	network, err := controlNetwork(addr)
+	if err != nil {
+		return "", err
+	}
+	h := &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://chisel/remotes", strings.NewReader(remote))
+	if err != nil {
+		return "", err
+	}
+	res, err := h.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(strings.TrimSpace(string(b)))
+	}
+	return string(b), nil
+}
@@ -0,0 +1,63 @@
+package chclient
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// discover looks up the servers of the SRV records of Config.Discover
+// (like _chisel._tcp.example.com), ordered by priority and randomly by
+// weight, so that clients spread across the servers of equal priority.
+// TXT records of the same name may set the servers' scheme (http by
+// default, or https for port 443) and path, like "scheme=tls" or
+// "scheme=https path=/tunnel"
+func (c *Client) discover() error {
+	_, records, err := net.LookupSRV("", "", c.config.Discover)
+	if err != nil {
+		return fmt.Errorf("Discovery failed: %s", err)
+	}
+	scheme, path := "", ""
+	txts, _ := net.LookupTXT(c.config.Discover)
+	for _, txt := range txts {
+		for _, field := range strings.Fields(txt) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "scheme":
+				scheme = kv[1]
+			case "path":
+				path = kv[1]
+			}
+		}
+	}
+	var servers []serverURL
+	for _, r := range records {
+		s := scheme
+		if s == "" && r.Port == 443 {
+			s = "https"
+		} else if s == "" {
+			s = "http"
+		}
+		host := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		u, err := parseServer(s + "://" + host + path)
+		if err != nil {
+			return fmt.Errorf("Discovery failed: %s", err)
+		}
+		if u.raw && (c.config.Transport == "h2" || c.config.Transport == "poll" || c.proxy.viaHTTP()) {
+			return fmt.Errorf("Discovery failed: %s servers can't be reached by HTTP (--transport or --proxy)", u.scheme)
+		}
+		servers = append(servers, u)
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("Discovery failed: no servers at %s", c.config.Discover)
+	}
+	c.servers = servers
+	c.failures = 0
+	c.use(0)
+	c.Infof("Discovered %d servers at %s", len(servers), c.config.Discover)
+	return nil
+}
@@ -0,0 +1,136 @@
+package chclient
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serverURL is a server of the client, see Config.Servers
+type serverURL struct {
+	url    string
+	scheme string
+	//tcp:// and tls:// servers carry the tunnel without http
+	raw bool
+}
+
+func parseServer(server string) (serverURL, error) {
+	raw := strings.HasPrefix(server, "tcp://") || strings.HasPrefix(server, "tls://")
+	//apply default scheme
+	if !raw && !strings.HasPrefix(server, "http") {
+		server = "http://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return serverURL{}, err
+	}
+	//apply default port
+	if !regexp.MustCompile(`:\d+$`).MatchString(u.Host) {
+		if u.Scheme == "https" || u.Scheme == "wss" || u.Scheme == "tls" {
+			u.Host = u.Host + ":443"
+		} else {
+			u.Host = u.Host + ":80"
+		}
+	}
+	//swap to websockets scheme
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	return serverURL{url: u.String(), scheme: u.Scheme, raw: raw}, nil
+}
+
+// use switches to the server, which is first tried
+// by websocket (unless polling is configured)
+func (c *Client) use(i int) {
+	c.current = i
+	c.server = c.servers[i].url
+	c.raw = c.servers[i].raw
+	c.poll = c.config.Transport == "poll"
+}
+
+// failover switches to the next server after a connection error,
+// reporting whether it's yet to fail since the client last connected,
+// otherwise the client backs off before trying it (or discovering the
+// servers again)
+func (c *Client) failover() bool {
+	c.failures++
+	if c.failures < len(c.servers) {
+		c.use((c.current + 1) % len(c.servers))
+		return true
+	}
+	c.failures = 0
+	if c.config.Discover != "" {
+		c.servers = nil
+		return false
+	}
+	c.use((c.current + 1) % len(c.servers))
+	return false
+}
+
+// failback probes the servers before the current one until it's
+// disconnected, closing its connection once one of them is healthy
+// so that the client reconnects to it
+func (c *Client) failback(sshConn ssh.Conn, current int, done chan struct{}) {
+	t := time.NewTicker(c.config.Failback)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		for i := 0; i < current; i++ {
+			if c.probe(c.servers[i]) {
+				atomic.StoreInt32(&c.failbackTo, int32(i))
+				sshConn.Close()
+				return
+			}
+		}
+	}
+}
+
+// probe reports whether the server is healthy: whether its /health
+// replies OK or, for tcp:// and tls:// servers, it accepts connections
+func (c *Client) probe(server serverURL) bool {
+	u, err := url.Parse(server.url)
+	if err != nil {
+		return false
+	}
+	if server.raw {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dial := (&net.Dialer{}).DialContext
+		if p := c.proxyFor(server); p != nil {
+			dial = p.DialContext
+		}
+		conn, err := dial(ctx, "tcp", u.Host)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path = "/health"
+	t := &http.Transport{TLSClientConfig: c.tlsConfig()}
+	c.proxyFor(server).transport(t, u.String())
+	defer t.CloseIdleConnections()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	if c.config.HostHeader != "" {
+		req.Host = c.config.HostHeader
+	}
+	res, err := (&http.Client{Transport: t, Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
@@ -0,0 +1,125 @@
+package chclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jpillora/chisel/share"
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHosts records the host keys of the servers trusted on first use
+// (see Config.KnownHosts), in the format of OpenSSH's known_hosts files,
+// like "[chisel.example.com]:443 ecdsa-sha2-nistp256 AAAA...", so the
+// file may be managed with ssh-keygen (-F and -R). Hashed host names
+// and marked (@) lines aren't supported, and are ignored
+type knownHosts struct {
+	path string
+}
+
+// knownHostName returns the name of the server's
+// host:port, as given in known_hosts files
+func knownHostName(server string) string {
+	u, err := url.Parse(server)
+	if err != nil {
+		return server
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return u.Host
+	}
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// keys returns the recorded keys of the host
+func (k *knownHosts) keys(host string) ([]ssh.PublicKey, error) {
+	b, err := ioutil.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read known hosts: %s", err)
+	}
+	var keys []ssh.PublicKey
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == '@' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		found := false
+		for _, name := range strings.Split(fields[0], ",") {
+			if name == host {
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[1:], " ")))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// fingerprints returns the SHA256 fingerprints of the host's keys
+func (k *knownHosts) fingerprints(host string) []string {
+	keys, _ := k.keys(host)
+	var fingerprints []string
+	for _, key := range keys {
+		fingerprints = append(fingerprints, chshare.FingerprintKeySHA256(key))
+	}
+	return fingerprints
+}
+
+// verify checks the host's key against those recorded, recording it
+// when the host has none, in which case it reports that it was added
+func (k *knownHosts) verify(host string, key ssh.PublicKey) (bool, error) {
+	keys, err := k.keys(host)
+	if err != nil {
+		return false, err
+	}
+	if len(keys) == 0 {
+		return true, k.add(host, key)
+	}
+	for _, known := range keys {
+		if bytes.Equal(known.Marshal(), key.Marshal()) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("WARNING: the host key of %s has changed (to %s), which "+
+		"may be an attack, remove its line from %s if the key was replaced",
+		host, chshare.FingerprintKeySHA256(key), k.path)
+}
+
+// add records the host's key
+func (k *knownHosts) add(host string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return fmt.Errorf("Failed to write known hosts: %s", err)
+	}
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write known hosts: %s", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s", host, ssh.MarshalAuthorizedKey(key)); err != nil {
+		return fmt.Errorf("Failed to write known hosts: %s", err)
+	}
+	return nil
+}
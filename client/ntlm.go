@@ -0,0 +1,156 @@
+package chclient
+
+// NTLM (NTLMv2) authentication with upstream proxies (MS-NLMP)
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	ntlmNegotiateUnicode  = 0x00000001
+	ntlmRequestTarget     = 0x00000004
+	ntlmNegotiateNTLM     = 0x00000200
+	ntlmAlwaysSign        = 0x00008000
+	ntlmExtendedSecurity  = 0x00080000
+	ntlmNegotiateTarget   = 0x00800000
+	ntlmNegotiate128      = 0x20000000
+	ntlmNegotiate56       = 0x80000000
+	ntlmAvEOL             = 0
+	ntlmAvTimestamp       = 7
+	ntlmSignature         = "NTLMSSP\x00"
+	ntlmNegotiateFlags    = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM | ntlmAlwaysSign | ntlmExtendedSecurity | ntlmNegotiateTarget | ntlmNegotiate128 | ntlmNegotiate56
+	ntlmAuthenticateStart = 64
+)
+
+// ntlmNegotiate returns the NEGOTIATE_MESSAGE which starts the exchange
+func ntlmNegotiate() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmNegotiateFlags)
+	return b
+}
+
+// ntlmChallenge is the content of a CHALLENGE_MESSAGE
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func parseNTLMChallenge(b []byte) (*ntlmChallenge, error) {
+	if len(b) < 48 || string(b[:8]) != ntlmSignature || binary.LittleEndian.Uint32(b[8:]) != 2 {
+		return nil, errors.New("invalid NTLM challenge")
+	}
+	c := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(b[20:]),
+		challenge: b[24:32],
+	}
+	n := int(binary.LittleEndian.Uint16(b[40:]))
+	off := int(binary.LittleEndian.Uint32(b[44:]))
+	if off+n > len(b) {
+		return nil, errors.New("invalid NTLM challenge")
+	}
+	c.targetInfo = b[off : off+n]
+	return c, nil
+}
+
+// timestamp returns the server's MsvAvTimestamp, if any
+func (c *ntlmChallenge) timestamp() []byte {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		n := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == ntlmAvEOL || 4+n > len(info) {
+			break
+		}
+		if id == ntlmAvTimestamp && n == 8 {
+			return info[4:12]
+		}
+		info = info[4+n:]
+	}
+	return nil
+}
+
+// ntlmAuthenticate returns the AUTHENTICATE_MESSAGE answering the
+// challenge, with the NTLMv2 response of the user, who may be given
+// as DOMAIN\user (or as user@domain, with an empty domain)
+func ntlmAuthenticate(challenge []byte, user, pass string) ([]byte, error) {
+	c, err := parseNTLMChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+	domain := ""
+	if i := strings.Index(user, `\`); i >= 0 {
+		domain, user = user[:i], user[i+1:]
+	}
+	key := ntowfv2(user, pass, domain)
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	timestamp := c.timestamp()
+	lm := make([]byte, 24)
+	if timestamp == nil {
+		timestamp = make([]byte, 8)
+		//FILETIME, 100ns intervals since 1601
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+		lm = append(hmacMD5(key, c.challenge, clientChallenge), clientChallenge...)
+	}
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(c.targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+	nt := append(hmacMD5(key, c.challenge, temp.Bytes()), temp.Bytes()...)
+	fields := [][]byte{lm, nt, utf16le(domain), utf16le(user), nil, nil}
+	b := make([]byte, ntlmAuthenticateStart)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	for i, f := range fields {
+		//each field is its length (twice) and offset
+		at := 12 + 8*i
+		binary.LittleEndian.PutUint16(b[at:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(b[at+2:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(b[at+4:], uint32(len(b)))
+		b = append(b, f...)
+	}
+	binary.LittleEndian.PutUint32(b[60:], c.flags&ntlmNegotiateFlags|ntlmNegotiateUnicode)
+	return b, nil
+}
+
+// ntowfv2 is the user's NTLMv2 key
+func ntowfv2(user, pass, domain string) []byte {
+	h := md4.New()
+	h.Write(utf16le(pass))
+	return hmacMD5(h.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
@@ -0,0 +1,215 @@
+package chclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// OIDCConfig logs in with the OAuth2 device authorization
+// grant (RFC 8628), presenting the resulting token to the server
+type OIDCConfig struct {
+	// Issuer is the OpenID Connect issuer URL
+	Issuer   string
+	ClientID string
+	// Scope defaults to "openid"
+	Scope string
+}
+
+// oidcLogin obtains and caches tokens, refreshing them or
+// repeating the device flow when they are about to expire
+type oidcLogin struct {
+	*chshare.Logger
+	config   OIDCConfig
+	client   *http.Client
+	provider *chshare.OIDCProvider
+	mut      sync.Mutex
+	token    string
+	refresh  string
+	expiry   time.Time
+}
+
+type oidcTokenResponse struct {
+	IDToken      string `json:"id_token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+func newOIDCLogin(c OIDCConfig, logger *chshare.Logger) (*oidcLogin, error) {
+	if c.ClientID == "" {
+		return nil, errors.New("OIDC login requires a client ID")
+	}
+	if c.Scope == "" {
+		c.Scope = "openid"
+	}
+	return &oidcLogin{
+		Logger: logger,
+		config: c,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Token returns a valid token, logging in when required
+func (o *oidcLogin) Token() (string, error) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if o.token != "" && time.Now().Add(time.Minute).Before(o.expiry) {
+		return o.token, nil
+	}
+	if o.provider == nil {
+		p, err := chshare.DiscoverOIDC(o.config.Issuer)
+		if err != nil {
+			return "", err
+		}
+		if p.DeviceAuthorizationEndpoint == "" || p.TokenEndpoint == "" {
+			return "", errors.New("The OIDC issuer does not support the device flow")
+		}
+		o.provider = p
+	}
+	if o.refresh != "" {
+		t, err := o.request(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {o.refresh},
+		})
+		if err == nil {
+			return o.use(t)
+		}
+		o.Debugf("Failed to refresh OIDC token: %s", err)
+		o.refresh = ""
+	}
+	t, err := o.deviceFlow()
+	if err != nil {
+		return "", err
+	}
+	return o.use(t)
+}
+
+// use caches the token response, preferring the ID token since
+// access tokens are not necessarily JWTs
+func (o *oidcLogin) use(t *oidcTokenResponse) (string, error) {
+	o.token = t.IDToken
+	if o.token == "" {
+		o.token = t.AccessToken
+	}
+	if o.token == "" {
+		return "", errors.New("The OIDC token response contained no token")
+	}
+	if t.RefreshToken != "" {
+		o.refresh = t.RefreshToken
+	}
+	o.expiry = tokenExpiry(o.token)
+	if o.expiry.IsZero() {
+		o.expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	return o.token, nil
+}
+
+func (o *oidcLogin) deviceFlow() (*oidcTokenResponse, error) {
+	resp, err := o.client.PostForm(o.provider.DeviceAuthorizationEndpoint, url.Values{
+		"client_id": {o.config.ClientID},
+		"scope":     {o.config.Scope},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("OIDC device authorization failed: %s", err)
+	}
+	defer resp.Body.Close()
+	var auth struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil || resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC device authorization failed: %s", resp.Status)
+	}
+	if auth.VerificationURIComplete != "" {
+		o.Infof("To login, visit %s", auth.VerificationURIComplete)
+	} else {
+		o.Infof("To login, visit %s and enter the code %s", auth.VerificationURI, auth.UserCode)
+	}
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	for auth.ExpiresIn <= 0 || time.Now().Before(deadline) {
+		time.Sleep(interval)
+		t, err := o.request(url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {auth.DeviceCode},
+			"client_id":   {o.config.ClientID},
+		})
+		if err == nil {
+			o.Infof("Logged in")
+			return t, nil
+		}
+		switch t.Error {
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		}
+		return nil, err
+	}
+	return nil, errors.New("The OIDC login expired")
+}
+
+// request calls the token endpoint, returning the decoded
+// response along with an error when a token was not issued
+func (o *oidcLogin) request(form url.Values) (*oidcTokenResponse, error) {
+	if form.Get("client_id") == "" {
+		form.Set("client_id", o.config.ClientID)
+	}
+	t := &oidcTokenResponse{}
+	resp, err := o.client.PostForm(o.provider.TokenEndpoint, form)
+	if err != nil {
+		return t, fmt.Errorf("OIDC token request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(t); err != nil {
+		return t, fmt.Errorf("OIDC token request failed: %s", resp.Status)
+	}
+	if t.Error != "" {
+		if t.Description != "" {
+			return t, fmt.Errorf("OIDC login failed: %s (%s)", t.Error, t.Description)
+		}
+		return t, fmt.Errorf("OIDC login failed: %s", t.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return t, fmt.Errorf("OIDC token request failed: %s", resp.Status)
+	}
+	return t, nil
+}
+
+// tokenExpiry reads the (unverified) expiry of a JWT
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(b, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
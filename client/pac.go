@@ -0,0 +1,1441 @@
+package chclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PAC files (proxy auto-config) are run by a small interpreter of
+// the JavaScript they're written in: function declarations, var (let
+// and const), if, for, while, return, break and continue statements,
+// and expressions of strings, numbers, booleans, null and arrays, with
+// their operators and common methods, along with the PAC functions
+// (like shExpMatch and isInNet, but not dateRange). Regular expressions,
+// objects and switch statements aren't supported.
+
+const (
+	//pacMaxSize is the largest PAC file read
+	pacMaxSize = 1 << 20
+	//pacMaxSteps is the most statements (and loop iterations)
+	//run, so that a broken PAC file can't hang the client
+	pacMaxSteps = 1000000
+	pacMaxDepth = 200
+)
+
+// loadPAC reads the PAC file of the http:// or https:// URL
+// (which is fetched without any proxy) or path
+func loadPAC(location string) (string, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		b, err := ioutil.ReadFile(strings.TrimPrefix(location, "file://"))
+		return string(b), err
+	}
+	client := &http.Client{Transport: &http.Transport{}, Timeout: 10 * time.Second}
+	res, err := client.Get(location)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unexpected status %s", res.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, pacMaxSize))
+	return string(b), err
+}
+
+// pacProxyURL returns the URL of the first proxy of the result of
+// FindProxyForURL (like "PROXY proxy:3128; DIRECT") which the client
+// supports (PROXY, HTTP, HTTPS, SOCKS or SOCKS5), or nil for DIRECT
+func pacProxyURL(result string) (*url.URL, error) {
+	if strings.TrimSpace(result) == "" {
+		return nil, nil
+	}
+	schemes := map[string]string{"PROXY": "http", "HTTP": "http", "HTTPS": "https", "SOCKS": "socks5", "SOCKS5": "socks5"}
+	for _, entry := range strings.Split(result, ";") {
+		f := strings.Fields(entry)
+		if len(f) == 1 && strings.ToUpper(f[0]) == "DIRECT" {
+			return nil, nil
+		}
+		if len(f) == 2 && schemes[strings.ToUpper(f[0])] != "" {
+			return url.Parse(schemes[strings.ToUpper(f[0])] + "://" + f[1])
+		}
+	}
+	return nil, fmt.Errorf("No supported proxy in '%s'", result)
+}
+
+// findProxyForURL runs the PAC file's FindProxyForURL of the URL
+func findProxyForURL(src, u, host string) (string, error) {
+	toks, err := pacLex(src)
+	if err != nil {
+		return "", err
+	}
+	p := &pacParser{toks: toks}
+	body, err := p.statements("")
+	if err != nil {
+		return "", err
+	}
+	global := &pacEnv{vars: map[string]pacValue{}, run: &pacRun{}}
+	for name, f := range pacBuiltins {
+		global.vars[name] = f
+	}
+	if _, _, err := body(global); err != nil {
+		return "", err
+	}
+	f, err := global.get("FindProxyForURL")
+	if err != nil {
+		return "", err
+	}
+	v, err := global.call(f, []pacValue{u, host})
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok && v != nil {
+		return "", errors.New("FindProxyForURL didn't return a string")
+	}
+	return s, nil
+}
+
+// pacValue is a string, float64, bool, nil (null and undefined),
+// *pacArray, *pacClosure or pacBuiltin
+type pacValue interface{}
+
+type pacArray struct {
+	items []pacValue
+}
+
+type pacClosure struct {
+	params []string
+	body   pacStmt
+	scope  *pacEnv
+}
+
+type pacBuiltin func(args []pacValue) (pacValue, error)
+
+type pacRun struct {
+	steps int
+	depth int
+}
+
+// pacEnv is the scope of a function (or the global scope)
+type pacEnv struct {
+	vars   map[string]pacValue
+	parent *pacEnv
+	run    *pacRun
+}
+
+func (e *pacEnv) step() error {
+	e.run.steps++
+	if e.run.steps > pacMaxSteps {
+		return errors.New("PAC file runs for too long")
+	}
+	return nil
+}
+
+func (e *pacEnv) get(name string) (pacValue, error) {
+	for s := e; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not defined", name)
+}
+
+// set assigns the variable of the closest scope which declares
+// it or, when none does, the global variable
+func (e *pacEnv) set(name string, v pacValue) {
+	s := e
+	for s.parent != nil {
+		if _, ok := s.vars[name]; ok {
+			break
+		}
+		s = s.parent
+	}
+	s.vars[name] = v
+}
+
+func (e *pacEnv) call(f pacValue, args []pacValue) (pacValue, error) {
+	switch f := f.(type) {
+	case pacBuiltin:
+		return f(args)
+	case *pacClosure:
+		if e.run.depth >= pacMaxDepth {
+			return nil, errors.New("PAC file recurses too deeply")
+		}
+		e.run.depth++
+		defer func() { e.run.depth-- }()
+		local := &pacEnv{vars: map[string]pacValue{}, parent: f.scope, run: e.run}
+		for i, name := range f.params {
+			local.vars[name] = pacArg(args, i)
+		}
+		_, v, err := f.body(local)
+		return v, err
+	}
+	return nil, errors.New("not a function")
+}
+
+func pacArg(args []pacValue, i int) pacValue {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// lexer
+
+type pacToken struct {
+	//kind is 'i' (identifier), 'n' (number), 's' (string),
+	//'p' (punctuator) or 0 (the end)
+	kind byte
+	text string
+	num  float64
+	line int
+}
+
+var pacPunctuators = []string{
+	"===", "!==", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=", "*=", "/=",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "?", ":", "=", "<", ">", "+", "-", "*", "/", "%", "!",
+}
+
+func pacLex(src string) ([]pacToken, error) {
+	var toks []pacToken
+	line := 1
+	isIdent := func(c byte, first bool) bool {
+		return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+	}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			j := strings.Index(src[i+2:], "*/")
+			if j < 0 {
+				return nil, fmt.Errorf("PAC file line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+j], "\n")
+			i += j + 4
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c && src[j] != '\n'; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					case 'r':
+						b.WriteByte('\r')
+					default:
+						b.WriteByte(src[j])
+					}
+					continue
+				}
+				b.WriteByte(src[j])
+			}
+			if j >= len(src) || src[j] != c {
+				return nil, fmt.Errorf("PAC file line %d: unterminated string", line)
+			}
+			toks = append(toks, pacToken{kind: 's', text: b.String(), line: line})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			for j < len(src) && (isIdent(src[j], false) || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				//like 0x1F
+				h, herr := strconv.ParseInt(src[i:j], 0, 64)
+				if herr != nil {
+					return nil, fmt.Errorf("PAC file line %d: invalid number %s", line, src[i:j])
+				}
+				n = float64(h)
+			}
+			toks = append(toks, pacToken{kind: 'n', text: src[i:j], num: n, line: line})
+			i = j
+		case isIdent(c, true):
+			j := i
+			for j < len(src) && isIdent(src[j], false) {
+				j++
+			}
+			toks = append(toks, pacToken{kind: 'i', text: src[i:j], line: line})
+			i = j
+		default:
+			p := ""
+			for _, s := range pacPunctuators {
+				if strings.HasPrefix(src[i:], s) {
+					p = s
+					break
+				}
+			}
+			if p == "" {
+				return nil, fmt.Errorf("PAC file line %d: unsupported character %q", line, c)
+			}
+			toks = append(toks, pacToken{kind: 'p', text: p, line: line})
+			i += len(p)
+		}
+	}
+	return append(toks, pacToken{line: line}), nil
+}
+
+// parser, which compiles the statements and expressions to closures
+
+type pacFlow int
+
+const (
+	pacNext pacFlow = iota
+	pacReturn
+	pacBreak
+	pacContinue
+)
+
+type pacStmt func(e *pacEnv) (pacFlow, pacValue, error)
+
+type pacExpr func(e *pacEnv) (pacValue, error)
+
+type pacParser struct {
+	toks []pacToken
+	pos  int
+}
+
+func (p *pacParser) peek() pacToken {
+	return p.toks[p.pos]
+}
+
+// is reports whether the next token is the punctuator or keyword
+func (p *pacParser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == 'p' || t.kind == 'i') && t.text == text
+}
+
+func (p *pacParser) accept(text string) bool {
+	if p.is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *pacParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *pacParser) unexpected() error {
+	t := p.peek()
+	if t.kind == 0 {
+		return fmt.Errorf("PAC file line %d: unexpected end", t.line)
+	}
+	return fmt.Errorf("PAC file line %d: unexpected '%s'", t.line, t.text)
+}
+
+func (p *pacParser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != 'i' {
+		return "", p.unexpected()
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// statements parses statements up to the closing brace (or the end,
+// when end is empty), whose function declarations run first
+func (p *pacParser) statements(end string) (pacStmt, error) {
+	var funcs, stmts []pacStmt
+	for !(end == "" && p.peek().kind == 0) && !p.is(end) {
+		if p.peek().kind == 0 {
+			return nil, p.unexpected()
+		}
+		isFunc := p.is("function")
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if isFunc {
+			funcs = append(funcs, s)
+		} else {
+			stmts = append(stmts, s)
+		}
+	}
+	all := append(funcs, stmts...)
+	return func(e *pacEnv) (pacFlow, pacValue, error) {
+		for _, s := range all {
+			if flow, v, err := s(e); err != nil || flow != pacNext {
+				return flow, v, err
+			}
+		}
+		return pacNext, nil, nil
+	}, nil
+}
+
+func (p *pacParser) statement() (pacStmt, error) {
+	switch {
+	case p.accept("{"):
+		body, err := p.statements("}")
+		if err != nil {
+			return nil, err
+		}
+		return body, p.expect("}")
+	case p.accept(";"):
+		return func(*pacEnv) (pacFlow, pacValue, error) { return pacNext, nil, nil }, nil
+	case p.accept("function"):
+		return p.function()
+	case p.is("var") || p.is("let") || p.is("const"):
+		p.pos++
+		s, err := p.declarations()
+		p.accept(";")
+		return s, err
+	case p.accept("if"):
+		return p.ifStatement()
+	case p.accept("while"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		cond, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		body, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		return pacLoop(cond, nil, body), nil
+	case p.accept("for"):
+		return p.forStatement()
+	case p.accept("return"):
+		var value pacExpr
+		if !p.is(";") && !p.is("}") && p.peek().kind != 0 {
+			var err error
+			if value, err = p.expression(); err != nil {
+				return nil, err
+			}
+		}
+		p.accept(";")
+		return func(e *pacEnv) (pacFlow, pacValue, error) {
+			if value == nil {
+				return pacReturn, nil, nil
+			}
+			v, err := value(e)
+			return pacReturn, v, err
+		}, nil
+	case p.accept("break"):
+		p.accept(";")
+		return func(*pacEnv) (pacFlow, pacValue, error) { return pacBreak, nil, nil }, nil
+	case p.accept("continue"):
+		p.accept(";")
+		return func(*pacEnv) (pacFlow, pacValue, error) { return pacContinue, nil, nil }, nil
+	}
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.accept(";")
+	return func(e *pacEnv) (pacFlow, pacValue, error) {
+		if err := e.step(); err != nil {
+			return pacNext, nil, err
+		}
+		_, err := x(e)
+		return pacNext, nil, err
+	}, nil
+}
+
+func (p *pacParser) function() (pacStmt, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var params []string
+	for !p.accept(")") {
+		if len(params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		param, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, param)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	body, err := p.statements("}")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+	return func(e *pacEnv) (pacFlow, pacValue, error) {
+		e.vars[name] = &pacClosure{params: params, body: body, scope: e}
+		return pacNext, nil, nil
+	}, nil
+}
+
+// declarations parses the variables of var, let or const
+// (which are all scoped to the function)
+func (p *pacParser) declarations() (pacStmt, error) {
+	type decl struct {
+		name  string
+		value pacExpr
+	}
+	var decls []decl
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		d := decl{name: name}
+		if p.accept("=") {
+			if d.value, err = p.expression(); err != nil {
+				return nil, err
+			}
+		}
+		decls = append(decls, d)
+		if !p.accept(",") {
+			break
+		}
+	}
+	return func(e *pacEnv) (pacFlow, pacValue, error) {
+		for _, d := range decls {
+			if d.value == nil {
+				if _, ok := e.vars[d.name]; !ok {
+					e.vars[d.name] = nil
+				}
+				continue
+			}
+			v, err := d.value(e)
+			if err != nil {
+				return pacNext, nil, err
+			}
+			e.vars[d.name] = v
+		}
+		return pacNext, nil, nil
+	}, nil
+}
+
+func (p *pacParser) ifStatement() (pacStmt, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	cond, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	then, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	var otherwise pacStmt
+	if p.accept("else") {
+		if otherwise, err = p.statement(); err != nil {
+			return nil, err
+		}
+	}
+	return func(e *pacEnv) (pacFlow, pacValue, error) {
+		v, err := cond(e)
+		if err != nil {
+			return pacNext, nil, err
+		}
+		if pacTruthy(v) {
+			return then(e)
+		} else if otherwise != nil {
+			return otherwise(e)
+		}
+		return pacNext, nil, nil
+	}, nil
+}
+
+func (p *pacParser) forStatement() (pacStmt, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var init pacStmt
+	var cond, update pacExpr
+	var err error
+	if p.is("var") || p.is("let") || p.is("const") {
+		p.pos++
+		init, err = p.declarations()
+	} else if !p.is(";") {
+		var x pacExpr
+		x, err = p.expression()
+		init = func(e *pacEnv) (pacFlow, pacValue, error) {
+			_, err := x(e)
+			return pacNext, nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(";") {
+		if cond, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(")") {
+		if update, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	body, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	loop := pacLoop(cond, update, body)
+	return func(e *pacEnv) (pacFlow, pacValue, error) {
+		if init != nil {
+			if _, _, err := init(e); err != nil {
+				return pacNext, nil, err
+			}
+		}
+		return loop(e)
+	}, nil
+}
+
+// pacLoop runs the body while the condition (if any) holds,
+// followed by the update (if any) after each iteration
+func pacLoop(cond, update pacExpr, body pacStmt) pacStmt {
+	return func(e *pacEnv) (pacFlow, pacValue, error) {
+		for {
+			if err := e.step(); err != nil {
+				return pacNext, nil, err
+			}
+			if cond != nil {
+				v, err := cond(e)
+				if err != nil {
+					return pacNext, nil, err
+				}
+				if !pacTruthy(v) {
+					return pacNext, nil, nil
+				}
+			}
+			flow, v, err := body(e)
+			if err != nil || flow == pacReturn {
+				return flow, v, err
+			}
+			if flow == pacBreak {
+				return pacNext, nil, nil
+			}
+			if update != nil {
+				if _, err := update(e); err != nil {
+					return pacNext, nil, err
+				}
+			}
+		}
+	}
+}
+
+func (p *pacParser) expression() (pacExpr, error) {
+	//assignments, of variables only
+	if t := p.peek(); t.kind == 'i' {
+		next := p.toks[p.pos+1]
+		if next.kind == 'p' && (next.text == "=" || next.text == "+=" || next.text == "-=" || next.text == "*=" || next.text == "/=") {
+			p.pos += 2
+			value, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return func(e *pacEnv) (pacValue, error) {
+				v, err := value(e)
+				if err != nil {
+					return nil, err
+				}
+				if next.text != "=" {
+					old, err := e.get(t.text)
+					if err != nil {
+						return nil, err
+					}
+					v = pacOperate(next.text[:1], old, v)
+				}
+				e.set(t.text, v)
+				return v, nil
+			}, nil
+		}
+	}
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	then, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return func(e *pacEnv) (pacValue, error) {
+		v, err := cond(e)
+		if err != nil {
+			return nil, err
+		}
+		if pacTruthy(v) {
+			return then(e)
+		}
+		return otherwise(e)
+	}, nil
+}
+
+// pacLevels are the binary operators, by increasing precedence
+var pacLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"===", "!==", "==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *pacParser) binary(level int) (pacExpr, error) {
+	if level == len(pacLevels) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range pacLevels[level] {
+			if p.is(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = pacBinary(op, left, right)
+	}
+}
+
+func pacBinary(op string, left, right pacExpr) pacExpr {
+	return func(e *pacEnv) (pacValue, error) {
+		a, err := left(e)
+		if err != nil {
+			return nil, err
+		}
+		//(short circuits, with the value of the operand)
+		if op == "&&" && !pacTruthy(a) || op == "||" && pacTruthy(a) {
+			return a, nil
+		}
+		b, err := right(e)
+		if err != nil {
+			return nil, err
+		}
+		return pacOperate(op, a, b), nil
+	}
+}
+
+func pacOperate(op string, a, b pacValue) pacValue {
+	switch op {
+	case "&&", "||":
+		return b
+	case "==", "!=", "===", "!==":
+		eq := pacEqual(a, b, len(op) == 3)
+		return eq == (op[0] == '=')
+	}
+	sa, aok := a.(string)
+	sb, bok := b.(string)
+	if op == "+" && (aok || bok) {
+		return pacString(a) + pacString(b)
+	}
+	if aok && bok {
+		switch op {
+		case "<":
+			return sa < sb
+		case ">":
+			return sa > sb
+		case "<=":
+			return sa <= sb
+		case ">=":
+			return sa >= sb
+		}
+	}
+	x, y := pacNumber(a), pacNumber(b)
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		return x / y
+	case "%":
+		return math.Mod(x, y)
+	case "<":
+		return x < y
+	case ">":
+		return x > y
+	case "<=":
+		return x <= y
+	case ">=":
+		return x >= y
+	}
+	return nil
+}
+
+func (p *pacParser) unary() (pacExpr, error) {
+	switch {
+	case p.accept("!"):
+		x, err := p.unary()
+		return func(e *pacEnv) (pacValue, error) {
+			v, err := x(e)
+			return !pacTruthy(v), err
+		}, err
+	case p.accept("-"):
+		x, err := p.unary()
+		return func(e *pacEnv) (pacValue, error) {
+			v, err := x(e)
+			return -pacNumber(v), err
+		}, err
+	case p.accept("+"):
+		x, err := p.unary()
+		return func(e *pacEnv) (pacValue, error) {
+			v, err := x(e)
+			return pacNumber(v), err
+		}, err
+	case p.accept("typeof"):
+		//(of variables which may not be defined)
+		t, next := p.peek(), p.toks[p.pos+1]
+		suffixed := next.kind == 'p' && (next.text == "(" || next.text == "." || next.text == "[" || next.text == "++" || next.text == "--")
+		if t.kind == 'i' && !suffixed {
+			if _, err := p.primary(); err != nil {
+				return nil, err
+			}
+			return func(e *pacEnv) (pacValue, error) {
+				v, err := e.get(t.text)
+				if err != nil {
+					return "undefined", nil
+				}
+				return pacTypeof(v), nil
+			}, nil
+		}
+		x, err := p.unary()
+		return func(e *pacEnv) (pacValue, error) {
+			v, err := x(e)
+			return pacTypeof(v), err
+		}, err
+	case p.is("++") || p.is("--"):
+		op := p.peek().text
+		p.pos++
+		name, err := p.ident()
+		return pacIncrement(name, op, true), err
+	}
+	return p.postfix()
+}
+
+// pacIncrement increments (or decrements) the
+// variable, with its new value when prefix
+func pacIncrement(name, op string, prefix bool) pacExpr {
+	return func(e *pacEnv) (pacValue, error) {
+		v, err := e.get(name)
+		if err != nil {
+			return nil, err
+		}
+		n := pacNumber(v)
+		m := n + 1
+		if op == "--" {
+			m = n - 1
+		}
+		e.set(name, m)
+		if prefix {
+			return m, nil
+		}
+		return n, nil
+	}
+}
+
+func (p *pacParser) postfix() (pacExpr, error) {
+	name := ""
+	if t := p.peek(); t.kind == 'i' {
+		name = t.text
+	}
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("("):
+			args, err := p.arguments()
+			if err != nil {
+				return nil, err
+			}
+			callee := x
+			x = func(e *pacEnv) (pacValue, error) {
+				f, err := callee(e)
+				if err != nil {
+					return nil, err
+				}
+				values, err := pacValues(e, args)
+				if err != nil {
+					return nil, err
+				}
+				return e.call(f, values)
+			}
+		case p.accept("."):
+			prop, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			obj := x
+			if p.accept("(") {
+				args, err := p.arguments()
+				if err != nil {
+					return nil, err
+				}
+				x = func(e *pacEnv) (pacValue, error) {
+					o, err := obj(e)
+					if err != nil {
+						return nil, err
+					}
+					values, err := pacValues(e, args)
+					if err != nil {
+						return nil, err
+					}
+					return pacMethod(o, prop, values)
+				}
+			} else {
+				x = func(e *pacEnv) (pacValue, error) {
+					o, err := obj(e)
+					if err != nil {
+						return nil, err
+					}
+					return pacProperty(o, prop)
+				}
+			}
+		case p.accept("["):
+			index, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			obj := x
+			x = func(e *pacEnv) (pacValue, error) {
+				o, err := obj(e)
+				if err != nil {
+					return nil, err
+				}
+				i, err := index(e)
+				if err != nil {
+					return nil, err
+				}
+				return pacIndex(o, i)
+			}
+		case name != "" && (p.is("++") || p.is("--")):
+			op := p.peek().text
+			p.pos++
+			return pacIncrement(name, op, false), nil
+		default:
+			return x, nil
+		}
+		//only variables are incremented
+		name = ""
+	}
+}
+
+func (p *pacParser) arguments() ([]pacExpr, error) {
+	var args []pacExpr
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, x)
+	}
+	return args, nil
+}
+
+func pacValues(e *pacEnv, xs []pacExpr) ([]pacValue, error) {
+	values := make([]pacValue, len(xs))
+	for i, x := range xs {
+		v, err := x(e)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func (p *pacParser) primary() (pacExpr, error) {
+	t := p.peek()
+	constant := func(v pacValue) (pacExpr, error) {
+		p.pos++
+		return func(*pacEnv) (pacValue, error) { return v, nil }, nil
+	}
+	switch t.kind {
+	case 'n':
+		return constant(t.num)
+	case 's':
+		return constant(t.text)
+	case 'i':
+		switch t.text {
+		case "true":
+			return constant(true)
+		case "false":
+			return constant(false)
+		case "null", "undefined":
+			return constant(nil)
+		case "function", "var", "let", "const", "if", "else", "for", "while", "return", "break", "continue", "switch", "new", "in":
+			return nil, p.unexpected()
+		}
+		p.pos++
+		return func(e *pacEnv) (pacValue, error) { return e.get(t.text) }, nil
+	}
+	switch {
+	case p.accept("("):
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case p.accept("["):
+		var items []pacExpr
+		for !p.accept("]") {
+			if len(items) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				if p.accept("]") {
+					//trailing comma
+					break
+				}
+			}
+			x, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, x)
+		}
+		return func(e *pacEnv) (pacValue, error) {
+			values, err := pacValues(e, items)
+			return &pacArray{items: values}, err
+		}, nil
+	}
+	return nil, p.unexpected()
+}
+
+// values
+
+func pacTruthy(v pacValue) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func pacNumber(v pacValue) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+	}
+	return math.NaN()
+}
+
+func pacString(v pacValue) string {
+	switch v := v.(type) {
+	case nil:
+		return "undefined"
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case *pacArray:
+		s := make([]string, len(v.items))
+		for i, item := range v.items {
+			if item != nil {
+				s[i] = pacString(item)
+			}
+		}
+		return strings.Join(s, ",")
+	}
+	return "function"
+}
+
+func pacTypeof(v pacValue) string {
+	switch v.(type) {
+	case nil:
+		return "undefined"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case *pacArray:
+		return "object"
+	}
+	return "function"
+}
+
+// pacEqual compares the values, strictly (===) or loosely (==),
+// when numbers, strings and booleans are compared as numbers
+func pacEqual(a, b pacValue, strict bool) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	ta, tb := pacTypeof(a), pacTypeof(b)
+	switch {
+	case ta == "function" || tb == "function":
+		//(which can't be compared)
+		return false
+	case ta == tb:
+		return a == b
+	case strict || ta == "object" || tb == "object":
+		return false
+	}
+	return pacNumber(a) == pacNumber(b)
+}
+
+func pacProperty(o pacValue, name string) (pacValue, error) {
+	if name == "length" {
+		switch o := o.(type) {
+		case string:
+			return float64(len(o)), nil
+		case *pacArray:
+			return float64(len(o.items)), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported property %s of %s", name, pacTypeof(o))
+}
+
+func pacIndex(o pacValue, i pacValue) (pacValue, error) {
+	if name, ok := i.(string); ok {
+		return pacProperty(o, name)
+	}
+	n := int(pacNumber(i))
+	switch o := o.(type) {
+	case string:
+		if n >= 0 && n < len(o) {
+			return o[n : n+1], nil
+		}
+		return nil, nil
+	case *pacArray:
+		if n >= 0 && n < len(o.items) {
+			return o.items[n], nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("can't index %s", pacTypeof(o))
+}
+
+func pacMethod(o pacValue, name string, args []pacValue) (pacValue, error) {
+	//arg returns the argument as an int, or the default
+	arg := func(i, def int) int {
+		if v := pacArg(args, i); v != nil {
+			return int(pacNumber(v))
+		}
+		return def
+	}
+	str := func(i int) string {
+		return pacString(pacArg(args, i))
+	}
+	switch o := o.(type) {
+	case string:
+		//clamp restricts an index to the string
+		clamp := func(i int) int {
+			return int(math.Max(0, math.Min(float64(i), float64(len(o)))))
+		}
+		//relative indexes count back from the end
+		relative := func(i int) int {
+			if i < 0 {
+				i += len(o)
+			}
+			return clamp(i)
+		}
+		switch name {
+		case "toLowerCase":
+			return strings.ToLower(o), nil
+		case "toUpperCase":
+			return strings.ToUpper(o), nil
+		case "trim":
+			return strings.TrimSpace(o), nil
+		case "indexOf":
+			from := clamp(arg(1, 0))
+			i := strings.Index(o[from:], str(0))
+			if i >= 0 {
+				i += from
+			}
+			return float64(i), nil
+		case "lastIndexOf":
+			return float64(strings.LastIndex(o, str(0))), nil
+		case "includes":
+			return strings.Contains(o, str(0)), nil
+		case "startsWith":
+			return strings.HasPrefix(o, str(0)), nil
+		case "endsWith":
+			return strings.HasSuffix(o, str(0)), nil
+		case "charAt":
+			v, err := pacIndex(o, float64(arg(0, 0)))
+			if v == nil {
+				v = ""
+			}
+			return v, err
+		case "substring":
+			a, b := clamp(arg(0, 0)), clamp(arg(1, len(o)))
+			if a > b {
+				a, b = b, a
+			}
+			return o[a:b], nil
+		case "substr":
+			a := relative(arg(0, 0))
+			return o[a:clamp(a+arg(1, len(o)))], nil
+		case "slice":
+			a, b := relative(arg(0, 0)), relative(arg(1, len(o)))
+			if a > b {
+				return "", nil
+			}
+			return o[a:b], nil
+		case "split":
+			var parts []string
+			if pacArg(args, 0) == nil {
+				parts = []string{o}
+			} else {
+				parts = strings.Split(o, str(0))
+			}
+			items := make([]pacValue, len(parts))
+			for i, s := range parts {
+				items[i] = s
+			}
+			return &pacArray{items: items}, nil
+		case "replace":
+			return strings.Replace(o, str(0), str(1), 1), nil
+		}
+	case *pacArray:
+		switch name {
+		case "indexOf", "includes":
+			i := -1
+			for j, item := range o.items {
+				if pacEqual(item, pacArg(args, 0), true) {
+					i = j
+					break
+				}
+			}
+			if name == "includes" {
+				return i >= 0, nil
+			}
+			return float64(i), nil
+		case "join":
+			sep := ","
+			if pacArg(args, 0) != nil {
+				sep = str(0)
+			}
+			s := make([]string, len(o.items))
+			for i, item := range o.items {
+				if item != nil {
+					s[i] = pacString(item)
+				}
+			}
+			return strings.Join(s, sep), nil
+		case "push":
+			o.items = append(o.items, args...)
+			return float64(len(o.items)), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported method %s of %s", name, pacTypeof(o))
+}
+
+// the PAC functions
+
+var pacBuiltins = map[string]pacBuiltin{
+	"isPlainHostName": func(args []pacValue) (pacValue, error) {
+		return !strings.Contains(pacString(pacArg(args, 0)), "."), nil
+	},
+	"dnsDomainIs": func(args []pacValue) (pacValue, error) {
+		host, domain := pacString(pacArg(args, 0)), pacString(pacArg(args, 1))
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain)), nil
+	},
+	"localHostOrDomainIs": func(args []pacValue) (pacValue, error) {
+		host, hostdom := strings.ToLower(pacString(pacArg(args, 0))), strings.ToLower(pacString(pacArg(args, 1)))
+		return host == hostdom || !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."), nil
+	},
+	"isResolvable": func(args []pacValue) (pacValue, error) {
+		return pacResolve(pacString(pacArg(args, 0))) != nil, nil
+	},
+	"isInNet": func(args []pacValue) (pacValue, error) {
+		ip := pacResolve(pacString(pacArg(args, 0)))
+		pattern := net.ParseIP(pacString(pacArg(args, 1))).To4()
+		mask := net.ParseIP(pacString(pacArg(args, 2))).To4()
+		if ip == nil || pattern == nil || mask == nil {
+			return false, nil
+		}
+		return ip.Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask))), nil
+	},
+	"dnsResolve": func(args []pacValue) (pacValue, error) {
+		if ip := pacResolve(pacString(pacArg(args, 0))); ip != nil {
+			return ip.String(), nil
+		}
+		return nil, nil
+	},
+	"myIpAddress": func(args []pacValue) (pacValue, error) {
+		//the address of the default route (no packets are sent)
+		conn, err := net.Dial("udp4", "198.51.100.1:53")
+		if err != nil {
+			return "127.0.0.1", nil
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+	},
+	"dnsDomainLevels": func(args []pacValue) (pacValue, error) {
+		return float64(strings.Count(pacString(pacArg(args, 0)), ".")), nil
+	},
+	"shExpMatch": func(args []pacValue) (pacValue, error) {
+		//* matches any characters (including /) and ? any one
+		re := regexp.QuoteMeta(pacString(pacArg(args, 1)))
+		re = strings.Replace(strings.Replace(re, `\*`, ".*", -1), `\?`, ".", -1)
+		return regexp.MustCompile("^(?s:" + re + ")$").MatchString(pacString(pacArg(args, 0))), nil
+	},
+	"weekdayRange": func(args []pacValue) (pacValue, error) {
+		now, args := pacNow(args)
+		days := "SUNMONTUEWEDTHUFRISAT"
+		day := func(i int) int {
+			return strings.Index(days, strings.ToUpper(pacString(pacArg(args, i)))) / 3
+		}
+		from, to, today := day(0), day(0), int(now.Weekday())
+		if len(args) > 1 {
+			to = day(1)
+		}
+		if from < 0 || to < 0 {
+			return false, nil
+		}
+		if from <= to {
+			return from <= today && today <= to, nil
+		}
+		return today >= from || today <= to, nil
+	},
+	"timeRange": func(args []pacValue) (pacValue, error) {
+		now, args := pacNow(args)
+		n := make([]int, len(args))
+		for i, a := range args {
+			n[i] = int(pacNumber(a))
+		}
+		hour := now.Hour()
+		secs := hour*3600 + now.Minute()*60 + now.Second()
+		var from, to int
+		switch len(n) {
+		case 1:
+			return hour == n[0], nil
+		case 2:
+			from, to = n[0]*3600, n[1]*3600
+		case 4:
+			from, to = n[0]*3600+n[1]*60, n[2]*3600+n[3]*60
+		case 6:
+			from, to = n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5]
+		default:
+			return false, nil
+		}
+		if from <= to {
+			return from <= secs && secs < to, nil
+		}
+		return secs >= from || secs < to, nil
+	},
+	"alert": func(args []pacValue) (pacValue, error) {
+		return nil, nil
+	},
+}
+
+// pacNow returns the time, in UTC when the last argument
+// is "GMT", and the arguments without it
+func pacNow(args []pacValue) (time.Time, []pacValue) {
+	if n := len(args); n > 0 && pacArg(args, n-1) == "GMT" {
+		return time.Now().UTC(), args[:n-1]
+	}
+	return time.Now(), args
+}
+
+// pacResolve returns the IPv4 address of the host, or nil
+func pacResolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
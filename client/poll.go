@@ -0,0 +1,163 @@
+package chclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// pollMaxPending is the most data written ahead of its POST
+const pollMaxPending = 1 << 20
+
+// dialPoll carries the tunnel over a series of plain HTTP requests,
+// for proxies which refuse websockets: one opens the tunnel, after
+// which POSTs send data, one at a time, while GETs wait for data
+// (see the server's pollTunnels)
+func (c *Client) dialPoll(headers http.Header) (net.Conn, error) {
+	t := &http.Transport{TLSHandshakeTimeout: 45 * time.Second, TLSClientConfig: c.tlsConfig()}
+	p := &pollConn{
+		client:  &http.Client{Transport: t},
+		server:  strings.Replace(c.server, "ws", "http", 1),
+		headers: headers,
+	}
+	c.currentProxy.transport(t, p.server)
+	p.cond = sync.NewCond(&p.mut)
+	res, err := p.do(http.MethodPost, "open", nil)
+	if err != nil {
+		return nil, err
+	}
+	id, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	p.headers.Set(chshare.PollHeader, string(id))
+	p.in, p.inW = io.Pipe()
+	go p.receive()
+	go p.send()
+	return chshare.NewRWCConn(p), nil
+}
+
+// pollConn is the client's side of a polling tunnel
+type pollConn struct {
+	client  *http.Client
+	server  string
+	headers http.Header
+	in      *io.PipeReader
+	inW     *io.PipeWriter
+	mut     sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closed  bool
+}
+
+// do sends a request of the tunnel, failing unless it succeeds
+func (p *pollConn) do(method, id string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, p.server, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = p.headers.Clone()
+	if h := req.Header.Get("Host"); h != "" {
+		req.Host = h
+	}
+	req.Header.Set(chshare.H2ProtocolHeader, chshare.ProtocolVersion)
+	if id != "" {
+		req.Header.Set(chshare.PollHeader, id)
+	}
+	req.Header.Set("Cache-Control", "no-cache")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("Unexpected status %s", res.Status)
+	}
+	return res, nil
+}
+
+// receive polls for data until the tunnel is closed
+func (p *pollConn) receive() {
+	for {
+		res, err := p.do(http.MethodGet, "", nil)
+		if err == nil {
+			_, err = io.Copy(p.inW, res.Body)
+			res.Body.Close()
+		}
+		if err != nil {
+			p.inW.CloseWithError(err)
+			p.Close()
+			return
+		}
+	}
+}
+
+// send posts the pending data, one request at a time
+func (p *pollConn) send() {
+	for {
+		p.mut.Lock()
+		for len(p.pending) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mut.Unlock()
+			return
+		}
+		body := p.pending
+		p.pending = nil
+		p.cond.Broadcast()
+		p.mut.Unlock()
+		res, err := p.do(http.MethodPost, "", body)
+		if err != nil {
+			p.inW.CloseWithError(err)
+			p.Close()
+			return
+		}
+		res.Body.Close()
+	}
+}
+
+func (p *pollConn) Read(b []byte) (int, error) {
+	return p.in.Read(b)
+}
+
+func (p *pollConn) Write(b []byte) (int, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for len(p.pending) >= pollMaxPending && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return 0, errors.New("tunnel closed")
+	}
+	p.pending = append(p.pending, b...)
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (p *pollConn) Close() error {
+	p.mut.Lock()
+	if p.closed {
+		p.mut.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.cond.Broadcast()
+	p.mut.Unlock()
+	p.inW.Close()
+	//the server closes its side too
+	if res, err := p.do(http.MethodDelete, "", nil); err == nil {
+		res.Body.Close()
+	}
+	return nil
+}
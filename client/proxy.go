@@ -0,0 +1,396 @@
+package chclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// proxyDialer connects to the server through an upstream proxy (see
+// Config.HTTPProxy), either an HTTP proxy, with a CONNECT request
+// authenticated with the credentials of the proxy URL by the strongest
+// scheme the proxy offers: NTLM (as itself or within Negotiate), Digest
+// or Basic, or a SOCKS5 proxy, with its username/password auth
+type proxyDialer struct {
+	url   *url.URL
+	socks bool
+}
+
+// newProxyDialer returns the dialer of an http://, https://,
+// socks5:// or socks5h:// proxy URL (which are the same, as
+// the SOCKS5 proxy always resolves the server's name)
+func newProxyDialer(u *url.URL) (*proxyDialer, error) {
+	switch u.Scheme {
+	case "http", "https":
+		return &proxyDialer{url: u}, nil
+	case "socks5", "socks5h":
+		return &proxyDialer{url: u, socks: true}, nil
+	}
+	return nil, fmt.Errorf("Invalid proxy URL (unsupported scheme '%s')", u.Scheme)
+}
+
+// viaHTTP reports whether there's a proxy, which is an HTTP proxy
+func (p *proxyDialer) viaHTTP() bool {
+	return p != nil && !p.socks
+}
+
+// DialContext returns a connection to the address through the proxy
+func (p *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if p.socks {
+		return p.socksConnect(ctx, addr)
+	}
+	conn, res, err := p.connect(ctx, nil, addr, "")
+	if err == nil && res.StatusCode == http.StatusProxyAuthRequired {
+		conn, res, err = p.authenticate(ctx, conn, res, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy refused CONNECT: %s", res.Status)
+	}
+	return conn, nil
+}
+
+// transport sends the transport's requests of the server through the
+// proxy (if any): over CONNECT for https:// servers, while HTTP proxies
+// forward the requests of http:// servers, with Basic auth only
+func (p *proxyDialer) transport(t *http.Transport, server string) {
+	if p == nil {
+		return
+	}
+	if p.socks || strings.HasPrefix(server, "https") {
+		t.DialContext = p.DialContext
+	} else {
+		t.Proxy = http.ProxyURL(p.url)
+	}
+}
+
+// proxyFor returns the proxy of the server (or nil, to connect
+// directly): the --proxy, else the choice of the --pac file, else the
+// proxy of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables. Only SOCKS5 proxies are chosen for tcp:// and tls://
+// servers (see dialRaw)
+func (c *Client) proxyFor(server serverURL) *proxyDialer {
+	if c.proxy != nil {
+		return c.proxy
+	}
+	u, err := url.Parse(server.url)
+	if err != nil {
+		return nil
+	}
+	//the proxy of the server's http(s) URL
+	switch u.Scheme {
+	case "ws", "tcp":
+		u.Scheme = "http"
+	case "wss", "tls":
+		u.Scheme = "https"
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	var proxy *url.URL
+	if c.config.PAC != "" {
+		proxy, err = c.pacProxy(u)
+	} else {
+		proxy, err = http.ProxyFromEnvironment(&http.Request{URL: u})
+	}
+	if err != nil {
+		c.Infof("Proxy detection failed, connecting directly: %s", err)
+		return nil
+	}
+	if proxy == nil {
+		return nil
+	}
+	p, err := newProxyDialer(proxy)
+	if err != nil || (server.raw && !p.socks) {
+		c.Debugf("Ignoring proxy %s of %s", proxy.Redacted(), server.url)
+		return nil
+	}
+	return p
+}
+
+// pacProxy loads and runs the --pac file (on each connection, as
+// the client roams between networks) choosing the URL's proxy
+func (c *Client) pacProxy(u *url.URL) (*url.URL, error) {
+	src, err := loadPAC(c.config.PAC)
+	if err != nil {
+		return nil, fmt.Errorf("PAC file %s: %s", c.config.PAC, err)
+	}
+	result, err := findProxyForURL(src, u.String(), u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	c.Debugf("PAC file: %s", result)
+	return pacProxyURL(result)
+}
+
+// dial connects to the proxy itself, with TLS for https:// proxies
+func (p *proxyDialer) dial(ctx context.Context) (net.Conn, error) {
+	host := p.url.Host
+	if p.url.Port() == "" {
+		port := "80"
+		if p.socks {
+			port = "1080"
+		} else if p.url.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(p.url.Hostname(), port)
+	}
+	d := net.Dialer{Timeout: 30 * time.Second}
+	if p.url.Scheme == "https" {
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: p.url.Hostname()}}
+		return td.DialContext(ctx, "tcp", host)
+	}
+	return d.DialContext(ctx, "tcp", host)
+}
+
+// socksConnect returns a connection to the address through the SOCKS5
+// proxy, authenticated with the credentials of the URL, if it has any
+func (p *proxyDialer) socksConnect(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	auth := ""
+	if user := p.url.User.Username(); user != "" {
+		pass, _ := p.url.User.Password()
+		auth = user + ":" + pass
+	}
+	conn.SetDeadline(time.Now().Add(45 * time.Second))
+	if err := chshare.SocksConnect(conn, addr, auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect sends a CONNECT request of the address, with the authorization
+// (if any), on the connection or (when nil) on a new one, returning the
+// connection and the proxy's response, whose body has been read
+func (p *proxyDialer) connect(ctx context.Context, conn net.Conn, addr, auth string) (net.Conn, *http.Response, error) {
+	if conn == nil {
+		var err error
+		if conn, err = p.dial(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	conn.SetDeadline(time.Now().Add(45 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	//(the proxy sends nothing more until the server does)
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if res.StatusCode == http.StatusOK {
+		//the tunnel, which has no body
+		return conn, res, nil
+	}
+	//drain the body, to keep the connection
+	_, err = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<20))
+	res.Body.Close()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, res, nil
+}
+
+// authenticate answers the proxy's challenge (its 407 response)
+// with the credentials of the proxy URL, if it has any
+func (p *proxyDialer) authenticate(ctx context.Context, conn net.Conn, res *http.Response, addr string) (net.Conn, *http.Response, error) {
+	user := p.url.User.Username()
+	pass, _ := p.url.User.Password()
+	if user == "" {
+		return conn, res, nil
+	}
+	scheme, challenge := proxyChallenge(res.Header)
+	if scheme == "" {
+		return conn, res, nil
+	}
+	//connections closed by the proxy are replaced,
+	//apart from NTLM's, which authenticates the connection
+	if res.Close {
+		conn.Close()
+		conn = nil
+	}
+	switch scheme {
+	case "basic":
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+		return p.connect(ctx, conn, addr, "Basic "+auth)
+	case "digest":
+		auth, err := digestAuth(challenge, user, pass, http.MethodConnect, addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return p.connect(ctx, conn, addr, auth)
+	}
+	//ntlm or negotiate
+	name := "NTLM"
+	if scheme == "negotiate" {
+		name = "Negotiate"
+	}
+	conn, res, err := p.connect(ctx, conn, addr, name+" "+base64.StdEncoding.EncodeToString(ntlmNegotiate()))
+	if err != nil || res.StatusCode != http.StatusProxyAuthRequired {
+		return conn, res, err
+	}
+	if res.Close {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Proxy closed the connection during %s authentication", name)
+	}
+	params, _ := proxyChallengeOf(res.Header, scheme)
+	b, err := base64.StdEncoding.DecodeString(params)
+	if err == nil {
+		b, err = ntlmAuthenticate(b, user, pass)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%s authentication failed: %s", name, err)
+	}
+	return p.connect(ctx, conn, addr, name+" "+base64.StdEncoding.EncodeToString(b))
+}
+
+// proxyChallenge returns the strongest scheme of the proxy's challenges
+// (lower case), and its parameters. Negotiate is used for NTLM only,
+// so only when NTLM isn't offered by itself
+func proxyChallenge(h http.Header) (string, string) {
+	for _, scheme := range []string{"ntlm", "negotiate", "digest", "basic"} {
+		if params, ok := proxyChallengeOf(h, scheme); ok {
+			return scheme, params
+		}
+	}
+	return "", ""
+}
+
+// proxyChallengeOf returns the parameters of the scheme's
+// challenge, from the Proxy-Authenticate headers (one each)
+func proxyChallengeOf(h http.Header, scheme string) (string, bool) {
+	for _, v := range h.Values("Proxy-Authenticate") {
+		s := strings.SplitN(strings.TrimSpace(v), " ", 2)
+		if strings.ToLower(s[0]) == scheme {
+			return strings.TrimSpace(strings.Join(s[1:], "")), true
+		}
+	}
+	return "", false
+}
+
+// digestAuth returns the Digest authorization (RFC 7616) answering
+// the challenge, with the MD5 or SHA-256 algorithms (or their -sess
+// variants), and qop=auth when the proxy offers it
+func digestAuth(challenge, user, pass, method, uri string) (string, error) {
+	params := digestParams(challenge)
+	algorithm := params["algorithm"]
+	var h func() hash.Hash
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", fmt.Errorf("Unsupported digest algorithm '%s'", algorithm)
+	}
+	digest := func(s string) string {
+		d := h()
+		io.WriteString(d, s)
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cnonce, nc, nonce := fmt.Sprintf("%x", b), "00000001", params["nonce"]
+	ha1 := digest(user + ":" + params["realm"] + ":" + pass)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = digest(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := digest(method + ":" + uri)
+	qop := ""
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, user, params["realm"], nonce, uri)
+	if qop != "" {
+		auth += fmt.Sprintf(`, response="%s", qop=%s, nc=%s, cnonce="%s"`, digest(ha1+":"+nonce+":"+nc+":"+cnonce+":"+qop+":"+ha2), qop, nc, cnonce)
+	} else {
+		auth += fmt.Sprintf(`, response="%s"`, digest(ha1+":"+nonce+":"+ha2))
+	}
+	if algorithm != "" {
+		auth += ", algorithm=" + algorithm
+	}
+	if opaque, ok := params["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth, nil
+}
+
+// digestParams parses the challenge's comma separated
+// name=value parameters, whose values may be quoted
+func digestParams(s string) map[string]string {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return params
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimSpace(s[i+1:])
+		value := ""
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i = 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				//the closing quote
+				i++
+			}
+			value, s = b.String(), s[i:]
+		} else {
+			i = strings.Index(s, ",")
+			if i < 0 {
+				i = len(s)
+			}
+			value, s = strings.TrimSpace(s[:i]), s[i:]
+		}
+		params[name] = value
+	}
+}
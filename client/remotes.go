@@ -0,0 +1,176 @@
+package chclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+	"golang.org/x/crypto/ssh"
+)
+
+// remoteTimeout is how long the server is given to add or remove
+// a remote (servers without the remote-add request never reply)
+const remoteTimeout = 30 * time.Second
+
+// Remotes returns the client's remotes, labelled with their names
+func (c *Client) Remotes() []string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	list := []string{}
+	for _, r := range c.config.shared.Remotes {
+		list = append(list, r.Label())
+	}
+	return list
+}
+
+// AddRemote opens a remote on the running client, listening on its
+// port, or, for reverse remotes, asking the server to. Either way,
+// the server checks the remote is allowed, as for those given when
+// connecting. The remote is kept when reconnecting.
+func (c *Client) AddRemote(s string) (*chshare.Remote, error) {
+	r, err := chshare.DecodeRemote(s)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode remote '%s': %s", s, err)
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, other := range c.config.shared.Remotes {
+		if other.String() == r.String() || (r.Name != "" && other.Name == r.Name) {
+			return nil, fmt.Errorf("Remote %s is already open", other.Label())
+		}
+	}
+	//the server may bind another (reserved) port
+	if r, err = c.remoteRequest("remote-add", r); err != nil {
+		return nil, err
+	}
+	if !r.Reverse {
+		if err := c.startProxy(len(c.config.shared.Remotes), r); err != nil {
+			c.remoteRequest("remote-del", r)
+			return nil, err
+		}
+	}
+	c.config.shared.Remotes = append(c.config.shared.Remotes, r)
+	c.Infof("Added remote %s", r.Label())
+	return r, nil
+}
+
+// RemoveRemote closes the remote of the running client,
+// given by its name, or as it was added
+func (c *Client) RemoveRemote(s string) (*chshare.Remote, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	match := s
+	if r, err := chshare.DecodeRemote(s); err == nil {
+		match = r.String()
+	}
+	for i, r := range c.config.shared.Remotes {
+		if r.Name != s && r.String() != match && r.Label() != s {
+			continue
+		}
+		if _, err := c.remoteRequest("remote-del", r); err != nil {
+			return nil, err
+		}
+		if stop, ok := c.proxies[r]; ok {
+			stop()
+			delete(c.proxies, r)
+		}
+		remotes := c.config.shared.Remotes
+		c.config.shared.Remotes = append(remotes[:i:i], remotes[i+1:]...)
+		c.Infof("Removed remote %s", r.Label())
+		return r, nil
+	}
+	return nil, fmt.Errorf("Remote %s is not open", s)
+}
+
+// startProxy listens on the port of the (forward) remote, until
+// it's removed (see RemoveRemote) or the client is stopped
+func (c *Client) startProxy(i int, r *chshare.Remote) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	proxy := chshare.NewTCPProxy(c.Logger, func() ssh.Conn { return c.sshConn }, i, r)
+	proxy.UDP = c.config.UDP
+	proxy.SocksAuth = c.config.Auth
+	if err := proxy.Start(ctx); err != nil {
+		cancel()
+		return err
+	}
+	c.proxies[r] = cancel
+	return nil
+}
+
+// handleRequests handles the server's requests to open and close
+// remotes (see the server's pushRemote), when allowed
+func (c *Client) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "remote-open", "remote-close":
+			if !c.config.ServerRemotes {
+				c.Infof("Denied the server's request to open or close remote %s, please enable --allow-server-remotes", req.Payload)
+				req.Reply(false, []byte("The client doesn't allow the server to open remotes"))
+				continue
+			}
+			//adding remotes waits on the server's other requests
+			go func(req *ssh.Request) {
+				var r *chshare.Remote
+				var err error
+				if req.Type == "remote-open" {
+					r, err = c.AddRemote(string(req.Payload))
+				} else {
+					r, err = c.RemoveRemote(string(req.Payload))
+				}
+				if err != nil {
+					req.Reply(false, []byte(err.Error()))
+					return
+				}
+				req.Reply(true, []byte(r.Label()))
+			}(req)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// remoteRequest asks the server to add or remove the remote,
+// returning the remote as the server has it, when connected (or else
+// the remote is sent with the others once connected)
+func (c *Client) remoteRequest(name string, r *chshare.Remote) (*chshare.Remote, error) {
+	sshConn := c.sshConn
+	if sshConn == nil {
+		return r, nil
+	}
+	b, _ := json.Marshal(r)
+	type reply struct {
+		ok      bool
+		payload []byte
+		err     error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		ok, payload, err := sshConn.SendRequest(name, true, b)
+		replies <- reply{ok, payload, err}
+	}()
+	var res reply
+	select {
+	case res = <-replies:
+	case <-time.After(remoteTimeout):
+		return nil, errors.New("The server didn't reply, it may not support adding remotes")
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	if !res.ok {
+		if len(res.payload) == 0 {
+			return nil, errors.New("The server doesn't support adding remotes")
+		}
+		return nil, errors.New(string(res.payload))
+	}
+	added := &chshare.Remote{}
+	if err := json.Unmarshal(res.payload, added); err != nil {
+		return nil, fmt.Errorf("Invalid reply from server: %s", err)
+	}
+	return added, nil
+}
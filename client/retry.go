@@ -0,0 +1,40 @@
+package chclient
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jpillora/backoff"
+)
+
+// newBackoff returns the backoff of the client's retries, see
+// Config.RetryDelay, RetryMultiplier and RetryJitter
+func (c *Client) newBackoff() (*backoff.Backoff, error) {
+	config := c.config
+	if config.RetryMultiplier != 0 && config.RetryMultiplier < 1 {
+		return nil, fmt.Errorf("Invalid retry multiplier %g (expected 1 or more)", config.RetryMultiplier)
+	}
+	if config.RetryJitter < 0 || config.RetryJitter > 1 {
+		return nil, fmt.Errorf("Invalid retry jitter %g (expected 0 to 1)", config.RetryJitter)
+	}
+	switch config.GiveUp {
+	case "", "exit", "fail", "restart":
+	default:
+		return nil, fmt.Errorf("Invalid give up action '%s' (expected exit, fail or restart)", config.GiveUp)
+	}
+	//seeded apart from the global source, so that
+	//clients don't all jitter their retries alike
+	c.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &backoff.Backoff{
+		Min:    config.RetryDelay,
+		Max:    config.MaxRetryInterval,
+		Factor: config.RetryMultiplier,
+	}, nil
+}
+
+// jitter shortens the delay by a random part of
+// the RetryJitter's fraction of it
+func (c *Client) jitter(d time.Duration) time.Duration {
+	return d - time.Duration(c.random.Float64()*c.config.RetryJitter*float64(d))
+}
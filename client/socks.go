@@ -0,0 +1,93 @@
+package chclient
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	socks5 "github.com/armon/go-socks5"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// reverseSocks reports whether the client has a reverse socks
+// remote, whose streams are served by the client's SOCKS5 server
+func (c *Client) reverseSocks() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, r := range c.config.shared.Remotes {
+		if r.Reverse && r.Socks {
+			return true
+		}
+	}
+	return false
+}
+
+// socksServer returns the SOCKS5 server (not listening on any
+// port!) of reverse socks remotes, whose connections are dialed
+// from the client's network
+func (c *Client) socksServer() (*chshare.SocksServer, error) {
+	c.socksOnce.Do(func() {
+		config := &socks5.Config{Rules: &socksRules{c}}
+		if user, pass := chshare.ParseAuth(c.config.SocksAuth); user != "" {
+			config.Credentials = socks5.StaticCredentials{user: pass}
+		}
+		if c.Debug {
+			config.Logger = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
+		} else {
+			config.Logger = log.New(ioutil.Discard, "", 0)
+		}
+		c.socks, c.socksErr = chshare.NewSocksServer(config)
+	})
+	return c.socks, c.socksErr
+}
+
+func (c *Client) handleSocksStream(l *chshare.Logger, src io.ReadWriteCloser) {
+	defer src.Close()
+	socksServer, err := c.socksServer()
+	if err != nil {
+		l.Debugf("Failed to start SOCKS5 server: %s", err)
+		return
+	}
+	conn := chshare.NewRWCConn(src)
+	c.connStats.Open()
+	l.Debugf("%s Opening", &c.connStats)
+	err = socksServer.ServeConn(conn)
+	c.connStats.Close()
+	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
+		l.Debugf("%s: Closed (error: %s)", &c.connStats, err)
+	} else {
+		l.Debugf("%s: Closed", &c.connStats)
+	}
+}
+
+// socksRules only permits CONNECT requests, to
+// the destinations of the access list (if any)
+type socksRules struct {
+	*Client
+}
+
+func (r *socksRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		r.Debugf("Denied SOCKS command %d", req.Command)
+		return ctx, false
+	}
+	if len(r.socksAllow) == 0 {
+		return ctx, true
+	}
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(req.DestAddr.Port))
+	allowed := (&chshare.User{Addrs: r.socksAllow}).HasAccess(addr)
+	if !allowed {
+		r.Infof("Denied SOCKS access to '%s'", addr)
+	}
+	return ctx, allowed
+}
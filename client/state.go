@@ -0,0 +1,97 @@
+package chclient
+
+import (
+	"time"
+)
+
+// State is the state of the client's connection to its server
+type State int
+
+const (
+	//StateConnecting is the client's first connection attempt
+	StateConnecting State = iota
+	//StateConnected is an established tunnel
+	StateConnected
+	//StateDisconnected is a lost (or closed) tunnel
+	StateDisconnected
+	//StateReconnecting is the wait before a further attempt
+	StateReconnecting
+	//StateStopped is a client which has given up, or was closed
+	StateStopped
+)
+
+var stateNames = []string{"connecting", "connected", "disconnected", "reconnecting", "stopped"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+// StateChange describes a change of the client's state, see Client.States
+type StateChange struct {
+	State State
+	//Server is the URL of the server (dis)connected from, or being
+	//connected to, which may be empty while servers are discovered
+	Server string
+	//Err is why the client disconnected (nil for a clean disconnect),
+	//why it's reconnecting, or why it gave up (nil once closed)
+	Err error
+	//Attempt is the number of the next attempt (from 1),
+	//made after the Delay, while reconnecting
+	Attempt int
+	Delay   time.Duration
+	Time    time.Time
+}
+
+// State returns the client's current state
+func (c *Client) State() State {
+	c.stateMut.Lock()
+	defer c.stateMut.Unlock()
+	return c.state
+}
+
+// States returns the channel of the client's state changes, for
+// embedders surfacing the tunnel's health, which is closed once the
+// client stops. Changes which aren't received in time are dropped,
+// oldest first, so the channel doesn't hold up the connection loop.
+// See also Config.OnConnect, OnDisconnect and OnReconnecting
+func (c *Client) States() <-chan StateChange {
+	return c.states
+}
+
+// setState records and publishes the change, and calls its hook
+func (c *Client) setState(change StateChange) {
+	change.Time = time.Now()
+	c.stateMut.Lock()
+	c.state = change.State
+	select {
+	case c.states <- change:
+	default:
+		//drop the oldest change for this one
+		select {
+		case <-c.states:
+		default:
+		}
+		c.states <- change
+	}
+	if change.State == StateStopped {
+		close(c.states)
+	}
+	c.stateMut.Unlock()
+	switch change.State {
+	case StateConnected:
+		if c.config.OnConnect != nil {
+			c.config.OnConnect(change.Server)
+		}
+	case StateDisconnected:
+		if c.config.OnDisconnect != nil {
+			c.config.OnDisconnect(change.Server, change.Err)
+		}
+	case StateReconnecting:
+		if c.config.OnReconnecting != nil {
+			c.config.OnReconnecting(change.Attempt, change.Delay, change.Err)
+		}
+	}
+}
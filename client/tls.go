@@ -0,0 +1,168 @@
+package chclient
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// TLSConfig verifies the certificates of https:// and tls:// servers
+type TLSConfig struct {
+	//CA is a PEM file (or a directory of them) of the CAs which
+	//verify servers, in place of the system's
+	CA string
+	//Pins are sha256:<digest>s of public keys (the SHA256 digest, in hex
+	//or base64, of a certificate's SubjectPublicKeyInfo), one of which
+	//must be the server's. Without a CA, the pin alone verifies the server
+	//(so self-signed certificates are accepted), or else one of the keys
+	//of the chain verified by the CA must be pinned
+	Pins []string
+	//Cert and Key are the paths of a PEM-encoded key pair presented to
+	//servers (or the proxies in front of them) requiring a client
+	//certificate, see the server's --tls-ca
+	Cert string
+	Key  string
+}
+
+// newTLSConfig returns the TLS config of the client's servers,
+// or nil when the defaults apply
+func newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	if c.CA == "" && len(c.Pins) == 0 && c.Cert == "" && c.Key == "" && !chshare.FIPS() {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			return nil, errors.New("TLS client certificate and key must be provided together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.CA != "" {
+		pool, err := loadCAs(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(c.Pins) > 0 {
+		pins := map[string]bool{}
+		for _, p := range c.Pins {
+			digest, err := parsePin(p)
+			if err != nil {
+				return nil, err
+			}
+			pins[string(digest)] = true
+		}
+		if c.CA == "" {
+			//only the server's own certificate is authenticated
+			//by the handshake, so only its key may be pinned
+			config.InsecureSkipVerify = true
+			config.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+				if len(certs) > 0 {
+					if cert, err := x509.ParseCertificate(certs[0]); err == nil && pins[pinOf(cert)] {
+						return nil
+					}
+				}
+				return errors.New("the server's certificate matches none of the TLS pins")
+			}
+		} else {
+			config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+				for _, chain := range chains {
+					for _, cert := range chain {
+						if pins[pinOf(cert)] {
+							return nil
+						}
+					}
+				}
+				return errors.New("the server's certificate chain matches none of the TLS pins")
+			}
+		}
+	}
+	if err := chshare.FIPSTLS(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// tlsConfig returns a copy of the TLS config of https:// and
+// tls:// servers, which is nil when the defaults apply
+func (c *Client) tlsConfig() *tls.Config {
+	if c.tls == nil {
+		return nil
+	}
+	return c.tls.Clone()
+}
+
+// loadCAs reads the PEM certificates of the file, or of
+// each file of the directory
+func loadCAs(path string) (*x509.CertPool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read TLS CA: %s", err)
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read TLS CA: %s", err)
+		}
+		files = nil
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	pool := x509.NewCertPool()
+	found := false
+	for _, f := range files {
+		pem, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read TLS CA: %s", err)
+		}
+		if pool.AppendCertsFromPEM(pem) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("No certificates found in TLS CA: %s", path)
+	}
+	return pool, nil
+}
+
+// parsePin returns the digest of a sha256:<digest> pin
+func parsePin(pin string) ([]byte, error) {
+	const prefix = "sha256:"
+	if !strings.HasPrefix(strings.ToLower(pin), prefix) {
+		return nil, fmt.Errorf("Invalid TLS pin '%s' (expected sha256:<digest>)", pin)
+	}
+	s := pin[len(prefix):]
+	digest, err := hex.DecodeString(s)
+	if err != nil {
+		digest, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("Invalid TLS pin '%s' (expected a SHA256 digest, in hex or base64)", pin)
+	}
+	return digest, nil
+}
+
+// pinOf returns the digest of the certificate's public key
+func pinOf(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return string(digest[:])
+}
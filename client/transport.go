@@ -0,0 +1,92 @@
+package chclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// dialH2 carries the tunnel over an HTTP/2 stream, writing
+// the request body and reading the response body, with
+// TLS or, for http:// servers, by prior knowledge (h2c)
+func (c *Client) dialH2(headers http.Header) (net.Conn, error) {
+	server := strings.Replace(c.server, "ws", "http", 1)
+	t := &http.Transport{
+		Protocols:           &http.Protocols{},
+		TLSHandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:     c.tlsConfig(),
+	}
+	if strings.HasPrefix(server, "https") {
+		t.Protocols.SetHTTP2(true)
+	} else {
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	c.currentProxy.transport(t, server)
+	body, w := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, server, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = headers
+	if h := headers.Get("Host"); h != "" {
+		req.Host = h
+	}
+	req.Header.Set(chshare.H2ProtocolHeader, chshare.ProtocolVersion)
+	res, err := t.RoundTrip(req)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		w.Close()
+		res.Body.Close()
+		return nil, fmt.Errorf("Unexpected status %s", res.Status)
+	}
+	//the transport's connection isn't reused
+	closeW := func() error {
+		w.Close()
+		t.CloseIdleConnections()
+		return nil
+	}
+	return chshare.NewHTTPStreamConn(res.Body, w, nil, closeW), nil
+}
+
+// dialRaw carries the tunnel directly over TCP or, for tls://
+// servers, TLS, without any HTTP upgrade (but possibly through
+// a SOCKS5 proxy)
+func (c *Client) dialRaw() (net.Conn, error) {
+	u, err := url.Parse(c.server)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: 45 * time.Second}
+	dial := d.DialContext
+	if c.currentProxy != nil {
+		dial = c.currentProxy.DialContext
+	}
+	conn, err := dial(context.Background(), "tcp", u.Host)
+	if err != nil || u.Scheme != "tls" {
+		return conn, err
+	}
+	config := c.tlsConfig()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.ServerName = u.Hostname()
+	tlsConn := tls.Client(conn, config)
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
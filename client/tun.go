@@ -0,0 +1,116 @@
+package chclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// tunClient relays the IP packets of the client's TUN device
+// over the tun channel of each connection to the server
+type tunClient struct {
+	*chshare.Logger
+	dev  *chshare.TUN
+	ip   net.IP
+	mut  sync.Mutex
+	conn ssh.Channel
+}
+
+// newTunClient checks the client's tun address (like 10.8.0.2/24),
+// or returns nil when it's empty (the device is created by start)
+func newTunClient(logger *chshare.Logger, addr string, routes []string) (*tunClient, error) {
+	if addr == "" {
+		if len(routes) > 0 {
+			return nil, fmt.Errorf("TUN routes require a TUN address")
+		}
+		return nil, nil
+	}
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TUN address: %s", err)
+	}
+	for _, r := range routes {
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			return nil, fmt.Errorf("Invalid TUN route: %s", err)
+		}
+	}
+	return &tunClient{Logger: logger.Fork("tun"), ip: ip}, nil
+}
+
+// start creates the TUN device, with the address and routes,
+// which is removed once the client is stopped
+func (t *tunClient) start(ctx context.Context, addr string, routes []string) error {
+	if t == nil {
+		return nil
+	}
+	dev, err := chshare.OpenTUN(addr, routes)
+	if err != nil {
+		return err
+	}
+	t.dev = dev
+	t.Infof("Device %s has address %s", dev.Name, addr)
+	go func() {
+		<-ctx.Done()
+		dev.Close()
+	}()
+	go t.send()
+	return nil
+}
+
+// send relays the packets of the device to the current
+// connection's channel, dropping them while disconnected
+func (t *tunClient) send() {
+	buf := chshare.NewPacketBuffer()
+	for {
+		n, err := t.dev.Read(buf)
+		if err != nil {
+			return
+		}
+		t.mut.Lock()
+		conn := t.conn
+		t.mut.Unlock()
+		if conn == nil {
+			continue
+		}
+		if err := chshare.WritePacket(conn, buf[:n]); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// connect opens the tun channel of the connection, relaying its
+// packets to the device until the connection is closed
+func (t *tunClient) connect(sshConn ssh.Conn) {
+	if t == nil {
+		return
+	}
+	conn, reqs, err := sshConn.OpenChannel("tun", []byte(t.ip.String()))
+	if err != nil {
+		t.Infof("Failed to open the tun channel: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	t.mut.Lock()
+	t.conn = conn
+	t.mut.Unlock()
+	t.Debugf("Connected")
+	buf := chshare.NewPacketBuffer()
+	for {
+		b, err := chshare.ReadPacket(conn, buf)
+		if err != nil {
+			break
+		}
+		t.dev.Write(b)
+	}
+	t.mut.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.mut.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,543 @@
+package chserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	chshare "github.com/jpillora/chisel/share"
+)
+
+// LetsEncryptURL is the directory URL of the Let's Encrypt ACME CA
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeALPNProto     = "acme-tls/1"
+	acmeRetry         = 10 * time.Minute
+)
+
+// id-pe-acmeIdentifier, see RFC 8737
+var acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// acmeManager obtains a certificate for the domains from an
+// ACME (RFC 8555) CA, keeping it (and the account key) in the
+// cache directory, and renews it before it expires. Domains are
+// validated with the tls-alpn-01 challenge on the TLS listeners,
+// or with http-01 when there is a plain HTTP listener on port 80
+type acmeManager struct {
+	*chshare.Logger
+	directoryURL string
+	email        string
+	domains      []string
+	cache        string
+	client       *http.Client
+	http01       bool
+	mut          sync.RWMutex
+	cert         *tls.Certificate
+	leaf         *x509.Certificate
+	tokens       map[string]string
+	alpnCerts    map[string]*tls.Certificate
+	//account state
+	key   *ecdsa.PrivateKey
+	kid   string
+	dir   acmeDirectory
+	nonce string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("%s (%s)", p.Detail, p.Type)
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthz struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type   string       `json:"type"`
+		URL    string       `json:"url"`
+		Token  string       `json:"token"`
+		Status string       `json:"status"`
+		Error  *acmeProblem `json:"error"`
+	} `json:"challenges"`
+}
+
+func newACMEManager(c TLSConfig, logger *chshare.Logger) (*acmeManager, error) {
+	m := &acmeManager{
+		Logger:       logger.Fork("acme"),
+		directoryURL: c.ACMEURL,
+		email:        c.ACMEEmail,
+		domains:      c.Domains,
+		cache:        c.ACMECache,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		tokens:       map[string]string{},
+		alpnCerts:    map[string]*tls.Certificate{},
+	}
+	if m.directoryURL == "" {
+		m.directoryURL = LetsEncryptURL
+	}
+	if m.cache == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("No ACME cache directory: %s", err)
+		}
+		m.cache = filepath.Join(dir, "chisel", "acme")
+	}
+	if err := os.MkdirAll(m.cache, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create ACME cache directory: %s", err)
+	}
+	if err := m.loadAccountKey(); err != nil {
+		return nil, err
+	}
+	//a cached certificate is used until it's renewed
+	if b, err := ioutil.ReadFile(m.certPath()); err == nil {
+		if cert, err := tls.X509KeyPair(b, b); err == nil {
+			m.setCertificate(&cert)
+		}
+	}
+	return m, nil
+}
+
+func (m *acmeManager) certPath() string {
+	return filepath.Join(m.cache, m.domains[0]+".pem")
+}
+
+func (m *acmeManager) loadAccountKey() error {
+	path := filepath.Join(m.cache, "account.key")
+	if b, err := ioutil.ReadFile(path); err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return fmt.Errorf("Invalid ACME account key: %s", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("Invalid ACME account key: %s", err)
+		}
+		m.key = key
+		return nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("Failed to write ACME account key: %s", err)
+	}
+	m.key = key
+	return nil
+}
+
+func (m *acmeManager) setCertificate(cert *tls.Certificate) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	m.mut.Lock()
+	m.cert, m.leaf = cert, leaf
+	m.mut.Unlock()
+}
+
+// renewAt is when the certificate should be renewed, with a
+// third of its lifetime remaining, which is now when there is none
+func (m *acmeManager) renewAt() time.Time {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	if m.leaf == nil {
+		return time.Now()
+	}
+	for _, d := range m.domains {
+		if m.leaf.VerifyHostname(d) != nil {
+			return time.Now()
+		}
+	}
+	return m.leaf.NotAfter.Add(-m.leaf.NotAfter.Sub(m.leaf.NotBefore) / 3)
+}
+
+// run obtains and renews the certificate, forever
+func (m *acmeManager) run() {
+	for {
+		if wait := time.Until(m.renewAt()); wait > 0 {
+			//woken daily, in case the clock jumps
+			if wait > 24*time.Hour {
+				wait = 24 * time.Hour
+			}
+			time.Sleep(wait)
+			continue
+		}
+		m.Infof("Obtaining a certificate for %s from %s", strings.Join(m.domains, ", "), m.directoryURL)
+		if err := m.obtain(); err != nil {
+			m.Infof("Failed to obtain a certificate (retrying in %s): %s", acmeRetry, err)
+			time.Sleep(acmeRetry)
+			continue
+		}
+		m.mut.RLock()
+		expiry := m.leaf.NotAfter
+		m.mut.RUnlock()
+		m.Infof("Obtained a certificate, expiring %s", expiry.Format(time.RFC3339))
+	}
+}
+
+// getCertificate provides the certificate, or the
+// challenge certificate for tls-alpn-01 validations
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeALPNProto {
+		if cert, ok := m.alpnCerts[hello.ServerName]; ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("No ACME challenge for '%s'", hello.ServerName)
+	}
+	if m.cert == nil {
+		return nil, errors.New("No certificate obtained yet")
+	}
+	return m.cert, nil
+}
+
+// handleChallenge responds to http-01 validations
+func (m *acmeManager) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	m.mut.RLock()
+	keyAuth, ok := m.tokens[strings.TrimPrefix(r.URL.Path, acmeChallengePath)]
+	m.mut.RUnlock()
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("Not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
+
+func (m *acmeManager) obtain() error {
+	if m.kid == "" {
+		if err := m.register(); err != nil {
+			return fmt.Errorf("Account registration failed: %s", err)
+		}
+	}
+	var ids []map[string]string
+	for _, d := range m.domains {
+		ids = append(ids, map[string]string{"type": "dns", "value": d})
+	}
+	order := &acmeOrder{}
+	res, err := m.post(m.dir.NewOrder, map[string]interface{}{"identifiers": ids}, order)
+	if err != nil {
+		return fmt.Errorf("New order failed: %s", err)
+	}
+	orderURL := res.Header.Get("Location")
+	for _, a := range order.Authorizations {
+		if err := m.authorize(a); err != nil {
+			return err
+		}
+	}
+	//the certificate key is kept with the certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domains[0]},
+		DNSNames: m.domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	if _, err := m.post(order.Finalize, map[string]string{"csr": b64(csr)}, order); err != nil {
+		return fmt.Errorf("Finalize failed: %s", err)
+	}
+	for order.Status != "valid" {
+		if order.Status == "invalid" {
+			return fmt.Errorf("Order is invalid: %v", order.Error)
+		}
+		time.Sleep(time.Second)
+		if _, err := m.post(orderURL, nil, order); err != nil {
+			return err
+		}
+	}
+	res, err = m.post(order.Certificate, nil, nil)
+	if err != nil {
+		return fmt.Errorf("Certificate download failed: %s", err)
+	}
+	chain, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	b := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), chain...)
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return fmt.Errorf("Invalid certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(m.certPath(), b, 0600); err != nil {
+		m.Infof("Failed to cache the certificate: %s", err)
+	}
+	m.setCertificate(&cert)
+	return nil
+}
+
+func (m *acmeManager) register() error {
+	res, err := m.client.Get(m.directoryURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(&m.dir); err != nil {
+		return fmt.Errorf("Invalid directory: %s", err)
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if m.email != "" {
+		account["contact"] = []string{"mailto:" + m.email}
+	}
+	res, err = m.post(m.dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	m.kid = res.Header.Get("Location")
+	return nil
+}
+
+// authorize completes the authorization of a domain
+func (m *acmeManager) authorize(url string) error {
+	authz := &acmeAuthz{}
+	if _, err := m.post(url, nil, authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	domain := authz.Identifier.Value
+	kind := "tls-alpn-01"
+	if m.http01 {
+		kind = "http-01"
+	}
+	for _, c := range authz.Challenges {
+		if c.Type != kind {
+			continue
+		}
+		keyAuth := c.Token + "." + m.thumbprint()
+		if err := m.setChallenge(domain, c.Token, keyAuth); err != nil {
+			return err
+		}
+		defer m.clearChallenge(domain, c.Token)
+		res, err := m.post(c.URL, struct{}{}, nil)
+		if err != nil {
+			return fmt.Errorf("Challenge for %s failed: %s", domain, err)
+		}
+		res.Body.Close()
+		for authz.Status == "pending" || authz.Status == "processing" {
+			time.Sleep(time.Second)
+			if _, err := m.post(url, nil, authz); err != nil {
+				return err
+			}
+		}
+		if authz.Status != "valid" {
+			for _, c := range authz.Challenges {
+				if c.Error != nil {
+					return fmt.Errorf("Validation of %s failed: %s", domain, c.Error)
+				}
+			}
+			return fmt.Errorf("Validation of %s failed (%s)", domain, authz.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("No %s challenge offered for %s", kind, domain)
+}
+
+func (m *acmeManager) setChallenge(domain, token, keyAuth string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.http01 {
+		m.tokens[token] = keyAuth
+		return nil
+	}
+	cert, err := acmeALPNCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	m.alpnCerts[domain] = cert
+	return nil
+}
+
+func (m *acmeManager) clearChallenge(domain, token string) {
+	m.mut.Lock()
+	delete(m.tokens, token)
+	delete(m.alpnCerts, domain)
+	m.mut.Unlock()
+}
+
+// acmeALPNCert is the self-signed tls-alpn-01 challenge
+// certificate, with the key authorization's digest
+func acmeALPNCert(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: acmeIdentifierOID, Critical: true, Value: value},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// post sends a JWS signed request, or a POST-as-GET when the
+// payload is nil, decoding the JSON response into v, if any
+// (otherwise the response body is left to be closed)
+func (m *acmeManager) post(url string, payload, v interface{}) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		res, err := m.send(url, payload)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 400 {
+			p := &acmeProblem{}
+			json.NewDecoder(res.Body).Decode(p)
+			res.Body.Close()
+			//nonces may expire, so requests are retried once
+			if p.Type == "urn:ietf:params:acme:error:badNonce" && retry == 0 {
+				continue
+			}
+			if p.Type == "" {
+				return nil, fmt.Errorf("Unexpected status %d", res.StatusCode)
+			}
+			return nil, p
+		}
+		if v != nil {
+			defer res.Body.Close()
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				return nil, fmt.Errorf("Invalid response: %s", err)
+			}
+		}
+		return res, nil
+	}
+}
+
+func (m *acmeManager) send(url string, payload interface{}) (*http.Response, error) {
+	if m.nonce == "" {
+		res, err := m.client.Head(m.dir.NewNonce)
+		if err != nil {
+			return nil, err
+		}
+		res.Body.Close()
+		m.nonce = res.Header.Get("Replay-Nonce")
+	}
+	protected := map[string]interface{}{"alg": "ES256", "nonce": m.nonce, "url": url}
+	if m.kid != "" {
+		protected["kid"] = m.kid
+	} else {
+		protected["jwk"] = m.jwk()
+	}
+	m.nonce = ""
+	body := ""
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = b64(b)
+	}
+	p, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	header := b64(p)
+	digest := sha256.Sum256([]byte(header + "." + body))
+	r, s, err := ecdsa.Sign(rand.Reader, m.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	jws, err := json.Marshal(map[string]string{"protected": header, "payload": body, "signature": b64(sig)})
+	if err != nil {
+		return nil, err
+	}
+	res, err := m.client.Post(url, "application/jose+json", bytes.NewReader(jws))
+	if err != nil {
+		return nil, err
+	}
+	m.nonce = res.Header.Get("Replay-Nonce")
+	return res, nil
+}
+
+// jwk is the account's public key, with its members
+// in the (lexical) order used for its thumbprint
+func (m *acmeManager) jwk() json.RawMessage {
+	pub := m.key.PublicKey
+	x, y := make([]byte, 32), make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return json.RawMessage(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(x), b64(y)))
+}
+
+func (m *acmeManager) thumbprint() string {
+	digest := sha256.Sum256(m.jwk())
+	return b64(digest[:])
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
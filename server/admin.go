@@ -0,0 +1,190 @@
+package chserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminSession is a session as listed by GET /admin/sessions
+type adminSession struct {
+	ID       int32     `json:"id"`
+	User     string    `json:"user"`
+	SourceIP string    `json:"source_ip"`
+	Started  time.Time `json:"started"`
+	Uptime   string    `json:"uptime"`
+	Remotes  []string  `json:"remotes"`
+	Channels int       `json:"channels"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// adminReversePort is a port bound by a reverse
+// remote, as listed by GET /admin/reverse-ports
+type adminReversePort struct {
+	Address   string `json:"address"`
+	Remote    string `json:"remote"`
+	SessionID int32  `json:"session_id"`
+	User      string `json:"user"`
+}
+
+// handleAdmin serves the admin API to requests bearing the --admin-token:
+//
+//	POST /admin/reload  reloads the users, see Reload
+//	GET /admin/sessions  lists the connected sessions
+//	DELETE /admin/sessions/<id>  disconnects a session
+//	POST|DELETE /admin/sessions/<id>/remotes  asks the client of a session
+//	  to open|close the remote given by the body, see pushRemote
+//	GET /admin/reverse-ports  lists the ports bound by reverse remotes
+//	GET /admin/maintenance  shows whether maintenance mode is enabled
+//	PUT|DELETE /admin/maintenance  enables|disables maintenance mode
+func (s *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return
+	}
+	path := r.URL.Path
+	switch {
+	case path == "/admin/reload" && r.Method == http.MethodPost:
+		if err := s.Reload(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		w.Write([]byte("OK\n"))
+	case path == "/admin/sessions" && r.Method == http.MethodGet:
+		writeAdminJSON(w, s.adminSessions())
+	case strings.HasPrefix(path, "/admin/sessions/") && strings.HasSuffix(path, "/remotes") &&
+		(r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(path, "/admin/sessions/"), "/remotes"), 10, 32)
+		sess := s.active.get(int32(id))
+		if err != nil || sess == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Session not found\n"))
+			return
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		open := r.Method == http.MethodPost
+		remote, err := s.pushRemote(sess, open, strings.TrimSpace(string(b)))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		if open {
+			s.Infof("session#%d: Opened remote %s by the admin API", id, remote)
+		} else {
+			s.Infof("session#%d: Closed remote %s by the admin API", id, remote)
+		}
+		w.Write([]byte(remote + "\n"))
+	case strings.HasPrefix(path, "/admin/sessions/") && r.Method == http.MethodDelete:
+		id, err := strconv.ParseInt(strings.TrimPrefix(path, "/admin/sessions/"), 10, 32)
+		if err != nil || !s.active.close(int32(id)) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Session not found\n"))
+			return
+		}
+		s.Infof("session#%d: Disconnected by the admin API", id)
+		w.Write([]byte("OK\n"))
+	case path == "/admin/reverse-ports" && r.Method == http.MethodGet:
+		writeAdminJSON(w, s.adminReversePorts())
+	case path == "/admin/maintenance" && r.Method == http.MethodGet:
+		writeAdminJSON(w, map[string]bool{"enabled": s.inMaintenance()})
+	case path == "/admin/maintenance" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		s.SetMaintenance(r.Method == http.MethodPut)
+		w.Write([]byte("OK\n"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (s *Server) adminSessions() []*adminSession {
+	s.active.Lock()
+	defer s.active.Unlock()
+	list := []*adminSession{}
+	for _, sess := range s.active.inner {
+		a := &adminSession{
+			ID:       sess.id,
+			SourceIP: sess.remoteIP,
+			Started:  sess.start,
+			Uptime:   time.Since(sess.start).Round(time.Second).String(),
+			Remotes:  []string{},
+			Channels: sess.channels,
+			BytesIn:  sess.bytes.BytesRead(),
+			BytesOut: sess.bytes.BytesWritten(),
+		}
+		if sess.user != nil {
+			a.User = sess.user.Name
+		}
+		for _, r := range sess.remoteList() {
+			a.Remotes = append(a.Remotes, r.String())
+		}
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (s *Server) adminReversePorts() []*adminReversePort {
+	s.active.Lock()
+	defer s.active.Unlock()
+	ports := []*adminReversePort{}
+	for _, sess := range s.active.inner {
+		for _, r := range sess.remoteList() {
+			if !r.Reverse {
+				continue
+			}
+			p := &adminReversePort{
+				Address:   net.JoinHostPort(r.LocalHost, r.LocalPort),
+				Remote:    r.Remote(),
+				SessionID: sess.id,
+			}
+			if r.LocalSocket != "" {
+				p.Address = r.LocalAddr()
+			}
+			if sess.user != nil {
+				p.User = sess.user.Name
+			}
+			ports = append(ports, p)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].SessionID < ports[j].SessionID })
+	return ports
+}
+
+// serveAdmin serves the admin API on its own listener
+func (s *Server) serveAdmin(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen for the admin API: %s", err)
+	}
+	s.Infof("Serving the admin API on http://%s/admin/", l.Addr())
+	go func() {
+		if err := http.Serve(l, http.HandlerFunc(s.handleAdmin)); err != nil {
+			s.Infof("Admin API server failed: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,89 @@
+package chserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// aclEvent is an access decision. Type is "remote", "socks",
+// "stream" or "window" (a time window which has ended), and
+// By is "acl" (the user's access list) or "policy".
+type aclEvent struct {
+	Time      time.Time `json:"time"`
+	SessionID int32     `json:"session_id"`
+	User      string    `json:"user"`
+	SourceIP  string    `json:"source_ip"`
+	Type      string    `json:"type"`
+	Address   string    `json:"address"`
+	Allowed   bool      `json:"allowed"`
+	By        string    `json:"by"`
+	//Rule is the matching access list entry (if any)
+	Rule string `json:"rule,omitempty"`
+}
+
+// aclAuditor logs access decisions, and optionally
+// appends them to a file as JSON lines
+type aclAuditor struct {
+	mut  sync.Mutex
+	file *os.File
+}
+
+// newACLAuditor returns nil when auditing is disabled
+func newACLAuditor(enabled bool, path string) (*aclAuditor, error) {
+	if !enabled && path == "" {
+		return nil, nil
+	}
+	a := &aclAuditor{}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open ACL audit file: %s", err)
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+func (a *aclAuditor) record(clog *chshare.Logger, sess *session, kind, addr, by string, rule *chshare.ACLRule, allowed bool) {
+	if a == nil {
+		return
+	}
+	e := &aclEvent{
+		Time:      time.Now(),
+		SessionID: sess.id,
+		SourceIP:  sess.remoteIP,
+		Type:      kind,
+		Address:   addr,
+		Allowed:   allowed,
+		By:        by,
+	}
+	if sess.user != nil {
+		e.User = sess.user.Name
+	}
+	if rule != nil {
+		e.Rule = rule.Rule
+	}
+	decision := "Denied"
+	if allowed {
+		decision = "Allowed"
+	}
+	if e.Rule != "" {
+		clog.Infof("%s %s access to '%s' for user '%s' by %s (rule '%s')", decision, kind, addr, e.User, by, e.Rule)
+	} else {
+		clog.Infof("%s %s access to '%s' for user '%s' by %s", decision, kind, addr, e.User, by)
+	}
+	if a.file == nil {
+		return
+	}
+	b, _ := json.Marshal(e)
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		clog.Infof("Failed to write ACL audit event: %s", err)
+	}
+}
@@ -0,0 +1,106 @@
+package chserver
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// Authenticator validates the credentials presented by a connecting
+// client. On success it returns the user whose access list should be
+// enforced for the session. A nil user with a nil error grants the
+// session unrestricted access.
+type Authenticator interface {
+	Authenticate(user, pass string, c ssh.ConnMetadata) (*chshare.User, error)
+}
+
+// ErrInvalidCredentials is matched (with errors.Is) by the errors of
+// Authenticators rejecting a client's credentials, as opposed to failing
+// to check them (as when their backend is unreachable). Only rejections
+// count towards the lockouts of Config.LoginLimit, see Rejected
+var ErrInvalidCredentials = errors.New("Invalid authentication")
+
+// Rejected marks the error as a rejection of the client's credentials
+func Rejected(err error) error {
+	return rejectedError{err}
+}
+
+type rejectedError struct {
+	error
+}
+
+func (e rejectedError) Is(target error) bool {
+	return target == ErrInvalidCredentials
+}
+
+// invalidAuth rejects the credentials of the username
+func invalidAuth(name string) error {
+	return Rejected(fmt.Errorf("Invalid authentication for username: %s", name))
+}
+
+// checkAuthBackends returns a ConfigError when more than one backend
+// would authenticate users, as each would silently replace the others.
+// The user index (of the auth file, Auth, Redis or Vault) adds access
+// lists to the users of AuthURL, LDAP and tokens, but is otherwise
+// ignored by an Authenticator or SQL
+func checkAuthBackends(config *Config, vaultUsers bool) error {
+	var backends []string
+	if config.Authenticator != nil {
+		backends = append(backends, "Authenticator")
+	}
+	if config.AuthURL != "" {
+		backends = append(backends, "AuthURL")
+	}
+	if config.LDAP.URL != "" {
+		backends = append(backends, "LDAP")
+	}
+	if config.SQL.DSN != "" {
+		backends = append(backends, "SQL")
+	}
+	if len(backends) > 1 {
+		return &ConfigError{Setting: backends[1], Err: fmt.Errorf("Can't be used with %s, only one may authenticate users", backends[0])}
+	}
+	index := config.AuthFile != "" || config.Auth != "" || config.Redis.URL != "" || vaultUsers
+	tokens := config.JWTSecret != "" || config.JWKSURL != "" || config.OIDCIssuer != ""
+	if index && !tokens && (config.Authenticator != nil || config.SQL.DSN != "") {
+		return &ConfigError{Setting: backends[0], Err: errors.New("The users of the auth file, Auth, Redis or Vault would be ignored")}
+	}
+	return nil
+}
+
+// AuthenticatorFunc adapts an ordinary function into an Authenticator
+type AuthenticatorFunc func(user, pass string, c ssh.ConnMetadata) (*chshare.User, error)
+
+// Authenticate calls f(user, pass, c)
+func (f AuthenticatorFunc) Authenticate(user, pass string, c ssh.ConnMetadata) (*chshare.User, error) {
+	return f(user, pass, c)
+}
+
+// NewUserIndexAuthenticator creates the default Authenticator, which
+// checks credentials against the users found in the given index
+func NewUserIndexAuthenticator(users *chshare.UserIndex) Authenticator {
+	return &userIndexAuthenticator{users: users}
+}
+
+type userIndexAuthenticator struct {
+	users *chshare.UserIndex
+	//required when users are loaded dynamically,
+	//so an empty index doesn't allow all
+	required bool
+}
+
+func (a *userIndexAuthenticator) Authenticate(name, pass string, c ssh.ConnMetadata) (*chshare.User, error) {
+	// check if user authenication is enable and it not allow all
+	if a.users.Len() == 0 && !a.required {
+		return nil, nil
+	}
+	// check the user exists and has matching password
+	user, found := a.users.Get(name)
+	if !found || !chshare.CheckPassword(user.Pass, pass) {
+		return nil, invalidAuth(name)
+	}
+	return user, nil
+}
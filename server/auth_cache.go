@@ -0,0 +1,77 @@
+package chserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// authCache holds recent authentication results. Entries are
+// keyed by a MAC of the credentials (using a random per-process
+// key) so that passwords are never held in memory as-is.
+type authCache struct {
+	sync.Mutex
+	secret  []byte
+	entries map[string]*authCacheEntry
+	pruned  time.Time
+}
+
+type authCacheEntry struct {
+	user    *chshare.User
+	err     error
+	expires time.Time
+}
+
+func newAuthCache() *authCache {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &authCache{
+		secret:  secret,
+		entries: map[string]*authCacheEntry{},
+	}
+}
+
+func (c *authCache) key(name, pass string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(pass))
+	return string(mac.Sum(nil))
+}
+
+func (c *authCache) get(key string) (*authCacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, found := c.entries[key]
+	if !found || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e, true
+}
+
+// clear forgets all of the results
+func (c *authCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = map[string]*authCacheEntry{}
+}
+
+func (c *authCache) set(key string, user *chshare.User, err error, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	//occasionally drop expired entries
+	if now.Sub(c.pruned) > time.Minute {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.pruned = now
+	}
+	c.entries[key] = &authCacheEntry{user: user, err: err, expires: now.Add(ttl)}
+}
@@ -0,0 +1,119 @@
+package chserver
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// JWTScopePrefix marks the token scopes which grant access to
+// an address, for example "chisel:^10.0.0.5:22$" or "chisel:*"
+const JWTScopePrefix = "chisel:"
+
+// JWTOnceClaim marks a single-use token (when true), which
+// must also have a "jti" claim. Once a single-use token has
+// been accepted, it is rejected until it expires.
+const JWTOnceClaim = "chisel_once"
+
+// JWTExactClaim marks a token (when true) which grants exactly its
+// scopes, without the addresses of the matching user in the index,
+// as do single-use tokens. It is set on the tokens of chisel token.
+const JWTExactClaim = "chisel_exact"
+
+// NewJWTAuthenticator creates an Authenticator which accepts JSON Web
+// Tokens in place of a password. The token subject becomes the username
+// and the user's access list is built from the token's "chisel:" scopes
+// plus the addresses of the matching user in the index (if any), unless
+// the token is exact (see JWTExactClaim). Any password which is not a
+// token is handed to next.
+func NewJWTAuthenticator(v *chshare.JWTVerifier, users *chshare.UserIndex, next Authenticator) Authenticator {
+	return &jwtAuthenticator{verifier: v, users: users, next: next, used: map[string]time.Time{}}
+}
+
+type jwtAuthenticator struct {
+	verifier *chshare.JWTVerifier
+	users    *chshare.UserIndex
+	next     Authenticator
+	//used holds the IDs of accepted single-use tokens until they expire
+	usedMut sync.Mutex
+	used    map[string]time.Time
+}
+
+func (a *jwtAuthenticator) Authenticate(name, pass string, c ssh.ConnMetadata) (*chshare.User, error) {
+	if !chshare.IsJWT(pass) {
+		return a.next.Authenticate(name, pass, c)
+	}
+	claims, err := a.verifier.Verify(pass)
+	if err != nil {
+		//unless the keys couldn't be fetched, the token is invalid
+		if _, ok := err.(*chshare.JWKSError); ok {
+			return nil, err
+		}
+		return nil, Rejected(err)
+	}
+	sub := claims.String("sub")
+	if sub == "" {
+		return nil, errors.New("Token has no subject")
+	}
+	user := &chshare.User{Name: sub}
+	var remotes []string
+	for _, scope := range append(claims.Strings("scope"), claims.Strings("scp")...) {
+		if strings.HasPrefix(scope, JWTScopePrefix) {
+			remotes = append(remotes, strings.TrimPrefix(scope, JWTScopePrefix))
+		}
+	}
+	if user.Addrs, err = chshare.ParseAddrs(remotes); err != nil {
+		return nil, err
+	}
+	//string claims are access list variables
+	user.Vars = map[string]string{}
+	for k, v := range claims {
+		if s, ok := v.(string); ok {
+			user.Vars[k] = s
+		}
+	}
+	once, _ := claims[JWTOnceClaim].(bool)
+	exact, _ := claims[JWTExactClaim].(bool)
+	if u, found := a.users.Get(sub); found {
+		if !once && !exact {
+			user.AddRules(u)
+		}
+		for k, v := range u.Vars {
+			user.Vars[k] = v
+		}
+	}
+	if once {
+		if err := a.use(claims); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// use records the single-use token, failing if it was already used
+func (a *jwtAuthenticator) use(claims chshare.JWTClaims) error {
+	jti := claims.String("jti")
+	if jti == "" {
+		return errors.New("Single-use token has no ID")
+	}
+	exp, _ := claims["exp"].(float64)
+	a.usedMut.Lock()
+	defer a.usedMut.Unlock()
+	now := time.Now()
+	for id, until := range a.used {
+		if now.After(until) {
+			delete(a.used, id)
+		}
+	}
+	if _, ok := a.used[jti]; ok {
+		return Rejected(errors.New("Token has already been used"))
+	}
+	//keep it past the verifier's leeway
+	a.used[jti] = time.Unix(int64(exp), 0).Add(time.Hour)
+	return nil
+}
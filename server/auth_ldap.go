@@ -0,0 +1,174 @@
+package chserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// LDAPConfig configures an LDAP Authenticator
+type LDAPConfig struct {
+	// URL of the directory, ldap://host[:port] or ldaps://host[:port]
+	URL string
+	// CA is an optional path to a PEM-encoded certificate
+	// authority used to verify ldaps (and StartTLS) servers
+	CA string
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool
+	// Plaintext allows passwords to be sent to ldap:// directories
+	// without StartTLS, which are otherwise refused
+	Plaintext bool
+	// BindDN and BindPassword are the credentials used to search
+	// for users, when empty the search is made anonymously
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched for
+	BaseDN string
+	// UserFilter finds a user's entry, with %s replaced by the
+	// username. Defaults to (uid=%s), Active Directory uses
+	// (sAMAccountName=%s).
+	UserFilter string
+	// GroupFilter is optionally combined with the UserFilter,
+	// restricting logins to the users which also match it
+	GroupFilter string
+	// GroupAttr is the attribute listing a user's
+	// group DNs, defaults to memberOf
+	GroupAttr string
+	// Groups maps group names (common names or DNs)
+	// to the addrs which their members may access
+	Groups  map[string][]string
+	Timeout time.Duration
+}
+
+// NewLDAPAuthenticator creates an Authenticator which verifies
+// credentials by binding to a directory as the user. The user's
+// access list is made up of the addrs of each of their mapped groups,
+// along with the addrs of the matching user in the index.
+func NewLDAPAuthenticator(c LDAPConfig, users *chshare.UserIndex) (Authenticator, error) {
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+	if c.GroupAttr == "" {
+		c.GroupAttr = "memberOf"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	//passwords are only bound in cleartext when allowed
+	if strings.HasPrefix(c.URL, "ldap://") && !c.StartTLS && !c.Plaintext {
+		return nil, errors.New("Passwords would be sent to the ldap:// directory in cleartext, use ldaps://, StartTLS, or allow plaintext")
+	}
+	if strings.HasPrefix(c.URL, "ldaps://") && c.StartTLS {
+		return nil, errors.New("StartTLS only applies to ldap:// directories")
+	}
+	//check filters early
+	if _, err := compileLDAPFilter(c.UserFilter); err != nil {
+		return nil, err
+	}
+	if c.GroupFilter != "" {
+		if _, err := compileLDAPFilter(c.GroupFilter); err != nil {
+			return nil, err
+		}
+	}
+	a := &ldapAuthenticator{
+		LDAPConfig: c,
+		users:      users,
+		groups:     map[string][]*chshare.ACLRule{},
+		tls:        &tls.Config{},
+	}
+	for group, remotes := range c.Groups {
+		addrs, err := chshare.ParseAddrs(remotes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid LDAP group '%s': %s", group, err)
+		}
+		key := strings.ToLower(group)
+		a.groups[key] = append(a.groups[key], addrs...)
+	}
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read LDAP CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in LDAP CA: %s", c.CA)
+		}
+		a.tls.RootCAs = pool
+	}
+	return a, nil
+}
+
+type ldapAuthenticator struct {
+	LDAPConfig
+	users  *chshare.UserIndex
+	groups map[string][]*chshare.ACLRule
+	tls    *tls.Config
+}
+
+func (a *ldapAuthenticator) Authenticate(name, pass string, c ssh.ConnMetadata) (*chshare.User, error) {
+	//an empty password would be an unauthenticated bind
+	if name == "" || pass == "" {
+		return nil, invalidAuth(name)
+	}
+	conn, err := dialLDAP(a.URL, a.tls, a.StartTLS, a.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP connection failed: %s", err)
+	}
+	defer conn.close()
+	if a.BindDN != "" {
+		if err := conn.bind(a.BindDN, a.BindPassword); err != nil {
+			return nil, fmt.Errorf("LDAP search bind failed: %s", err)
+		}
+	}
+	filter := strings.Replace(a.UserFilter, "%s", ldapEscapeFilter(name), -1)
+	if a.GroupFilter != "" {
+		filter = "(&" + filter + a.GroupFilter + ")"
+	}
+	entries, err := conn.search(a.BaseDN, filter, []string{a.GroupAttr})
+	if err != nil {
+		return nil, fmt.Errorf("LDAP search failed: %s", err)
+	}
+	if len(entries) != 1 {
+		return nil, invalidAuth(name)
+	}
+	entry := entries[0]
+	if err := conn.bind(entry.DN, pass); err != nil {
+		if e, ok := err.(*ldapError); ok && e.Code == ldapResultInvalidCred {
+			return nil, invalidAuth(name)
+		}
+		return nil, fmt.Errorf("LDAP bind failed: %s", err)
+	}
+	user := &chshare.User{Name: name}
+	for _, dn := range entry.Attrs[strings.ToLower(a.GroupAttr)] {
+		user.Addrs = append(user.Addrs, a.groupAddrs(dn)...)
+	}
+	if u, found := a.users.Get(name); found {
+		user.AddRules(u)
+	}
+	return user, nil
+}
+
+// groupAddrs finds the addrs of a group by its DN, or by
+// the value of the DN's first component (its common name)
+func (a *ldapAuthenticator) groupAddrs(dn string) []*chshare.ACLRule {
+	dn = strings.ToLower(dn)
+	if addrs, ok := a.groups[dn]; ok {
+		return addrs
+	}
+	rdn := dn
+	if i := strings.IndexByte(rdn, ','); i >= 0 {
+		rdn = rdn[:i]
+	}
+	if i := strings.IndexByte(rdn, '='); i >= 0 {
+		return a.groups[strings.TrimSpace(rdn[i+1:])]
+	}
+	return nil
+}
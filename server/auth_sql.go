@@ -0,0 +1,200 @@
+package chserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// SQLConfig configures an SQL Authenticator. The database/sql driver
+// must be registered by the program, by importing it (for example
+// github.com/lib/pq for PostgreSQL, or github.com/go-sql-driver/mysql,
+// as the chisel command does).
+type SQLConfig struct {
+	// Driver is the registered driver name, when empty it is
+	// inferred from the DSN (see SQLDriver)
+	Driver string
+	DSN    string
+	// UserQuery looks up a user at login. It takes the username as its
+	// only parameter, and returns a row of (username, password, addrs),
+	// where the password may be a hash and addrs is a JSON array of
+	// address regular expressions.
+	UserQuery string
+	// UsersQuery loads all users, returning the same columns as
+	// UserQuery. The loaded users are used when the database
+	// is unavailable at login.
+	UsersQuery string
+	// Refresh is how often UsersQuery is run (0 disables)
+	Refresh time.Duration
+	Logger  *chshare.Logger
+}
+
+// SQLDriver infers the database/sql driver name from a DSN: URLs
+// starting with postgres:// (or postgresql://) and PostgreSQL
+// key=value strings use "postgres", otherwise "mysql"
+func SQLDriver(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") ||
+		strings.Contains(dsn, "host=") || strings.Contains(dsn, "dbname=") {
+		return "postgres"
+	}
+	return "mysql"
+}
+
+// NewSQLAuthenticator creates an Authenticator which looks up
+// users and their access lists in an SQL database
+func NewSQLAuthenticator(c SQLConfig) (Authenticator, error) {
+	if c.Driver == "" {
+		c.Driver = SQLDriver(c.DSN)
+	}
+	param := "?"
+	if c.Driver == "postgres" {
+		param = "$1"
+	}
+	if c.UserQuery == "" {
+		c.UserQuery = "SELECT username, password, addrs FROM chisel_users WHERE username = " + param
+	}
+	if c.UsersQuery == "" {
+		c.UsersQuery = "SELECT username, password, addrs FROM chisel_users"
+	}
+	if c.Logger == nil {
+		c.Logger = chshare.NewLogger("sql")
+	}
+	if !sqlDriverRegistered(c.Driver) {
+		return nil, fmt.Errorf("SQL driver '%s' is not included in this build", c.Driver)
+	}
+	db, err := sql.Open(c.Driver, c.DSN)
+	if err != nil {
+		return nil, err
+	}
+	a := &sqlAuthenticator{
+		SQLConfig: c,
+		db:        db,
+		users:     chshare.NewUsers(),
+	}
+	if c.Refresh > 0 {
+		if err := a.load(); err != nil {
+			return nil, err
+		}
+		go a.refresh()
+	}
+	return a, nil
+}
+
+func sqlDriverRegistered(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+type sqlAuthenticator struct {
+	SQLConfig
+	db *sql.DB
+	sync.RWMutex
+	users *chshare.Users
+}
+
+func (a *sqlAuthenticator) Authenticate(name, pass string, c ssh.ConnMetadata) (*chshare.User, error) {
+	user, err := a.lookup(name)
+	if err != nil {
+		if a.Refresh == 0 {
+			return nil, fmt.Errorf("SQL user lookup failed: %s", err)
+		}
+		a.Logger.Infof("SQL user lookup failed, using the last loaded users (%s)", err)
+		a.RLock()
+		user, _ = a.users.Get(name)
+		a.RUnlock()
+	}
+	if user == nil || !chshare.CheckPassword(user.Pass, pass) {
+		return nil, invalidAuth(name)
+	}
+	return user, nil
+}
+
+// lookup runs UserQuery, returning a nil user when there's no such
+// user. Only the errors of a failed query are returned, so that the last
+// loaded users are never used in place of a row which was found but
+// is invalid (which is rejected, as is a user which isn't found)
+func (a *sqlAuthenticator) lookup(name string) (*chshare.User, error) {
+	rows, err := a.db.Query(a.UserQuery, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	user, err := a.scanUser(rows)
+	if err != nil {
+		a.Logger.Infof("SQL user lookup failed: %s", err)
+		return nil, nil
+	}
+	return user, nil
+}
+
+// load replaces the loaded users with the results of UsersQuery
+func (a *sqlAuthenticator) load() error {
+	rows, err := a.db.Query(a.UsersQuery)
+	if err != nil {
+		return fmt.Errorf("SQL users query failed: %s", err)
+	}
+	defer rows.Close()
+	users := chshare.NewUsers()
+	for rows.Next() {
+		user, err := a.scanUser(rows)
+		if err != nil {
+			return err
+		}
+		users.AddUser(user)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("SQL users query failed: %s", err)
+	}
+	a.Lock()
+	a.users = users
+	a.Unlock()
+	a.Logger.Debugf("Loaded %d users from SQL", users.Len())
+	return nil
+}
+
+func (a *sqlAuthenticator) refresh() {
+	for range time.Tick(a.Refresh) {
+		if err := a.load(); err != nil {
+			a.Logger.Infof("Failed to refresh SQL users: %s", err)
+		}
+	}
+}
+
+func (a *sqlAuthenticator) scanUser(row interface {
+	Scan(dest ...interface{}) error
+}) (*chshare.User, error) {
+	var remotes sql.NullString
+	user := &chshare.User{}
+	if err := row.Scan(&user.Name, &user.Pass, &remotes); err != nil {
+		return nil, err
+	}
+	if err := chshare.ValidatePassword(user.Pass); err != nil {
+		return nil, fmt.Errorf("Invalid password hash for user: %s (%s)", user.Name, err)
+	}
+	if remotes.Valid && remotes.String != "" {
+		var list []string
+		if err := json.Unmarshal([]byte(remotes.String), &list); err != nil {
+			return nil, fmt.Errorf("Invalid addrs for user: %s (%s)", user.Name, err)
+		}
+		addrs, err := chshare.ParseAddrs(list)
+		if err != nil {
+			return nil, err
+		}
+		user.Addrs = addrs
+	}
+	return user, nil
+}
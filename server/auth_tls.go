@@ -0,0 +1,228 @@
+package chserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// TLSConfig enables TLS on the server's listener. When CA is set, client
+// certificates signed by it are verified and mapped to users, see certUser.
+// Instead of paths, KeyPEM and CertPEM may contain the key pair itself.
+type TLSConfig struct {
+	Key     string
+	Cert    string
+	KeyPEM  []byte
+	CertPEM []byte
+	CA      string
+	// RequireClientCert rejects connections without a client
+	// certificate verified by the CA, and CRL and OCSP reject
+	// revoked certificates, see revocationChecker
+	RequireClientCert bool
+	CRL               string
+	OCSP              bool
+	// Domains enables certificates from an ACME CA
+	// (ACMEURL, defaulting to Let's Encrypt) in place
+	// of the key pair, see acmeManager
+	Domains   []string
+	ACMEURL   string
+	ACMEEmail string
+	ACMECache string
+	// SNICerts are further key pairs, presented to clients
+	// requesting one of their names (with SNI)
+	SNICerts []TLSKeyPair
+	// MinVersion (like 1.2), CipherSuites and Curves
+	// (by their Go names) restrict the handshakes
+	MinVersion   string
+	CipherSuites []string
+	Curves       []string
+}
+
+// TLSKeyPair are the paths of a PEM-encoded key and certificate
+type TLSKeyPair struct {
+	Key  string
+	Cert string
+}
+
+func (s *Server) newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if len(c.Domains) > 0 {
+		return s.newACMETLSConfig(c)
+	}
+	if len(c.KeyPEM) > 0 && len(c.CertPEM) > 0 {
+		cert, err = tls.X509KeyPair(c.CertPEM, c.KeyPEM)
+	} else if c.Key != "" && c.Cert != "" {
+		cert, err = tls.LoadX509KeyPair(c.Cert, c.Key)
+	} else {
+		return nil, errors.New("TLS requires both a key and a cert")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS key pair: %s", err)
+	}
+	s.setCertificate(&cert)
+	for _, p := range c.SNICerts {
+		cert, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS key pair: %s", err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("Failed to load TLS key pair: %s", err)
+		}
+		s.sniCerts = append(s.sniCerts, &cert)
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: s.getCertificate,
+	}
+	return tlsConfig, s.configureTLS(tlsConfig, c)
+}
+
+func (s *Server) newACMETLSConfig(c TLSConfig) (*tls.Config, error) {
+	if c.Key != "" || c.Cert != "" {
+		return nil, errors.New("TLS domains can't be used with a key and a cert")
+	}
+	var err error
+	if s.acme, err = newACMEManager(c, s.Logger); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: s.acme.getCertificate,
+		NextProtos:     []string{acmeALPNProto},
+	}
+	return tlsConfig, s.configureTLS(tlsConfig, c)
+}
+
+// configureTLS applies the options shared by all certificates
+func (s *Server) configureTLS(tlsConfig *tls.Config, c TLSConfig) error {
+	//HTTP/2 is negotiated for tunnels over HTTP/2 streams
+	tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
+	if err := setTLSParameters(tlsConfig, c); err != nil {
+		return err
+	}
+	return s.setClientCA(tlsConfig, c)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+func setTLSParameters(tlsConfig *tls.Config, c TLSConfig) error {
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return fmt.Errorf("Invalid TLS version '%s' (expected 1.0, 1.1, 1.2 or 1.3)", c.MinVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, name := range c.CipherSuites {
+		found := false
+		for _, suite := range suites {
+			if strings.EqualFold(suite.Name, name) {
+				tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite.ID)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown TLS cipher suite '%s'", name)
+		}
+	}
+	for _, name := range c.Curves {
+		found := false
+		for _, curve := range tlsCurves {
+			//like X25519, P256 or CurveP256
+			if strings.EqualFold(curve.String(), name) || strings.EqualFold(curve.String(), "Curve"+name) {
+				tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown TLS curve '%s'", name)
+		}
+	}
+	return chshare.FIPSTLS(tlsConfig)
+}
+
+// setClientCA enables client certificates verified by the CA, if any
+func (s *Server) setClientCA(tlsConfig *tls.Config, c TLSConfig) error {
+	if ca := c.CA; ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return fmt.Errorf("Failed to read TLS CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in TLS CA: %s", ca)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		checker, err := newRevocationChecker(c, s.Logger)
+		if err != nil {
+			return err
+		}
+		if checker != nil {
+			tlsConfig.VerifyPeerCertificate = checker.verify
+		}
+	} else if c.RequireClientCert || c.CRL != "" || c.OCSP {
+		return errors.New("Client certificate checks require a TLS CA")
+	}
+	return nil
+}
+
+// setCertificate replaces the certificate presented to new connections
+func (s *Server) setCertificate(cert *tls.Certificate) {
+	s.certMut.Lock()
+	s.cert = cert
+	s.certMut.Unlock()
+}
+
+// getCertificate provides the SNI certificate for the
+// requested name, if any, or else the main certificate
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName != "" {
+		for _, cert := range s.sniCerts {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	s.certMut.RLock()
+	defer s.certMut.RUnlock()
+	return s.cert, nil
+}
+
+// certUser finds the user matching the certificate's common
+// name or, failing that, one of its subject alternative names
+func (s *Server) certUser(cert *x509.Certificate) (*chshare.User, error) {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, n := range names {
+		if n == "" {
+			continue
+		}
+		if user, found := s.users.Get(n); found {
+			if user.Expired() {
+				return nil, fmt.Errorf("User '%s' has expired", user.Name)
+			}
+			return user.Expand()
+		}
+	}
+	return nil, fmt.Errorf("No user found for client certificate '%s'", cert.Subject.CommonName)
+}
@@ -0,0 +1,342 @@
+package chserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// authURLRequest is POSTed to the AuthURL for each login
+type authURLRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// authURLResponse is the optional JSON body of a successful
+// (200 OK) AuthURL response, used to build the session ACL
+type authURLResponse struct {
+	Addrs       *[]string         `json:"addrs"`
+	MaxSessions int               `json:"max_sessions"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	Vars        map[string]string `json:"vars"`
+}
+
+// AuthURLConfig configures an AuthURL Authenticator
+type AuthURLConfig struct {
+	URL    string
+	Client *http.Client
+	// CacheTTL enables caching of successful
+	// authentications for the given duration
+	CacheTTL time.Duration
+	// FailedCacheTTL enables caching of rejected
+	// authentications for the given duration
+	FailedCacheTTL time.Duration
+	// Timeout bounds each request to the service
+	Timeout time.Duration
+	// Retries is the number of additional attempts made
+	// after transport errors and 5xx responses
+	Retries int
+	// BreakerThreshold is the number of consecutive failed logins
+	// which opens the circuit breaker, after which logins fail fast
+	// for BreakerCooldown (0 disables the breaker)
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Headers are added to each request (e.g. API keys)
+	Headers http.Header
+	// Secret enables request signing, see signAuthURLRequest
+	Secret string
+	Logger *chshare.Logger
+}
+
+// NewAuthURLAuthenticator creates an Authenticator which delegates
+// credential checks to an HTTP service. Each login is POSTed to the URL
+// as JSON and accepted when the service responds 200 OK. When the
+// response contains an "addrs" list it becomes the user's access
+// list, otherwise the addrs of the matching user in the index are
+// used (and without one, the user may not access any address).
+func NewAuthURLAuthenticator(c AuthURLConfig, users *chshare.UserIndex) Authenticator {
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	if c.Logger == nil {
+		c.Logger = chshare.NewLogger("authurl")
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = 30 * time.Second
+	}
+	return &authURLAuthenticator{
+		AuthURLConfig: c,
+		users:         users,
+		cache:         newAuthCache(),
+		breaker: &circuitBreaker{
+			threshold: c.BreakerThreshold,
+			cooldown:  c.BreakerCooldown,
+		},
+	}
+}
+
+type authURLAuthenticator struct {
+	AuthURLConfig
+	users   *chshare.UserIndex
+	cache   *authCache
+	breaker *circuitBreaker
+	//latency (optional) observes the duration of each login
+	latency *histogram
+}
+
+func (a *authURLAuthenticator) Authenticate(name, pass string, c ssh.ConnMetadata) (*chshare.User, error) {
+	if a.CacheTTL == 0 && a.FailedCacheTTL == 0 {
+		return a.authenticate(name, pass, c)
+	}
+	var user *chshare.User
+	var err error
+	key := a.cache.key(name, pass)
+	if e, found := a.cache.get(key); found {
+		user, err = e.user, e.err
+	} else {
+		user, err = a.authenticate(name, pass, c)
+		if _, failed := err.(*authRejectedError); failed && a.FailedCacheTTL > 0 {
+			a.cache.set(key, nil, err, a.FailedCacheTTL)
+		} else if err == nil && a.CacheTTL > 0 {
+			a.cache.set(key, user, nil, a.CacheTTL)
+		}
+	}
+	return user, err
+}
+
+// authRejectedError is returned when the AuthURL service
+// rejects the credentials (as opposed to failing to respond)
+type authRejectedError struct {
+	name string
+}
+
+func (e *authRejectedError) Error() string {
+	return fmt.Sprintf("Invalid authentication for username: %s", e.name)
+}
+
+func (e *authRejectedError) Is(target error) bool {
+	return target == ErrInvalidCredentials
+}
+
+func (a *authURLAuthenticator) authenticate(name, pass string, c ssh.ConnMetadata) (*chshare.User, error) {
+	body, _ := json.Marshal(&authURLRequest{
+		Username:   name,
+		Password:   pass,
+		RemoteAddr: c.RemoteAddr().String(),
+	})
+	t0 := time.Now()
+	status, b, err := a.post(body)
+	a.latency.observe(time.Since(t0))
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, &authRejectedError{name: name}
+	}
+	result := authURLResponse{}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &result); err != nil {
+			return nil, fmt.Errorf("Invalid auth URL response: %s", err)
+		}
+	}
+	user := &chshare.User{
+		Name:        name,
+		MaxSessions: result.MaxSessions,
+		Expires:     result.ExpiresAt,
+		Vars:        result.Vars,
+	}
+	if result.Addrs != nil {
+		if user.Addrs, err = chshare.ParseAddrs(*result.Addrs); err != nil {
+			return nil, err
+		}
+	} else if u, found := a.users.Get(name); found {
+		user.AddRules(u)
+		if user.Vars == nil {
+			user.Vars = u.Vars
+		}
+	}
+	return user, nil
+}
+
+// post sends a login to the AuthURL service, retrying transport
+// errors and 5xx responses, and failing fast while the circuit
+// breaker is open
+func (a *authURLAuthenticator) post(body []byte) (int, []byte, error) {
+	if !a.breaker.allow() {
+		a.Logger.Debugf("Auth URL circuit breaker open, skipping request")
+		return 0, nil, errAuthURLUnavailable
+	}
+	b := &backoff.Backoff{Min: 100 * time.Millisecond, Max: 2 * time.Second, Jitter: true}
+	for attempt := 0; ; attempt++ {
+		status, resp, err := a.do(body)
+		if err == nil && status < 500 {
+			a.breaker.success()
+			return status, resp, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("Auth URL responded with status %d", status)
+		}
+		if attempt >= a.Retries {
+			if a.breaker.failure() {
+				a.Logger.Infof("Auth URL circuit breaker opened for %s after %d consecutive failures (%s)",
+					a.BreakerCooldown, a.BreakerThreshold, err)
+			}
+			return 0, nil, err
+		}
+		d := b.Duration()
+		a.Logger.Debugf("%s, retrying in %s...", err, d)
+		time.Sleep(d)
+	}
+}
+
+func (a *authURLAuthenticator) do(body []byte) (int, []byte, error) {
+	req, err := http.NewRequest("POST", a.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for k, v := range a.Headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.Secret != "" {
+		signAuthURLRequest(req, a.Secret, body, time.Now())
+	}
+	if a.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), a.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Auth URL request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Auth URL response failed: %s", err)
+	}
+	return resp.StatusCode, b, nil
+}
+
+// signAuthURLRequest allows the AuthURL service to verify that a request
+// came from this server. The X-Chisel-Signature header is the hex encoded
+// HMAC-SHA256 of the X-Chisel-Timestamp header (unix seconds), a "." and
+// the request body, keyed with the shared secret. Services should reject
+// requests with an invalid signature or a timestamp outside of a short
+// window, to prevent replays.
+func signAuthURLRequest(req *http.Request, secret string, body []byte, t time.Time) {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	req.Header.Set("X-Chisel-Timestamp", ts)
+	req.Header.Set("X-Chisel-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+var errAuthURLUnavailable = errors.New("Auth URL unavailable (circuit breaker open)")
+
+// circuitBreaker opens after a number of consecutive failures, then
+// rejects requests until the cooldown passes, after which a single
+// trial request is let through to decide whether to close again
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (c *circuitBreaker) allow() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.threshold <= 0 || c.failures < c.threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(c.openUntil) {
+		return false
+	}
+	//half-open, hold off others while this trial runs
+	c.openUntil = now.Add(c.cooldown)
+	return true
+}
+
+func (c *circuitBreaker) success() {
+	c.Lock()
+	c.failures = 0
+	c.Unlock()
+}
+
+// failure records a failed request, returning true
+// when this failure caused the breaker to open
+func (c *circuitBreaker) failure() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.threshold <= 0 {
+		return false
+	}
+	c.failures++
+	if c.failures >= c.threshold {
+		c.openUntil = time.Now().Add(c.cooldown)
+	}
+	return c.failures == c.threshold
+}
+
+// newAuthURLClient creates the HTTP client used to reach the AuthURL,
+// optionally trusting an additional certificate authority and
+// presenting a client certificate
+func newAuthURLClient(caCert, clientCert, clientKey string) (*http.Client, error) {
+	if caCert == "" && clientCert == "" && clientKey == "" {
+		return http.DefaultClient, nil
+	}
+	c := &tls.Config{}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read auth URL CA: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in auth URL CA: %s", caCert)
+		}
+		c.RootCAs = pool
+	}
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, errors.New("Auth URL client certificate and key must be provided together")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load auth URL client certificate: %s", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c,
+		},
+	}, nil
+}
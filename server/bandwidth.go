@@ -0,0 +1,66 @@
+package chserver
+
+import (
+	"sync"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// bandwidthIndex holds the rate limiter shared
+// by all of the sessions of each user
+type bandwidthIndex struct {
+	sync.Mutex
+	inner map[string]*userBandwidth
+	//rate applies to users without their own limit
+	rate int64
+}
+
+type userBandwidth struct {
+	limiter  *chshare.RateLimiter
+	sessions int
+}
+
+func newBandwidthIndex(rate int64) *bandwidthIndex {
+	return &bandwidthIndex{inner: map[string]*userBandwidth{}, rate: rate}
+}
+
+// acquire returns the user's rate limiter, or nil when
+// they are unlimited, and must be followed by release
+func (b *bandwidthIndex) acquire(user *chshare.User) *chshare.RateLimiter {
+	rate := b.rate
+	name := ""
+	if user != nil {
+		name = user.Name
+		if user.Bandwidth > 0 {
+			rate = user.Bandwidth
+		}
+	}
+	b.Lock()
+	defer b.Unlock()
+	u, ok := b.inner[name]
+	if !ok {
+		u = &userBandwidth{limiter: chshare.NewRateLimiter(rate)}
+		b.inner[name] = u
+	}
+	//the latest session applies any change to the user's limit
+	u.limiter.SetRate(rate)
+	u.sessions++
+	if rate == 0 {
+		return nil
+	}
+	return u.limiter
+}
+
+func (b *bandwidthIndex) release(user *chshare.User) {
+	name := ""
+	if user != nil {
+		name = user.Name
+	}
+	b.Lock()
+	defer b.Unlock()
+	if u, ok := b.inner[name]; ok {
+		if u.sessions--; u.sessions <= 0 {
+			delete(b.inner, name)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package chserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// clusterTTL is how long a claim on a reverse port outlives
+// its server, which refreshes it a few times within it
+const clusterTTL = 30 * time.Second
+
+// ClusterConfig shares the reverse ports of several
+// servers behind a load balancer, see cluster
+type ClusterConfig struct {
+	// RedisURL is the registry of the claimed ports
+	RedisURL string
+	// Addr is the host (or IP address) of this
+	// server, as reached by the other servers
+	Addr string
+	// Key prefixes the registry's keys and is its
+	// change channel, defaults to chisel:cluster
+	Key string
+}
+
+// cluster lets any server of a cluster accept the connections of
+// any reverse port: each server claims the ports of its clients'
+// reverse remotes in Redis (as keys like chisel:cluster:tcp:<port>
+// which expire unless refreshed) and listens on the tcp ports claimed
+// by the others, forwarding their connections to the server holding
+// the client's session, which must then bind a reachable host
+type cluster struct {
+	ClusterConfig
+	*chshare.Logger
+	mut sync.Mutex
+	//owned counts the holders of each of this server's
+	//claims (by <proto>:<port>), which is only given up
+	//once the last of them releases it
+	owned    map[string]int
+	forwards map[string]*clusterForward
+}
+
+// clusterClaim is the value of a claimed port's key
+type clusterClaim struct {
+	Node string `json:"node"`
+	Host string `json:"host"`
+}
+
+type clusterForward struct {
+	claim clusterClaim
+	l     net.Listener
+}
+
+// newCluster returns nil when there's no registry
+func newCluster(c ClusterConfig, logger *chshare.Logger) (*cluster, error) {
+	if c.RedisURL == "" {
+		return nil, nil
+	}
+	if c.Addr == "" {
+		return nil, errors.New("Clustering requires the address of this server (--cluster-addr)")
+	}
+	if c.Key == "" {
+		c.Key = "chisel:cluster"
+	}
+	conn, err := dialRedis(c.RedisURL, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Redis connection failed: %s", err)
+	}
+	conn.close()
+	cl := &cluster{
+		ClusterConfig: c,
+		Logger:        logger.Fork("cluster"),
+		owned:         map[string]int{},
+		forwards:      map[string]*clusterForward{},
+	}
+	go cl.watch()
+	go cl.refresh()
+	return cl, nil
+}
+
+// key returns the key of the claim, by its <proto>:<port>
+func (c *cluster) key(claim string) string {
+	return c.Key + ":" + claim
+}
+
+// do runs commands on a new connection
+func (c *cluster) do(fn func(conn *redisConn) error) error {
+	conn, err := dialRedis(c.RedisURL, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("Redis connection failed: %s", err)
+	}
+	defer conn.close()
+	return fn(conn)
+}
+
+// claim claims the port (of the protocol, tcp or udp) for this
+// server, failing when it's held by another, and stops forwarding
+// it. Each claim must be released once its listener is closed
+func (c *cluster) claim(proto, host, port string) error {
+	if c == nil {
+		return nil
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	name := proto + ":" + port
+	if c.owned[name] > 0 {
+		c.owned[name]++
+		return nil
+	}
+	value, _ := json.Marshal(clusterClaim{Node: c.Addr, Host: host})
+	ttl := strconv.FormatInt(int64(clusterTTL/time.Millisecond), 10)
+	err := c.do(func(conn *redisConn) error {
+		reply, err := conn.do("SET", c.key(name), string(value), "NX", "PX", ttl)
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			//held by a server, perhaps this one before a restart
+			claim, err := getClusterClaim(conn, c.key(name))
+			if err != nil {
+				return err
+			}
+			if claim != nil && claim.Node != c.Addr {
+				return fmt.Errorf("Reverse port %s is held by server %s", port, claim.Node)
+			}
+			if _, err := conn.do("SET", c.key(name), string(value), "PX", ttl); err != nil {
+				return err
+			}
+		}
+		_, err = conn.do("PUBLISH", c.Key, name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.owned[name] = 1
+	if f, ok := c.forwards[port]; ok && proto == "tcp" {
+		f.l.Close()
+		delete(c.forwards, port)
+	}
+	return nil
+}
+
+// release gives up a claim of the port, and once it has no
+// more holders, the port itself (if this server still holds it)
+func (c *cluster) release(proto, port string) {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	name := proto + ":" + port
+	if c.owned[name] > 1 {
+		c.owned[name]--
+		return
+	}
+	delete(c.owned, name)
+	err := c.do(func(conn *redisConn) error {
+		//the claim could expire and be taken between these,
+		//though only once this server has failed to refresh it
+		claim, err := getClusterClaim(conn, c.key(name))
+		if err != nil || claim == nil || claim.Node != c.Addr {
+			return err
+		}
+		if _, err := conn.do("DEL", c.key(name)); err != nil {
+			return err
+		}
+		_, err = conn.do("PUBLISH", c.Key, name)
+		return err
+	})
+	if err != nil {
+		c.Infof("Failed to release port %s: %s", port, err)
+	}
+}
+
+// refresh extends the claims of this server's
+// ports and catches up on any missed changes
+func (c *cluster) refresh() {
+	for range time.Tick(clusterTTL / 3) {
+		c.mut.Lock()
+		err := c.do(func(conn *redisConn) error {
+			for name := range c.owned {
+				claim, err := getClusterClaim(conn, c.key(name))
+				if err != nil {
+					return err
+				}
+				if claim == nil || claim.Node != c.Addr {
+					c.Infof("Lost the claim on port %s", name)
+					delete(c.owned, name)
+					continue
+				}
+				ttl := strconv.FormatInt(int64(clusterTTL/time.Millisecond), 10)
+				if _, err := conn.do("PEXPIRE", c.key(name), ttl); err != nil {
+					return err
+				}
+			}
+			return c.sync(conn)
+		})
+		c.mut.Unlock()
+		if err != nil {
+			c.Infof("Refresh failed: %s", err)
+		}
+	}
+}
+
+// watch syncs the forwarded ports as claims are published
+func (c *cluster) watch() {
+	b := &backoff.Backoff{Max: 30 * time.Second}
+	for {
+		err := c.subscribe(b)
+		d := b.Duration()
+		c.Infof("Subscription failed: %s, reconnecting in %s", err, d)
+		time.Sleep(d)
+	}
+}
+
+func (c *cluster) subscribe(b *backoff.Backoff) error {
+	conn, err := dialRedis(c.RedisURL, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	if _, err := conn.do("SUBSCRIBE", c.Key); err != nil {
+		return err
+	}
+	if err := c.resync(); err != nil {
+		return err
+	}
+	b.Reset()
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		if msg, ok := reply.([]interface{}); !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		if err := c.resync(); err != nil {
+			c.Infof("Sync failed: %s", err)
+		}
+	}
+}
+
+func (c *cluster) resync() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.do(c.sync)
+}
+
+// sync forwards each tcp port claimed by another server, closing
+// forwards of expired claims (udp ports aren't forwarded, their
+// claims only keep other servers from binding them)
+func (c *cluster) sync(conn *redisConn) error {
+	claims := map[string]*clusterClaim{}
+	prefix := c.key("tcp:")
+	cursor := "0"
+	for {
+		reply, err := conn.do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		list, _ := reply.([]interface{})
+		if len(list) != 2 {
+			return errors.New("Invalid SCAN reply")
+		}
+		keys, _ := list[1].([]interface{})
+		for _, k := range keys {
+			key, _ := k.(string)
+			claim, err := getClusterClaim(conn, key)
+			if err != nil {
+				return err
+			}
+			if claim != nil && claim.Node != c.Addr {
+				claims[strings.TrimPrefix(key, prefix)] = claim
+			}
+		}
+		if cursor, _ = list[0].(string); cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	for port, f := range c.forwards {
+		if claim := claims[port]; claim == nil || *claim != f.claim {
+			f.l.Close()
+			delete(c.forwards, port)
+			c.Infof("Stopped forwarding port %s", port)
+		}
+	}
+	for port, claim := range claims {
+		if _, ok := c.forwards[port]; ok || c.owned["tcp:"+port] > 0 {
+			continue
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(claim.Host, port))
+		if err != nil {
+			c.Debugf("Failed to forward port %s: %s", port, err)
+			continue
+		}
+		f := &clusterForward{claim: *claim, l: l}
+		c.forwards[port] = f
+		c.Infof("Forwarding port %s to server %s", port, claim.Node)
+		go c.forward(f, port)
+	}
+	return nil
+}
+
+// forward relays the connections of a port to its server
+func (c *cluster) forward(f *clusterForward, port string) {
+	target := net.JoinHostPort(f.claim.Node, port)
+	for {
+		src, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			dst, err := net.DialTimeout("tcp", target, 10*time.Second)
+			if err != nil {
+				c.Infof("Failed to forward to %s: %s", target, err)
+				src.Close()
+				return
+			}
+			chshare.Pipe(src, dst)
+		}()
+	}
+}
+
+func getClusterClaim(conn *redisConn, key string) (*clusterClaim, error) {
+	reply, err := conn.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	value, _ := reply.(string)
+	claim := &clusterClaim{}
+	if err := json.Unmarshal([]byte(value), claim); err != nil {
+		return nil, fmt.Errorf("Invalid claim %s: %s", key, err)
+	}
+	return claim, nil
+}
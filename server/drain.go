@@ -0,0 +1,65 @@
+package chserver
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Drain stops accepting new clients and waits for the connected
+// clients to disconnect, for up to the timeout, before closing the
+// server along with any sessions which remain
+func (s *Server) Drain(timeout time.Duration) error {
+	atomic.StoreInt32(&s.draining, 1)
+	s.Infof("Draining %d sessions (for up to %s)", s.active.len(), timeout)
+	deadline := time.Now().Add(timeout)
+	for s.active.len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(250 * time.Millisecond)
+	}
+	if n := s.active.closeAll(); n > 0 {
+		s.Infof("Closed %d remaining sessions", n)
+	}
+	return s.Close()
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// SetMaintenance enables or disables maintenance mode, in which
+// clients are denied new sessions (and retry later), while
+// their current sessions continue
+func (s *Server) SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.maintenance, v) != v {
+		if enabled {
+			s.Infof("Maintenance mode enabled")
+		} else {
+			s.Infof("Maintenance mode disabled")
+		}
+	}
+}
+
+func (s *Server) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// watchDrain drains the server on SIGTERM,
+// closing it immediately on a second SIGTERM
+func (s *Server) watchDrain(timeout time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	<-sig
+	go func() {
+		<-sig
+		s.Infof("Closing immediately")
+		s.active.closeAll()
+		s.Close()
+	}()
+	s.Drain(timeout)
+}
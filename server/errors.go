@@ -0,0 +1,22 @@
+package chserver
+
+import "fmt"
+
+// ConfigError is returned by NewServer when a setting of the
+// Config can't be used, like a TLS certificate which fails to
+// load, so that programs embedding the server can tell which
+// one failed (using errors.As) and handle it
+type ConfigError struct {
+	// Setting is the name of the Config field, like
+	// KeySeed or TLS
+	Setting string
+	Err     error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", e.Setting, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
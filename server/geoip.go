@@ -0,0 +1,61 @@
+package chserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// geoIPFilter allows or denies client connections
+// by the country of their source IP
+type geoIPFilter struct {
+	db    *mmdb
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// newGeoIPFilter opens the MaxMind DB and parses the lists of
+// ISO country codes, returning nil when both lists are empty
+func newGeoIPFilter(path string, allow, deny []string) (*geoIPFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	if path == "" {
+		return nil, errors.New("A GeoIP database is required to restrict countries")
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open GeoIP database: %s", err)
+	}
+	f := &geoIPFilter{db: db, allow: map[string]bool{}, deny: map[string]bool{}}
+	for _, c := range allow {
+		f.allow[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+	for _, c := range deny {
+		f.deny[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+	return f, nil
+}
+
+// allowed reports whether the country of the IP isn't denied
+// and, when there is an allow list, is allowed (IPs of an unknown
+// country are only allowed without an allow list). It also returns
+// the country, if known.
+func (f *geoIPFilter) allowed(s string) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false, ""
+	}
+	country, err := f.db.country(ip)
+	if err != nil {
+		return false, ""
+	}
+	if f.deny[country] {
+		return false, country
+	}
+	return len(f.allow) == 0 || f.allow[country], country
+}
@@ -2,12 +2,16 @@ package chserver
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	socks5 "github.com/armon/go-socks5"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/jpillora/chisel/share"
@@ -15,11 +19,31 @@ import (
 
 // handleClientHandler is the main http websocket handler for the chisel server
 func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
-	//websockets upgrade AND has chisel prefix
+	if s.acme != nil && strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		s.acme.handleChallenge(w, r)
+		return
+	}
+	//virtual hosts which aren't tunnel endpoints are only proxied
+	if proxy := s.vhosts.proxy(r); proxy != nil {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	//websockets upgrade AND has chisel prefix (AND is on
+	//the websocket path, others are treated as normal requests)
 	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
 	protocol := r.Header.Get("Sec-WebSocket-Protocol")
-	if upgrade == "websocket" && strings.HasPrefix(protocol, "chisel-") {
+	//OR is an HTTP/2 stream or polling request, see isH2Tunnel
+	if isH2Tunnel(r) || isPollTunnel(r) {
+		upgrade, protocol = "websocket", r.Header.Get(chshare.H2ProtocolHeader)
+	}
+	onPath := s.wsPath == "" || r.URL.Path == s.wsPath
+	if upgrade == "websocket" && strings.HasPrefix(protocol, "chisel-") && onPath {
 		if protocol == chshare.ProtocolVersion {
+			//polling tunnels are only admitted when opened
+			if id := r.Header.Get(chshare.PollHeader); id != "" && id != "open" {
+				s.polls.serve(w, r, id)
+				return
+			}
 			s.handleWebsocket(w, r)
 			return
 		}
@@ -27,7 +51,17 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 		s.Infof("ignored client connection using protocol '%s', expected '%s'",
 			protocol, chshare.ProtocolVersion)
 	}
-	//proxy target was provided
+	//admin requests require the admin token (and are
+	//only served here without a separate admin listener)
+	if s.adminToken != "" && s.adminAddr == "" && strings.HasPrefix(r.URL.Path, "/admin/") {
+		s.handleAdmin(w, r)
+		return
+	}
+	//proxy target was provided (by route)
+	if proxy := s.proxyRoutes.match(r); proxy != nil {
+		proxy.ServeHTTP(w, r)
+		return
+	}
 	if s.reverseProxy != nil {
 		s.reverseProxy.ServeHTTP(w, r)
 		return
@@ -35,6 +69,11 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 	//no proxy defined, provide access to health/version checks
 	switch r.URL.String() {
 	case "/health":
+		if s.isDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Draining\n"))
+			return
+		}
 		w.Write([]byte("OK\n"))
 		return
 	case "/version":
@@ -50,25 +89,134 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 	id := atomic.AddInt32(&s.sessCount, 1)
 	clog := s.Fork("session#%d", id)
-	wsConn, err := upgrader.Upgrade(w, req, nil)
+	ip := s.remoteIP(req)
+	certUser, status := s.admit(clog, ip, req.TLS)
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	token := ""
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	//polling tunnels outlive the request opening them
+	if isPollTunnel(req) {
+		rwc, err := s.polls.open(w)
+		if err != nil {
+			s.release(ip)
+			clog.Debugf("Failed to open polling tunnel (%s)", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		conn := s.forwarded(req, withRemoteAddr(chshare.NewRWCConn(rwc), req))
+		go func() {
+			defer s.release(ip)
+			defer conn.Close()
+			s.handleTunnel(clog, id, conn, ip, certUser, token, req.Header.Get(chshare.FingerprintHeader))
+		}()
+		return
+	}
+	defer s.release(ip)
+	conn, err := s.upgrade(w, req)
 	if err != nil {
 		clog.Debugf("Failed to upgrade (%s)", err)
 		return
 	}
-	conn := chshare.NewWebSocketConn(wsConn)
+	defer conn.Close()
+	s.handleTunnel(clog, id, s.forwarded(req, conn), ip, certUser, token, req.Header.Get(chshare.FingerprintHeader))
+}
+
+// admit checks whether a client may connect from the IP, returning
+// the user of its verified client certificate (if any), or else the
+// HTTP status of its denial. Admitted clients are released (see
+// release) from the connection limits once they disconnect
+func (s *Server) admit(clog *chshare.Logger, ip string, state *tls.ConnectionState) (*chshare.User, int) {
+	if s.isDraining() {
+		clog.Debugf("Denied connection while draining")
+		return nil, http.StatusServiceUnavailable
+	}
+	if !s.ipFilter.allowed(ip) {
+		clog.Debugf("Denied connection from %s", ip)
+		return nil, http.StatusForbidden
+	}
+	if ok, country := s.geoIPFilter.allowed(ip); !ok {
+		clog.Infof("Denied connection from %s (country '%s')", ip, country)
+		return nil, http.StatusForbidden
+	}
+	//connected clients (including those yet to
+	//handshake) are counted against --max-clients
+	if n := atomic.AddInt64(&s.metrics.clients, 1); s.maxClients > 0 && n > int64(s.maxClients) {
+		atomic.AddInt64(&s.metrics.clients, -1)
+		atomic.AddInt64(&s.metrics.clientsRejected, 1)
+		clog.Infof("Denied connection from %s (too many clients)", ip)
+		return nil, http.StatusServiceUnavailable
+	}
+	if !s.ipConns.acquire(ip) {
+		atomic.AddInt64(&s.metrics.clients, -1)
+		clog.Infof("Denied connection from %s (too many connections)", ip)
+		return nil, http.StatusTooManyRequests
+	}
+	//verified client certificates replace ssh authentication
+	if state != nil && len(state.VerifiedChains) > 0 {
+		certUser, err := s.certUser(state.VerifiedChains[0][0])
+		s.metrics.authenticated(err == nil)
+		if err != nil {
+			clog.Infof("Denied: %s", err)
+			s.release(ip)
+			return nil, http.StatusForbidden
+		}
+		return certUser, 0
+	}
+	return nil, 0
+}
+
+// release releases an admitted client from the connection limits
+func (s *Server) release(ip string) {
+	atomic.AddInt64(&s.metrics.clients, -1)
+	s.ipConns.release(ip)
+}
+
+// handleTunnel runs the session of a tunnel's connection, authenticated
+// by the user's certificate, bearer token or else ssh password, and
+// presenting the host key of the client's pinned fingerprint (if any)
+func (s *Server) handleTunnel(clog *chshare.Logger, id int32, conn net.Conn, ip string, certUser *chshare.User, token, fingerprint string) {
 	// perform SSH handshake on net.Conn
 	clog.Debugf("Handshaking...")
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	sshConfig, hostKey := s.hostKeyConfig(fingerprint)
+	if certUser != nil {
+		clog.Debugf("Authenticated user '%s' via client certificate", certUser.Name)
+		c := *sshConfig
+		c.NoClientAuth = true
+		sshConfig = &c
+	} else if token != "" {
+		//bearer tokens are validated in place of the ssh password
+		c := *sshConfig
+		c.PasswordCallback = func(m ssh.ConnMetadata, _ []byte) (*ssh.Permissions, error) {
+			return s.authUser(m, []byte(token))
+		}
+		sshConfig = &c
+	}
+	//the connection may not support deadlines
+	timeout := time.AfterFunc(s.timeouts.handshake, func() {
+		clog.Debugf("Timed out handshaking")
+		conn.Close()
+	})
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
+	timeout.Stop()
 	if err != nil {
 		s.Debugf("Failed to handshake (%s)", err)
 		return
 	}
+	s.hostKeyUsed(hostKey)
+	if s.oldKey.config != nil {
+		clog.Infof("Verified against the %s host key", hostKey)
+	}
 	// pull the users from the session map
-	var user *chshare.User
-	if s.users.Len() > 0 {
-		sid := string(sshConn.SessionID())
-		user, _ = s.sessions.Get(sid)
-		s.sessions.Del(sid)
+	sid := string(sshConn.SessionID())
+	user, _ := s.sessions.Get(sid)
+	s.sessions.Del(sid)
+	if certUser != nil {
+		user = certUser
 	}
 	//verify configuration
 	clog.Debugf("Verifying configuration")
@@ -76,7 +224,8 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 	var r *ssh.Request
 	select {
 	case r = <-reqs:
-	case <-time.After(10 * time.Second):
+	case <-time.After(s.timeouts.config):
+		clog.Debugf("Timed out waiting for the config")
 		sshConn.Close()
 		return
 	}
@@ -93,6 +242,12 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		failed(s.Errorf("invalid config"))
 		return
 	}
+	//new sessions wait out maintenance, while current ones continue
+	if s.inMaintenance() {
+		clog.Debugf("Denied session during maintenance")
+		failed(s.Errorf(chshare.MaintenanceError))
+		return
+	}
 	//print if client and server  versions dont match
 	if c.Version != chshare.BuildVersion {
 		v := c.Version
@@ -102,66 +257,252 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		clog.Infof("Client version (%s) differs from server version (%s)",
 			v, chshare.BuildVersion)
 	}
-	//confirm reverse tunnels are allowed
+	//clients are identified by their user and ID
+	name := ""
+	if user != nil {
+		name = user.Name
+	}
+	key := reservationKey(name, c.ClientID)
+	//reverse remotes bind the ports reserved for the client
+	if s.reverseOk && s.reservations != nil {
+		if key != "" {
+			if err := s.reservePorts(clog, key, c.Remotes); err != nil {
+				failed(s.Errorf("%s", err))
+				return
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sess := &session{
+		id:       id,
+		user:     user,
+		sshConn:  sshConn,
+		start:    time.Now(),
+		remoteIP: ip,
+		key:      key,
+		remotes:  c.Remotes,
+		reverses: map[string]func(){},
+		streams:  map[string]int{},
+		ctx:      ctx,
+		activity: chshare.NewActivity(),
+		bytes:    chshare.NewByteCounter(&s.metrics.bytes),
+	}
+	//confirm the remotes are allowed
 	for _, r := range c.Remotes {
-		if r.Reverse && !s.reverseOk {
-			clog.Debugf("Denied reverse port forwarding request, please enable --reverse")
-			failed(s.Errorf("Reverse port forwaring not enabled on server"))
+		if err := s.checkRemote(clog, sess, r); err != nil {
+			failed(err)
 			return
 		}
 	}
-	//if user is provided, ensure they have
-	//access to the desired remotes
+	//users may only connect from the IP of their other sessions
 	if user != nil {
-		for _, r := range c.Remotes {
-			var addr string
-			if r.Reverse {
-				addr = "R:" + r.LocalHost + ":" + r.LocalPort
-			} else {
-				addr = r.RemoteHost + ":" + r.RemotePort
-			}
-			if !user.HasAccess(addr) {
-				failed(s.Errorf("access to '%s' denied", addr))
-				return
-			}
+		if bound := s.ipBindings.acquire(user.Name, sess.remoteIP); bound != "" {
+			clog.Infof("Denied user '%s' from %s (bound to %s)", user.Name, sess.remoteIP, bound)
+			failed(s.Errorf("user '%s' is bound to another address", user.Name))
+			return
+		}
+		defer s.ipBindings.release(user.Name)
+	}
+	if !s.active.add(sess) {
+		failed(s.Errorf("too many sessions for user '%s'", user.Name))
+		return
+	}
+	defer s.active.del(id)
+	sess.limiter = s.bandwidth.acquire(user)
+	defer s.bandwidth.release(user)
+	sess.socksServer = s.socksServer
+	if s.socksServer != nil && (user != nil || s.opa != nil || s.socksAuth) {
+		rules := &socksRules{Server: s, sess: sess, log: clog}
+		var creds socks5.CredentialStore
+		if s.socksAuth {
+			creds = rules
+		}
+		if sess.socksServer, err = s.newSocksServer(rules, creds); err != nil {
+			failed(s.Errorf("%s", err))
+			return
 		}
 	}
 	//set up reverse port forwarding
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	defer s.stopReverses(sess)
 	for i, r := range c.Remotes {
 		if r.Reverse {
-			proxy := chshare.NewTCPProxy(s.Logger, func() ssh.Conn { return sshConn }, i, r)
-			if err := proxy.Start(ctx); err != nil {
-				failed(s.Errorf("%s", err))
+			if err := s.startReverse(sess, i, r); err != nil {
+				failed(err)
 				return
 			}
 		}
 	}
 	//success!
 	r.Reply(true, nil)
+	if addrs := sess.reverseAddrs(); len(addrs) > 0 {
+		s.state.set(key, addrs)
+	}
+	defer func() {
+		//clients of a draining server are expected back
+		if !s.isDraining() && len(sess.reverseAddrs()) > 0 {
+			s.state.set(key, nil)
+		}
+	}()
+	//end the session when the user expires
+	if user != nil && !user.Expires.IsZero() {
+		expiry := time.AfterFunc(time.Until(user.Expires), func() {
+			clog.Infof("User '%s' has expired, closing session", user.Name)
+			sshConn.Close()
+		})
+		defer expiry.Stop()
+	}
+	//end the session when it has been idle for too long
+	idleTimeout := s.idleTimeout
+	if user != nil && user.IdleTimeout > 0 {
+		idleTimeout = user.IdleTimeout
+	}
+	if idleTimeout > 0 {
+		go s.watchIdle(ctx, clog, sess, idleTimeout)
+	}
+	//end the session when its access is outside of a time window
+	if user != nil && user.Windowed() {
+		go s.watchWindows(ctx, clog, sess)
+	}
 	//prepare connection logger
 	clog.Debugf("Open")
-	go s.handleSSHRequests(clog, reqs)
-	go s.handleSSHChannels(clog, chans)
+	s.hooks.send(sess.event("open"))
+	go s.handleSSHRequests(clog, sess, reqs)
+	go s.handleSSHChannels(clog, sess, chans)
 	sshConn.Wait()
 	clog.Debugf("Close")
+	s.hooks.send(sess.event("close"))
+}
+
+// watchWindows re-checks the session's access each minute,
+// closing it once a remote is no longer allowed
+func (s *Server) watchWindows(ctx context.Context, clog *chshare.Logger, sess *session) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, addr := range sess.accessAddrs() {
+			if rule := s.matchRule(sess.user, addr); rule == nil || rule.Deny {
+				s.audit.record(clog, sess, "window", addr, "acl", rule, false)
+				clog.Infof("Access to '%s' is outside of its time window, closing session", addr)
+				sess.sshConn.Close()
+				return
+			}
+		}
+	}
+}
+
+// watchIdle closes the session once no data has
+// passed through its tunnels for the timeout
+func (s *Server) watchIdle(ctx context.Context, clog *chshare.Logger, sess *session, timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		idle := sess.activity.Idle()
+		if idle >= timeout {
+			clog.Infof("Session has been idle for %s, closing session", idle.Round(time.Second))
+			sess.sshConn.Close()
+			return
+		}
+		t.Reset(timeout - idle)
+	}
+}
+
+// checkAccess checks the access of the session's
+// user to the address, auditing the decision
+func (s *Server) checkAccess(clog *chshare.Logger, sess *session, kind, addr string) bool {
+	rule := s.matchRule(sess.user, addr)
+	allowed := rule != nil && !rule.Deny
+	s.audit.record(clog, sess, kind, addr, "acl", rule, allowed)
+	return allowed
+}
+
+// CheckACL evaluates the access list of the named user for a
+// request of the address (prefixed with R: for reverse remotes, and
+// udp: for UDP, or a unix:<path> socket), returning the matching
+// rule, or nil when none match
+func (s *Server) CheckACL(name, addr string) (*chshare.ACLRule, error) {
+	hostPort := strings.TrimPrefix(strings.TrimPrefix(addr, "R:"), "udp:")
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return nil, fmt.Errorf("Invalid address '%s': %s", addr, err)
+	}
+	user, ok := s.users.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown user '%s'", name)
+	}
+	user, err := user.Expand()
+	if err != nil {
+		return nil, err
+	}
+	return s.matchRule(user, addr), nil
 }
 
-func (s *Server) handleSSHRequests(clientLog *chshare.Logger, reqs <-chan *ssh.Request) {
+// matchRule returns the user's first rule matching
+// the address, resolving hostnames when enabled
+func (s *Server) matchRule(user *chshare.User, addr string) *chshare.ACLRule {
+	if s.aclResolve {
+		return user.MatchRuleResolved(addr, lookupIP)
+	}
+	return user.MatchRule(addr)
+}
+
+func lookupIP(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// remoteIP is the IP address of the client,
+// as forwarded by any trusted proxy
+func (s *Server) remoteIP(req *http.Request) string {
+	if ip := s.trustProxies.clientIP(req); ip != nil {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (s *Server) handleSSHRequests(clientLog *chshare.Logger, sess *session, reqs <-chan *ssh.Request) {
 	for r := range reqs {
 		switch r.Type {
 		case "ping":
 			r.Reply(true, nil)
+		case "remote-add", "remote-del":
+			s.handleRemoteRequest(clientLog, sess, r)
 		default:
 			clientLog.Debugf("Unknown request: %s", r.Type)
 		}
 	}
 }
 
-func (s *Server) handleSSHChannels(clientLog *chshare.Logger, chans <-chan ssh.NewChannel) {
+func (s *Server) handleSSHChannels(clientLog *chshare.Logger, sess *session, chans <-chan ssh.NewChannel) {
 	for ch := range chans {
-		remote := string(ch.ExtraData())
+		if ch.ChannelType() == "tun" {
+			go s.handleTunChannel(clientLog, sess, ch)
+			continue
+		}
+		requested := string(ch.ExtraData())
+		remote := chshare.DNSStreamRemote(requested)
 		socks := remote == "socks"
 		//dont accept socks when --socks5 isn't enabled
 		if socks && s.socksServer == nil {
@@ -169,28 +510,72 @@ func (s *Server) handleSSHChannels(clientLog *chshare.Logger, chans <-chan ssh.N
 			ch.Reject(ssh.Prohibited, "SOCKS5 is not enabled on the server")
 			continue
 		}
+		addr, udp := chshare.UDPRemote(remote)
+		//streams are checked like remotes (see UserAddr)
+		checked := addr
+		if udp {
+			checked = "udp:" + addr
+		}
+		//as are the queries of dns remotes, by either protocol
+		if remote != requested {
+			checked = "udp:" + chshare.DNSResolver()
+		}
+		//dont connect to sockets outside of --socket-dir
+		if path, ok := chshare.UnixRemote(remote); ok && !s.socketAllowed(path) {
+			clientLog.Debugf("Denied stream to unix socket %s, please set --socket-dir", path)
+			ch.Reject(ssh.Prohibited, "Unix socket is not allowed")
+			continue
+		}
+		//streams may be opened to any address by a modified
+		//client, not only to those of its remotes
+		if !socks && sess.user != nil && !s.checkAccess(clientLog, sess, "stream", checked) {
+			clientLog.Debugf("Denied stream to '%s'", checked)
+			ch.Reject(ssh.Prohibited, "access to '"+checked+"' denied")
+			continue
+		}
+		if !socks && !s.policyAllows(clientLog, sess, "stream", checked) {
+			ch.Reject(ssh.Prohibited, "Denied by policy")
+			continue
+		}
+		//dont exceed the channel limits
+		if err := s.active.openChannel(sess); err != nil {
+			clientLog.Debugf("Denied stream: %s", err)
+			ch.Reject(ssh.ResourceShortage, "Too many open channels")
+			continue
+		}
 		//accept rest
 		stream, reqs, err := ch.Accept()
 		if err != nil {
 			clientLog.Debugf("Failed to accept stream: %s", err)
+			s.active.closeChannel(sess)
 			continue
 		}
 		go ssh.DiscardRequests(reqs)
+		sess.activity.Touch()
+		rwc := sess.bytes.Count(sess.activity.Track(chshare.LimitRate(stream, sess.limiter, s.maxBandwidth)))
 		//handle stream type
 		connID := s.connStats.New()
-		if socks {
-			go s.handleSocksStream(clientLog.Fork("socksconn#%d", connID), stream)
-		} else {
-			go chshare.HandleTCPStream(clientLog.Fork("conn#%d", connID), &s.connStats, stream, remote)
-		}
+		go func() {
+			defer s.active.closeChannel(sess)
+			if !socks {
+				defer sess.openStream(checked)()
+			}
+			if socks {
+				s.handleSocksStream(clientLog.Fork("socksconn#%d", connID), sess.socksServer, rwc)
+			} else if udp {
+				chshare.HandleUDPStream(clientLog.Fork("conn#%d", connID), &s.connStats, rwc, addr, s.udp)
+			} else {
+				chshare.HandleTCPStream(clientLog.Fork("conn#%d", connID), &s.connStats, rwc, remote)
+			}
+		}()
 	}
 }
 
-func (s *Server) handleSocksStream(l *chshare.Logger, src io.ReadWriteCloser) {
+func (s *Server) handleSocksStream(l *chshare.Logger, socksServer *chshare.SocksServer, src io.ReadWriteCloser) {
 	conn := chshare.NewRWCConn(src)
 	s.connStats.Open()
 	l.Debugf("%s Opening", s.connStats)
-	err := s.socksServer.ServeConn(conn)
+	err := socksServer.ServeConn(conn)
 	s.connStats.Close()
 	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
 		l.Debugf("%s: Closed (error: %s)", s.connStats, err)
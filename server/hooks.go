@@ -0,0 +1,93 @@
+package chserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// sessionEvent is POSTed to the hook URL when
+// a session opens ("open") or closes ("close")
+type sessionEvent struct {
+	Event     string    `json:"event"`
+	Username  string    `json:"username"`
+	SessionID int32     `json:"session_id"`
+	RemoteIP  string    `json:"remote_ip"`
+	Tunnels   []string  `json:"tunnels"`
+	Timestamp time.Time `json:"timestamp"`
+	//Duration is the session's length in seconds (close only)
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// hookSender delivers events in the background,
+// so that slow hooks don't hold up sessions
+type hookSender struct {
+	*chshare.Logger
+	url    string
+	client *http.Client
+	events chan *sessionEvent
+}
+
+func newHookSender(url string, logger *chshare.Logger) *hookSender {
+	h := &hookSender{
+		Logger: logger,
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan *sessionEvent, 1000),
+	}
+	go h.run()
+	return h
+}
+
+func (h *hookSender) send(e *sessionEvent) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.events <- e:
+	default:
+		h.Infof("Hook queue full, dropped %s event for session#%d", e.Event, e.SessionID)
+	}
+}
+
+func (h *hookSender) run() {
+	for e := range h.events {
+		b := &bytes.Buffer{}
+		enc := json.NewEncoder(b)
+		enc.SetEscapeHTML(false)
+		enc.Encode(e)
+		resp, err := h.client.Post(h.url, "application/json", b)
+		if err != nil {
+			h.Infof("Hook request failed: %s", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			h.Infof("Hook responded with status %d", resp.StatusCode)
+		}
+	}
+}
+
+// event describes the session for the hook
+func (sess *session) event(name string) *sessionEvent {
+	e := &sessionEvent{
+		Event:     name,
+		SessionID: sess.id,
+		RemoteIP:  sess.remoteIP,
+		Tunnels:   []string{},
+		Timestamp: time.Now().UTC(),
+	}
+	if sess.user != nil {
+		e.Username = sess.user.Name
+	}
+	for _, r := range sess.remoteList() {
+		e.Tunnels = append(e.Tunnels, r.String())
+	}
+	if name == "close" {
+		e.Duration = time.Since(sess.start).Seconds()
+	}
+	return e
+}
@@ -0,0 +1,51 @@
+package chserver
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// newSSHConfig returns the ssh config presenting the host key
+func (s *Server) newSSHConfig(key ssh.Signer, algos chshare.SSHAlgorithms) (*ssh.ServerConfig, error) {
+	c := &ssh.ServerConfig{
+		ServerVersion:    "SSH-" + chshare.ProtocolVersion + "-server",
+		PasswordCallback: s.authUser,
+	}
+	if err := algos.Apply(&c.Config); err != nil {
+		return nil, &ConfigError{Setting: "SSHAlgorithms", Err: err}
+	}
+	c.AddHostKey(key)
+	return c, nil
+}
+
+// hostKeyConfig returns the ssh config presenting the host key which
+// the client expects. While the host key is rotated (see --keyfile-old)
+// clients are presented the old key, unless the fingerprint they pin
+// (sent by clients with --fingerprint) matches the new key, so clients
+// pinning either key keep connecting while they're migrated. It also
+// returns the name of the key, old or new
+func (s *Server) hostKeyConfig(fingerprint string) (*ssh.ServerConfig, string) {
+	if s.oldKey.config == nil {
+		return s.sshConfig, "new"
+	}
+	//clients may pin several fingerprints, comma separated
+	for _, f := range strings.Split(fingerprint, ",") {
+		if f = strings.TrimSpace(f); f != "" && chshare.MatchFingerprint(s.hostKey, f) {
+			return s.sshConfig, "new"
+		}
+	}
+	return s.oldKey.config, "old"
+}
+
+// hostKeyUsed counts the sessions verified against the key
+func (s *Server) hostKeyUsed(name string) {
+	if name == "old" {
+		atomic.AddInt64(&s.metrics.hostKeyOld, 1)
+	} else {
+		atomic.AddInt64(&s.metrics.hostKeyNew, 1)
+	}
+}
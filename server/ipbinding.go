@@ -0,0 +1,69 @@
+package chserver
+
+import (
+	"sync"
+	"time"
+)
+
+// ipBindings binds each user to the source IP of their
+// sessions, until a grace period after their last session
+// ends, so their credentials can't be reused elsewhere
+type ipBindings struct {
+	sync.Mutex
+	grace time.Duration
+	inner map[string]*ipBinding
+}
+
+type ipBinding struct {
+	ip       string
+	sessions int
+	until    time.Time
+}
+
+// newIPBindings returns nil when the grace period is 0 (disabled)
+func newIPBindings(grace time.Duration) *ipBindings {
+	if grace <= 0 {
+		return nil
+	}
+	return &ipBindings{grace: grace, inner: map[string]*ipBinding{}}
+}
+
+// acquire returns the IP address which the user is bound to, when
+// it isn't ip, or else binds the user to ip, and must be followed
+// by release
+func (b *ipBindings) acquire(name, ip string) string {
+	if b == nil {
+		return ""
+	}
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	for n, e := range b.inner {
+		if e.sessions == 0 && now.After(e.until) {
+			delete(b.inner, n)
+		}
+	}
+	e, ok := b.inner[name]
+	if ok && e.ip != ip {
+		return e.ip
+	}
+	if !ok {
+		e = &ipBinding{ip: ip}
+		b.inner[name] = e
+	}
+	e.sessions++
+	return ""
+}
+
+func (b *ipBindings) release(name string) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if e, ok := b.inner[name]; ok {
+		if e.sessions--; e.sessions <= 0 {
+			e.until = time.Now().Add(b.grace)
+		}
+	}
+}
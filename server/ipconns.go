@@ -0,0 +1,45 @@
+package chserver
+
+import "sync"
+
+// ipConnLimiter limits the concurrent
+// connections from each source IP
+type ipConnLimiter struct {
+	mut   sync.Mutex
+	max   int
+	conns map[string]int
+}
+
+// newIPConnLimiter returns nil when max is 0 (unlimited)
+func newIPConnLimiter(max int) *ipConnLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &ipConnLimiter{max: max, conns: map[string]int{}}
+}
+
+// acquire reports whether another connection from the
+// IP is allowed, which must then be followed by release
+func (l *ipConnLimiter) acquire(ip string) bool {
+	if l == nil {
+		return true
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *ipConnLimiter) release(ip string) {
+	if l == nil {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
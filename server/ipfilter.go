@@ -0,0 +1,80 @@
+package chserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipFilter allows or denies client connections by their source IP
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPFilter parses the allow and deny lists of CIDRs (or single
+// IP addresses), returning nil when both lists are empty
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &ipFilter{}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address: %s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR: %s", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// allowed reports whether the IP matches no deny entry and,
+// when there is an allow list, matches an allow entry
+func (f *ipFilter) allowed(s string) bool {
+	if f == nil {
+		return true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
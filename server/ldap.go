@@ -0,0 +1,563 @@
+package chserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ldapConn is a minimal LDAPv3 client (RFC 4511),
+// supporting only StartTLS, simple binds and searches
+type ldapConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	id      int64
+	timeout time.Duration
+}
+
+const (
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchEntry       = 0x64
+	ldapSearchDone        = 0x65
+	ldapSearchReference   = 0x73
+	ldapExtendedRequest   = 0x77
+	ldapExtendedResponse  = 0x78
+	ldapResultSuccess     = 0
+	ldapResultInvalidCred = 49
+	ldapStartTLSOID       = "1.3.6.1.4.1.1466.20037"
+)
+
+// ldapError is a non-success LDAP result
+type ldapError struct {
+	Code    int64
+	Message string
+}
+
+func (e *ldapError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("LDAP result code %d", e.Code)
+	}
+	return fmt.Sprintf("LDAP result code %d: %s", e.Code, e.Message)
+}
+
+// ldapEntry is a search result
+type ldapEntry struct {
+	DN    string
+	Attrs map[string][]string //lowercased names
+}
+
+// dialLDAP connects to the directory, upgrading
+// ldap:// connections with StartTLS when enabled
+func dialLDAP(rawurl string, tlsConfig *tls.Config, startTLS bool, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid LDAP URL: %s", err)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", withDefaultPort(u.Host, "389"))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", withDefaultPort(u.Host, "636"), tlsConfig)
+	default:
+		return nil, fmt.Errorf("Invalid LDAP URL scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &ldapConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+	if startTLS && u.Scheme == "ldap" {
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		if err := l.startTLS(config); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %s", err)
+		}
+	}
+	return l, nil
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (l *ldapConn) send(op []byte) (int64, error) {
+	l.id++
+	msg := berTLV(0x30, berInt(0x02, l.id), op)
+	if l.timeout > 0 {
+		l.conn.SetDeadline(time.Now().Add(l.timeout))
+	}
+	_, err := l.conn.Write(msg)
+	return l.id, err
+}
+
+// receive reads the next operation for the given message
+func (l *ldapConn) receive(id int64) (byte, []byte, error) {
+	for {
+		tag, msg, err := berRead(l.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if tag != 0x30 {
+			return 0, nil, errors.New("Invalid LDAP message")
+		}
+		_, msgID, rest, err := berNext(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		opTag, op, _, err := berNext(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+		if berToInt(msgID) != id {
+			continue
+		}
+		return opTag, op, nil
+	}
+}
+
+// startTLS upgrades the connection to TLS (RFC 4511 4.14)
+func (l *ldapConn) startTLS(config *tls.Config) error {
+	id, err := l.send(berTLV(ldapExtendedRequest, berTLV(0x80, []byte(ldapStartTLSOID))))
+	if err != nil {
+		return err
+	}
+	tag, op, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if tag != ldapExtendedResponse {
+		return errors.New("Unexpected LDAP extended response")
+	}
+	if err := ldapResult(op); err != nil {
+		return err
+	}
+	conn := tls.Client(l.conn, config)
+	if l.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(l.timeout))
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	l.conn = conn
+	l.r = bufio.NewReader(conn)
+	return nil
+}
+
+func (l *ldapConn) bind(dn, pass string) error {
+	id, err := l.send(berTLV(ldapBindRequest,
+		berInt(0x02, 3),
+		berTLV(0x04, []byte(dn)),
+		berTLV(0x80, []byte(pass)),
+	))
+	if err != nil {
+		return err
+	}
+	tag, op, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if tag != ldapBindResponse {
+		return errors.New("Unexpected LDAP bind response")
+	}
+	return ldapResult(op)
+}
+
+func (l *ldapConn) search(base, filter string, attrs []string) ([]*ldapEntry, error) {
+	f, err := compileLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrList []byte
+	for _, a := range attrs {
+		attrList = append(attrList, berTLV(0x04, []byte(a))...)
+	}
+	id, err := l.send(berTLV(ldapSearchRequest,
+		berTLV(0x04, []byte(base)),
+		berInt(0x0a, 2), //whole subtree
+		berInt(0x0a, 0), //never deref aliases
+		berInt(0x02, 0),
+		berInt(0x02, int64(l.timeout/time.Second)),
+		berTLV(0x01, []byte{0}),
+		f,
+		berTLV(0x30, attrList),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ldapEntry
+	for {
+		tag, op, err := l.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case ldapSearchEntry:
+			e, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case ldapSearchReference:
+			//referrals are not followed
+		case ldapSearchDone:
+			return entries, ldapResult(op)
+		default:
+			return nil, errors.New("Unexpected LDAP search response")
+		}
+	}
+}
+
+func (l *ldapConn) close() error {
+	l.send(berTLV(ldapUnbindRequest))
+	return l.conn.Close()
+}
+
+func ldapResult(op []byte) error {
+	_, code, rest, err := berNext(op)
+	if err != nil {
+		return err
+	}
+	_, _, rest, err = berNext(rest) //matched dn
+	if err != nil {
+		return err
+	}
+	_, msg, _, err := berNext(rest)
+	if err != nil {
+		return err
+	}
+	if c := berToInt(code); c != ldapResultSuccess {
+		return &ldapError{Code: c, Message: string(msg)}
+	}
+	return nil
+}
+
+func parseLDAPEntry(op []byte) (*ldapEntry, error) {
+	_, dn, rest, err := berNext(op)
+	if err != nil {
+		return nil, err
+	}
+	e := &ldapEntry{DN: string(dn), Attrs: map[string][]string{}}
+	_, attrs, _, err := berNext(rest)
+	if err != nil {
+		return nil, err
+	}
+	for len(attrs) > 0 {
+		var attr []byte
+		if _, attr, attrs, err = berNext(attrs); err != nil {
+			return nil, err
+		}
+		_, name, vals, err := berNext(attr)
+		if err != nil {
+			return nil, err
+		}
+		_, vals, _, err = berNext(vals)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(string(name))
+		for len(vals) > 0 {
+			var v []byte
+			if _, v, vals, err = berNext(vals); err != nil {
+				return nil, err
+			}
+			e.Attrs[key] = append(e.Attrs[key], string(v))
+		}
+	}
+	return e, nil
+}
+
+// ldapEscapeFilter escapes a value for use within a search filter (RFC 4515)
+func ldapEscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileLDAPFilter converts a string search filter
+// (RFC 4515) into its BER encoding
+func compileLDAPFilter(filter string) ([]byte, error) {
+	b, rest, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("Invalid LDAP filter: %s", filter)
+	}
+	return b, nil
+}
+
+func parseLDAPFilter(f string) ([]byte, string, error) {
+	if len(f) < 3 || f[0] != '(' {
+		return nil, "", fmt.Errorf("Invalid LDAP filter: %s", f)
+	}
+	f = f[1:]
+	var b []byte
+	switch f[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if f[0] == '|' {
+			tag = 0xa1
+		}
+		f = f[1:]
+		var children []byte
+		for len(f) > 0 && f[0] == '(' {
+			c, rest, err := parseLDAPFilter(f)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, c...)
+			f = rest
+		}
+		b = berTLV(tag, children)
+	case '!':
+		c, rest, err := parseLDAPFilter(f[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		b = berTLV(0xa2, c)
+		f = rest
+	default:
+		i := strings.IndexByte(f, ')')
+		if i < 0 {
+			return nil, "", fmt.Errorf("Invalid LDAP filter: %s", f)
+		}
+		item, err := ldapFilterItem(f[:i])
+		if err != nil {
+			return nil, "", err
+		}
+		b = item
+		f = f[i:]
+	}
+	if f == "" || f[0] != ')' {
+		return nil, "", fmt.Errorf("Invalid LDAP filter: missing ')'")
+	}
+	return b, f[1:], nil
+}
+
+func ldapFilterItem(item string) ([]byte, error) {
+	i := strings.IndexByte(item, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("Invalid LDAP filter item: %s", item)
+	}
+	attr, raw := item[:i], item[i+1:]
+	var tag byte
+	switch attr[len(attr)-1] {
+	case '~':
+		tag = 0xa8
+	case '>':
+		tag = 0xa5
+	case '<':
+		tag = 0xa6
+	case ':':
+		return ldapExtensibleItem(attr[:len(attr)-1], raw)
+	}
+	if tag != 0 {
+		v, err := ldapUnescapeFilter(raw)
+		if err != nil {
+			return nil, err
+		}
+		return berTLV(tag, berTLV(0x04, []byte(attr[:len(attr)-1])), berTLV(0x04, v)), nil
+	}
+	if raw == "*" {
+		return berTLV(0x87, []byte(attr)), nil
+	}
+	if !strings.Contains(raw, "*") {
+		v, err := ldapUnescapeFilter(raw)
+		if err != nil {
+			return nil, err
+		}
+		return berTLV(0xa3, berTLV(0x04, []byte(attr)), berTLV(0x04, v)), nil
+	}
+	parts := strings.Split(raw, "*")
+	var subs []byte
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		v, err := ldapUnescapeFilter(p)
+		if err != nil {
+			return nil, err
+		}
+		tag := byte(0x81) //any
+		if i == 0 {
+			tag = 0x80 //initial
+		} else if i == len(parts)-1 {
+			tag = 0x82 //final
+		}
+		subs = append(subs, berTLV(tag, v)...)
+	}
+	return berTLV(0xa4, berTLV(0x04, []byte(attr)), berTLV(0x30, subs)), nil
+}
+
+// ldapExtensibleItem encodes attr[:dn][:rule]:=value
+func ldapExtensibleItem(attr, raw string) ([]byte, error) {
+	v, err := ldapUnescapeFilter(raw)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(attr, ":")
+	var rule []byte
+	dn := false
+	for _, p := range parts[1:] {
+		if strings.EqualFold(p, "dn") {
+			dn = true
+		} else if p != "" {
+			rule = berTLV(0x81, []byte(p))
+		}
+	}
+	b := rule
+	if parts[0] != "" {
+		b = append(b, berTLV(0x82, []byte(parts[0]))...)
+	}
+	b = append(b, berTLV(0x83, v)...)
+	if dn {
+		b = append(b, berTLV(0x84, []byte{0xff})...)
+	}
+	return berTLV(0xa9, b), nil
+}
+
+func ldapUnescapeFilter(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '(' || c == '*' {
+			return nil, fmt.Errorf("Invalid LDAP filter value: %s", s)
+		}
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+		if i+3 > len(s) {
+			return nil, fmt.Errorf("Invalid LDAP filter escape: %s", s)
+		}
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid LDAP filter escape: %s", s)
+		}
+		b = append(b, byte(n))
+		i += 2
+	}
+	return b, nil
+}
+
+// berTLV encodes a BER tag-length-value, with the given contents
+func berTLV(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := []byte{tag}
+	if n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var l []byte
+		for v := n; v > 0; v >>= 8 {
+			l = append([]byte{byte(v)}, l...)
+		}
+		b = append(b, 0x80|byte(len(l)))
+		b = append(b, l...)
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berInt(tag byte, v int64) []byte {
+	b := []byte{byte(v)}
+	for v > 0x7f || v < -0x80 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berToInt(b []byte) int64 {
+	var v int64
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		v = -1
+	}
+	for _, c := range b {
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+// berNext splits the first tag-length-value off b
+func berNext(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, l := b[0], int(b[1])
+	b = b[2:]
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 4 || len(b) < n {
+			return 0, nil, nil, errors.New("Invalid BER length")
+		}
+		l = 0
+		for _, c := range b[:n] {
+			l = l<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if l < 0 || len(b) < l {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, b[:l], b[l:], nil
+}
+
+// berRead reads a single tag-length-value from r
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	l := int(head[1])
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 4 {
+			return 0, nil, errors.New("Invalid BER length")
+		}
+		lb := make([]byte, n)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return 0, nil, err
+		}
+		l = 0
+		for _, c := range lb {
+			l = l<<8 | int(c)
+		}
+	}
+	if l < 0 || l > 16<<20 {
+		return 0, nil, errors.New("LDAP message too large")
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return head[0], b, nil
+}
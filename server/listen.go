@@ -0,0 +1,170 @@
+package chserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenAddr is an address on which the server listens:
+// <host>:<port>, using TLS when it is configured, or prefixed
+// with http:// (never TLS) or https:// (always TLS), or
+// unix:<path> for a unix socket (never TLS). Prefixed with
+// tcp:// or tls:// instead, tunnels are spoken directly over
+// the connection (or TLS), without HTTP, see handleRaw
+type listenAddr struct {
+	addr string
+	tls  bool
+	unix bool
+	raw  bool
+	//systemd is the socket passed by systemd, if any
+	systemd net.Listener
+}
+
+func (s *Server) parseListenAddr(a string) (*listenAddr, error) {
+	l := &listenAddr{addr: a, tls: s.httpServer.TLSConfig != nil}
+	switch {
+	case strings.HasPrefix(a, "unix:"):
+		l.addr, l.tls, l.unix = strings.TrimPrefix(a, "unix:"), false, true
+		if l.addr == "" {
+			return nil, fmt.Errorf("Invalid listen address '%s': missing socket path", a)
+		}
+		return l, nil
+	case strings.HasPrefix(a, "http://"):
+		l.addr, l.tls = strings.TrimPrefix(a, "http://"), false
+	case strings.HasPrefix(a, "https://"):
+		if s.httpServer.TLSConfig == nil {
+			return nil, fmt.Errorf("Listening on %s requires --tls-key and --tls-cert", a)
+		}
+		l.addr, l.tls = strings.TrimPrefix(a, "https://"), true
+	case strings.HasPrefix(a, "tcp://"):
+		l.addr, l.tls, l.raw = strings.TrimPrefix(a, "tcp://"), false, true
+	case strings.HasPrefix(a, "tls://"):
+		if s.httpServer.TLSConfig == nil {
+			return nil, fmt.Errorf("Listening on %s requires --tls-key and --tls-cert", a)
+		}
+		l.addr, l.tls, l.raw = strings.TrimPrefix(a, "tls://"), true, true
+	}
+	if _, _, err := net.SplitHostPort(l.addr); err != nil {
+		return nil, fmt.Errorf("Invalid listen address '%s': %s", a, err)
+	}
+	return l, nil
+}
+
+func (l *listenAddr) String() string {
+	s := "http://" + l.addr
+	if l.unix {
+		s = "unix:" + l.addr
+	} else if l.raw && l.tls {
+		s = "tls://" + l.addr
+	} else if l.raw {
+		s = "tcp://" + l.addr
+	} else if l.tls {
+		s = "https://" + l.addr
+	}
+	if l.systemd != nil {
+		s += " (systemd)"
+	}
+	return s
+}
+
+// listen opens the listeners of the addresses,
+// closing them all should any one fail
+func (s *Server) listen(addrs []*listenAddr) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, a := range addrs {
+		var l net.Listener
+		var err error
+		if a.systemd != nil {
+			l = a.systemd
+		} else if a.unix {
+			l, err = listenUnix(a.addr)
+		} else {
+			l, err = net.Listen("tcp", a.addr)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if s.proxyProto {
+			l = &proxyProtoListener{Listener: l, log: s.Logger}
+		}
+		if a.tls {
+			l = tls.NewListener(l, s.httpServer.TLSConfig)
+		}
+		if a.raw {
+			l = &rawListener{Listener: l, handle: s.handleRaw}
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on the socket at path, replacing
+// any socket left behind by a previous server
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("Socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// systemdAddrs are the sockets passed by systemd socket
+// activation (see sd_listen_fds), which use TLS when it is
+// configured, as other addresses do
+func (s *Server) systemdAddrs() ([]*listenAddr, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS: %s", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	//not passed on to any child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	var addrs []*listenAddr
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(3+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		//the first passed descriptor is always 3
+		f := os.NewFile(uintptr(3+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, a := range addrs {
+				a.systemd.Close()
+			}
+			return nil, fmt.Errorf("Invalid systemd socket '%s': %s", name, err)
+		}
+		a := &listenAddr{addr: l.Addr().String(), systemd: l}
+		if l.Addr().Network() == "unix" {
+			a.unix = true
+		} else {
+			a.tls = s.httpServer.TLSConfig != nil
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+// isUnixRequest reports whether the request
+// was accepted on a unix socket listener
+func isUnixRequest(req *http.Request) bool {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
@@ -0,0 +1,118 @@
+package chserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+const (
+	//lockouts double up to this duration
+	maxLockout = time.Hour
+	//failures are forgotten after this long without another
+	lockoutForget = 24 * time.Hour
+)
+
+// loginLimiter locks out usernames and IP addresses after repeated failed
+// logins, doubling the lockout each time it is triggered again
+type loginLimiter struct {
+	*chshare.Logger
+	limit   int
+	lockout time.Duration
+	mut     sync.Mutex
+	entries map[string]*loginFailures
+	pruned  time.Time
+	total   int64
+}
+
+type loginFailures struct {
+	failures int
+	lockouts uint
+	until    time.Time
+	last     time.Time
+}
+
+func newLoginLimiter(limit int, lockout time.Duration, logger *chshare.Logger) *loginLimiter {
+	if lockout <= 0 {
+		lockout = time.Minute
+	}
+	return &loginLimiter{
+		Logger:  logger,
+		limit:   limit,
+		lockout: lockout,
+		entries: map[string]*loginFailures{},
+	}
+}
+
+// locked returns how much longer any of the keys are locked out for
+func (l *loginLimiter) locked(keys ...string) time.Duration {
+	if l.limit <= 0 {
+		return 0
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		if e, ok := l.entries[k]; ok && e.until.After(now) {
+			if d := e.until.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// failed records a failed login for each of the keys
+func (l *loginLimiter) failed(keys ...string) {
+	if l.limit <= 0 {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	//occasionally drop forgotten entries
+	if now.Sub(l.pruned) > time.Minute {
+		for k, e := range l.entries {
+			if now.Sub(e.last) > lockoutForget {
+				delete(l.entries, k)
+			}
+		}
+		l.pruned = now
+	}
+	for _, k := range keys {
+		e, ok := l.entries[k]
+		if !ok || now.Sub(e.last) > lockoutForget {
+			e = &loginFailures{}
+			l.entries[k] = e
+		}
+		e.last = now
+		e.failures++
+		if e.failures < l.limit {
+			continue
+		}
+		d := l.lockout << e.lockouts
+		if d > maxLockout || d <= 0 {
+			d = maxLockout
+		} else {
+			e.lockouts++
+		}
+		e.until = now.Add(d)
+		e.failures = 0
+		l.total++
+		l.Infof("Locked out %s for %s after %d failed logins (%d lockouts in total)", k, d, l.limit, l.total)
+	}
+}
+
+// succeeded clears the failures of each of the keys
+func (l *loginLimiter) succeeded(keys ...string) {
+	if l.limit <= 0 {
+		return
+	}
+	l.mut.Lock()
+	for _, k := range keys {
+		delete(l.entries, k)
+	}
+	l.mut.Unlock()
+}
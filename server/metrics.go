@@ -0,0 +1,143 @@
+package chserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// metrics are counted by the server
+// and served in the Prometheus format
+type metrics struct {
+	//bytes are read from and written to the clients' streams
+	bytes         chshare.ByteCounter
+	authSuccesses int64
+	authFailures  int64
+	reversePorts  int64
+	authURL       *histogram
+	//clients are connected (or handshaking), or were
+	//rejected for exceeding the --max-clients
+	clients         int64
+	clientsRejected int64
+	//sessions by the host key presented, see hostKeyConfig
+	hostKeyOld int64
+	hostKeyNew int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		authURL: newHistogram(.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10),
+	}
+}
+
+func (m *metrics) authenticated(ok bool) {
+	if ok {
+		atomic.AddInt64(&m.authSuccesses, 1)
+	} else {
+		atomic.AddInt64(&m.authFailures, 1)
+	}
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	mut     sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	v := d.Seconds()
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.buckets[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(b *bytes.Buffer, name string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	for i, bound := range h.bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, le, h.buckets[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(b, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(b, "%s_count %d\n", name, h.count)
+}
+
+func writeMetric(b *bytes.Buffer, name, kind, help string, values ...interface{}) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	//values are pairs of labels (or "") and values
+	for i := 0; i+1 < len(values); i += 2 {
+		fmt.Fprintf(b, "%s%s %v\n", name, values[i], values[i+1])
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+	b := &bytes.Buffer{}
+	writeMetric(b, "chisel_sessions", "gauge", "Connected clients.",
+		"", s.active.len())
+	writeMetric(b, "chisel_clients", "gauge", "Connected clients, including those yet to handshake.",
+		"", atomic.LoadInt64(&m.clients))
+	writeMetric(b, "chisel_clients_rejected_total", "counter", "Clients rejected for exceeding the client limit.",
+		"", atomic.LoadInt64(&m.clientsRejected))
+	writeMetric(b, "chisel_streams", "gauge", "Open streams (forward, reverse and SOCKS connections).",
+		"", s.connStats.Active())
+	writeMetric(b, "chisel_streams_total", "counter", "Streams opened.",
+		"", s.connStats.Total())
+	writeMetric(b, "chisel_bytes_total", "counter", "Bytes received from (in) and sent to (out) clients through streams.",
+		`{direction="in"}`, m.bytes.BytesRead(), `{direction="out"}`, m.bytes.BytesWritten())
+	writeMetric(b, "chisel_auth_total", "counter", "Client authentications.",
+		`{result="success"}`, atomic.LoadInt64(&m.authSuccesses), `{result="failure"}`, atomic.LoadInt64(&m.authFailures))
+	writeMetric(b, "chisel_host_key_sessions_total", "counter", "Sessions by the host key presented to the client (old while it's rotated).",
+		`{key="new"}`, atomic.LoadInt64(&m.hostKeyNew), `{key="old"}`, atomic.LoadInt64(&m.hostKeyOld))
+	writeMetric(b, "chisel_reverse_ports", "gauge", "Ports bound by reverse remotes.",
+		"", atomic.LoadInt64(&m.reversePorts))
+	if s.authURL != nil {
+		const name = "chisel_authurl_request_duration_seconds"
+		writeMetric(b, name, "histogram", "Latency of auth URL requests.")
+		m.authURL.write(b, name)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+// serveMetrics serves /metrics on its own listener
+func (s *Server) serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen for metrics: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.Infof("Serving metrics on http://%s/metrics", l.Addr())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			s.Infof("Metrics server failed: %s", err)
+		}
+	}()
+	return nil
+}
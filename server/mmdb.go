@@ -0,0 +1,302 @@
+package chserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdb is a minimal reader of MaxMind DB files, such as the
+// GeoLite2/GeoIP2 country databases, see
+// https://maxmind.github.io/MaxMind-DB/
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	//ipv4Start is the node of ::0.0.0.0/96 in IPv6 databases
+	ipv4Start uint
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDBInvalid = errors.New("Invalid MaxMind DB")
+
+func openMMDB(path string) (*mmdb, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMMDB(b)
+}
+
+func parseMMDB(b []byte) (*mmdb, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errMMDBInvalid
+	}
+	meta := &mmdbDecoder{data: b[i+len(mmdbMetadataMarker):]}
+	v, _, err := meta.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBInvalid
+	}
+	db := &mmdb{
+		nodeCount:  mmdbUint(m["node_count"]),
+		recordSize: mmdbUint(m["record_size"]),
+		ipVersion:  mmdbUint(m["ip_version"]),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("Unsupported MaxMind DB record size: %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	//the tree is followed by 16 zero bytes
+	if treeSize+16 > uint(i) {
+		return nil, errMMDBInvalid
+	}
+	db.tree = b[:treeSize]
+	db.data = b[treeSize+16 : i]
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func mmdbUint(v interface{}) uint {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n)
+	}
+	return 0
+}
+
+// record returns the left (0) or right (1) record of the node
+func (db *mmdb) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+}
+
+// lookup returns the data of the network containing
+// the IP address, or nil when there is none
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errMMDBInvalid
+	}
+	d := &mmdbDecoder{data: db.data}
+	v, _, err := d.decode(node - db.nodeCount - 16)
+	return v, err
+}
+
+// country returns the ISO code of the country of the IP address
+func (db *mmdb) country(ip net.IP) (string, error) {
+	v, err := db.lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	m, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		c, _ := m[key].(map[string]interface{})
+		if code, ok := c["iso_code"].(string); ok {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// mmdbDecoder decodes the values of the data section
+type mmdbDecoder struct {
+	data []byte
+}
+
+const (
+	mmdbPointer = 1 + iota
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decode returns the value at the offset, and the offset after it
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d *mmdbDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.data)) || offset+n < offset {
+		return nil, errMMDBInvalid
+	}
+	return d.data[offset : offset+n], nil
+}
+
+func (d *mmdbDecoder) decodeDepth(offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, errMMDBInvalid
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	kind := uint(b[0] >> 5)
+	size := uint(b[0] & 0x1f)
+	if kind == 0 {
+		ext, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		kind = 7 + uint(ext[0])
+	}
+	if kind == mmdbPointer {
+		n := size>>3 + 1
+		p, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr uint
+		switch n {
+		case 1:
+			ptr = (size&7)<<8 | uint(p[0])
+		case 2:
+			ptr = ((size&7)<<16 | uint(p[0])<<8 | uint(p[1])) + 2048
+		case 3:
+			ptr = ((size&7)<<24 | uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])) + 526336
+		case 4:
+			ptr = uint(binary.BigEndian.Uint32(p))
+		}
+		v, _, err := d.decodeDepth(ptr, depth+1)
+		return v, offset + n, err
+	}
+	if size >= 29 {
+		n := size - 28
+		s, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(s[0])
+		case 2:
+			size = 285 + (uint(s[0])<<8 | uint(s[1]))
+		case 3:
+			size = 65821 + (uint(s[0])<<16 | uint(s[1])<<8 | uint(s[2]))
+		}
+	}
+	switch kind {
+	case mmdbMap:
+		m := map[string]interface{}{}
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBInvalid
+			}
+			v, next, err := d.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+	v, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(v), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return v, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBInvalid
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(v)), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, errMMDBInvalid
+		}
+		var n uint64
+		for _, c := range v {
+			n = n<<8 | uint64(c)
+		}
+		if kind == mmdbInt32 {
+			return int64(int32(n)), offset, nil
+		}
+		return n, offset, nil
+	}
+	return nil, 0, fmt.Errorf("Unsupported MaxMind DB data type: %d", kind)
+}
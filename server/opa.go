@@ -0,0 +1,104 @@
+package chserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// opaInput describes a tunnel or stream which is about to be
+// opened, and is the input of the policy decision. Type is
+// "remote" (a tunnel requested as the session starts), "stream"
+// (a connection through a tunnel), "socks" (a SOCKS request)
+// or "tun" (a client's tun address, see tunServer).
+type opaInput struct {
+	Type        string    `json:"type"`
+	User        string    `json:"user"`
+	Groups      []string  `json:"groups"`
+	SourceIP    string    `json:"source_ip"`
+	Destination string    `json:"destination"`
+	SessionID   int32     `json:"session_id"`
+	Time        time.Time `json:"time"`
+}
+
+// opaClient queries an Open Policy Agent (https://www.openpolicyagent.org)
+// decision, using the data API (like http://localhost:8181/v1/data/chisel/allow)
+type opaClient struct {
+	url    string
+	client *http.Client
+}
+
+func newOPAClient(url string) *opaClient {
+	return &opaClient{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// allow returns the policy decision, which must be true or an
+// object with "allow": true (an undefined decision denies)
+func (o *opaClient) allow(input *opaInput) (bool, error) {
+	b, _ := json.Marshal(map[string]interface{}{"input": input})
+	resp, err := o.client.Post(o.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA responded with status %d", resp.StatusCode)
+	}
+	result := struct {
+		Result interface{} `json:"result"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false, fmt.Errorf("Invalid OPA response: %s", err)
+	}
+	switch r := result.Result.(type) {
+	case bool:
+		return r, nil
+	case map[string]interface{}:
+		allow, _ := r["allow"].(bool)
+		return allow, nil
+	}
+	return false, nil
+}
+
+// policyAllows consults the policy (if any) about opening a
+// tunnel or stream to the address, denying when it fails
+func (s *Server) policyAllows(clog *chshare.Logger, sess *session, kind, addr string) bool {
+	if s.opa == nil {
+		return true
+	}
+	input := &opaInput{
+		Type:        kind,
+		Groups:      []string{},
+		SourceIP:    sess.remoteIP,
+		Destination: addr,
+		SessionID:   sess.id,
+		Time:        time.Now(),
+	}
+	if sess.user != nil {
+		input.User = sess.user.Name
+		if sess.user.Groups != nil {
+			input.Groups = sess.user.Groups
+		}
+	}
+	allow, err := s.opa.allow(input)
+	if err != nil {
+		clog.Infof("Policy check failed: %s", err)
+	}
+	s.audit.record(clog, sess, kind, addr, "policy", nil, allow)
+	if err != nil {
+		return false
+	}
+	if !allow {
+		clog.Infof("Access to '%s' denied by policy", addr)
+	}
+	return allow
+}
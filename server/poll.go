@@ -0,0 +1,160 @@
+package chserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	chshare "github.com/jpillora/chisel/share"
+)
+
+const (
+	// pollWait is how long a poll waits for data to send
+	pollWait = 25 * time.Second
+	// pollTimeout closes tunnels which haven't polled for this long
+	pollTimeout = time.Minute
+	// pollMaxBody is the most data sent in reply to one poll
+	pollMaxBody = 1 << 20
+)
+
+// pollTunnels carry tunnels over a series of plain HTTP requests,
+// for proxies which refuse websockets: each is opened by a request
+// (see the client's --transport) returning its ID, after which each
+// POST with the ID carries data from the client, and each GET waits
+// for data to the client, in order, until a DELETE closes it
+type pollTunnels struct {
+	mut   sync.Mutex
+	conns map[string]*pollConn
+}
+
+func newPollTunnels() *pollTunnels {
+	return &pollTunnels{conns: map[string]*pollConn{}}
+}
+
+// isPollTunnel reports whether the request opens or
+// continues a tunnel carried by polling requests
+func isPollTunnel(req *http.Request) bool {
+	return req.Header.Get(chshare.PollHeader) != "" && req.Header.Get(chshare.H2ProtocolHeader) != ""
+}
+
+// open replies with the ID of a new tunnel's connection
+func (p *pollTunnels) open(w http.ResponseWriter) (io.ReadWriteCloser, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	c := &pollConn{
+		id:     hex.EncodeToString(b),
+		out:    make(chan []byte, 64),
+		closed: make(chan struct{}),
+		remove: p.remove,
+	}
+	c.in, c.inW = io.Pipe()
+	c.expiry = time.AfterFunc(pollTimeout, func() { c.Close() })
+	p.mut.Lock()
+	p.conns[c.id] = c
+	p.mut.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(c.id))
+	return c, nil
+}
+
+func (p *pollTunnels) remove(id string) {
+	p.mut.Lock()
+	delete(p.conns, id)
+	p.mut.Unlock()
+}
+
+// serve handles the further requests of the tunnel with the ID
+func (p *pollTunnels) serve(w http.ResponseWriter, req *http.Request, id string) {
+	p.mut.Lock()
+	c, ok := p.conns[id]
+	p.mut.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	c.expiry.Stop()
+	defer c.expiry.Reset(pollTimeout)
+	w.Header().Set("Cache-Control", "no-store")
+	switch req.Method {
+	case http.MethodGet:
+		c.send(w, req)
+	case http.MethodPost:
+		if _, err := io.Copy(c.inW, req.Body); err != nil {
+			w.WriteHeader(http.StatusGone)
+		}
+	case http.MethodDelete:
+		c.Close()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// pollConn is the server's side of a polling tunnel
+type pollConn struct {
+	id     string
+	in     *io.PipeReader
+	inW    *io.PipeWriter
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+	expiry *time.Timer
+	remove func(string)
+}
+
+func (c *pollConn) Read(b []byte) (int, error) {
+	return c.in.Read(b)
+}
+
+func (c *pollConn) Write(b []byte) (int, error) {
+	select {
+	case c.out <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-c.closed:
+		return 0, errors.New("tunnel closed")
+	}
+}
+
+func (c *pollConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.inW.Close()
+		c.expiry.Stop()
+		c.remove(c.id)
+	})
+	return nil
+}
+
+// send replies to a poll with the pending data, waiting
+// for some to be written when there's none
+func (c *pollConn) send(w http.ResponseWriter, req *http.Request) {
+	var body []byte
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+	select {
+	case b := <-c.out:
+		body = b
+	case <-c.closed:
+		w.WriteHeader(http.StatusGone)
+		return
+	case <-timer.C:
+	case <-req.Context().Done():
+		return
+	}
+	//along with any more already written
+	for more := true; more && len(body) > 0 && len(body) < pollMaxBody; {
+		select {
+		case b := <-c.out:
+			body = append(body, b...)
+		default:
+			more = false
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
@@ -0,0 +1,63 @@
+package chserver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies whose X-Real-IP and
+// X-Forwarded-For headers give the IP address of the client,
+// along with any proxy in front of a unix socket
+type trustedProxies []*net.IPNet
+
+func (t trustedProxies) trusts(ip net.IP) bool {
+	return containsIP(t, ip)
+}
+
+// clientIP is the client IP address forwarded by a trusted proxy,
+// preferring X-Real-IP, then the last X-Forwarded-For entry
+// which isn't itself a trusted proxy, or nil when the request
+// doesn't come from a trusted proxy
+func (t trustedProxies) clientIP(req *http.Request) net.IP {
+	if !isUnixRequest(req) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !t.trusts(ip) {
+			return nil
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	//each proxy appends the address of its peer,
+	//so only the entries after the client are trusted
+	var ip net.IP
+	entries := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		if ip = net.ParseIP(strings.TrimSpace(entries[i])); ip == nil || !t.trusts(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedConn replaces the remote address of a connection
+// from a trusted proxy with the forwarded client address,
+// which the ssh handshake (lockouts, --authurl) then sees
+type forwardedConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *forwardedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// forwarded replaces the remote address of the request's
+// tunnel, when it comes from a trusted proxy
+func (s *Server) forwarded(req *http.Request, conn net.Conn) net.Conn {
+	if ip := s.trustProxies.clientIP(req); ip != nil {
+		return &forwardedConn{Conn: conn, addr: &net.TCPAddr{IP: ip}}
+	}
+	return conn
+}
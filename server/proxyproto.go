@@ -0,0 +1,157 @@
+package chserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	chshare "github.com/jpillora/chisel/share"
+)
+
+// proxyProtoTimeout limits the time taken
+// to send the PROXY protocol header
+const proxyProtoTimeout = 5 * time.Second
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener accepts connections which begin with a
+// PROXY protocol (v1 or v2) header, sent by a load balancer
+// such as HAProxy, replacing their remote address with that
+// of the client in the header
+type proxyProtoListener struct {
+	net.Listener
+	log *chshare.Logger
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c), log: l.log}, nil
+}
+
+// proxyProtoConn reads the header on its first use (in the
+// connection's own goroutine rather than in Accept)
+type proxyProtoConn struct {
+	net.Conn
+	r    *bufio.Reader
+	log  *chshare.Logger
+	once sync.Once
+	addr net.Addr
+	err  error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+		c.addr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.log.Debugf("Invalid PROXY header from %s: %s", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.init(); c.addr != nil {
+		return c.addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header, returning
+// the source address it gives, or nil for connections
+// from the load balancer itself (LOCAL or UNKNOWN)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+		return readProxyHeaderV2(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, errors.New("missing header")
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 reads the text header, like
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		//at most 107 bytes, by the specification
+		if len(line) >= 107 {
+			return nil, errors.New("header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed header '%s'", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed header '%s'", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads the binary header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	if h[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", h[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	//LOCAL command
+	if h[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch h[13] {
+	case 0x11: //TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short IPv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: //TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short IPv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	//other families are kept as the load balancer's address
+	return nil, nil
+}
@@ -0,0 +1,150 @@
+package chserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisConn is a minimal Redis client, speaking
+// just enough RESP for commands and subscriptions
+type redisConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// redisError is an error reply
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis: " + string(e)
+}
+
+// dialRedis connects to redis://[[user]:password@]host[:port][/db]
+// (or rediss:// for TLS), authenticating and selecting the database
+func dialRedis(rawurl string, timeout time.Duration) (*redisConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Redis URL: %s", err)
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	switch u.Scheme {
+	case "redis":
+		conn, err = dialer.Dial("tcp", withDefaultPort(u.Host, "6379"))
+	case "rediss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", withDefaultPort(u.Host, "6379"), &tls.Config{})
+	default:
+		return nil, fmt.Errorf("Invalid Redis URL scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+	if u.User != nil {
+		args := []string{"AUTH", u.User.Username()}
+		if pass, ok := u.User.Password(); ok {
+			if u.User.Username() == "" {
+				args = args[:1]
+			}
+			args = append(args, pass)
+		}
+		if _, err := c.do(args...); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := c.do("SELECT", db); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) send(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// read parses a reply into a string, int64, []interface{}, nil or error
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("Invalid Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = c.read(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				list[i] = err
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("Invalid Redis reply: %q", line)
+}
+
+func (c *redisConn) close() error {
+	return c.conn.Close()
+}
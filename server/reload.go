@@ -0,0 +1,71 @@
+package chserver
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Reload re-reads the auth file (or re-fetches the Vault secret)
+// and forgets any cached --authurl results, so that new logins use
+// the latest users
+func (s *Server) Reload() error {
+	if s.vault != nil {
+		if err := s.reloadVault(); err != nil {
+			return err
+		}
+	}
+	if err := s.users.Reload(); err != nil {
+		return err
+	}
+	if s.authURL != nil {
+		s.authURL.cache.clear()
+	}
+	s.Infof("Reloaded users")
+	return nil
+}
+
+// watchReload reloads on each SIGHUP, the only handler
+// of it, so that reloads don't race one another
+func (s *Server) watchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := s.Reload(); err != nil {
+			s.Infof("Failed to reload: %s", err)
+		}
+	}
+}
+
+// revokeSessions closes the sessions of users in the index
+// whose reloaded access lists no longer allow their remotes
+// (removed users are closed by the index's OnRevoke)
+func (s *Server) revokeSessions() {
+	s.active.Lock()
+	var sessions []*session
+	for _, sess := range s.active.inner {
+		if sess.user != nil {
+			sessions = append(sessions, sess)
+		}
+	}
+	s.active.Unlock()
+	for _, sess := range sessions {
+		current, ok := s.users.Get(sess.user.Name)
+		if !ok {
+			continue
+		}
+		user, err := current.Expand()
+		if err != nil {
+			s.Infof("session#%d: Failed to reload user '%s': %s", sess.id, sess.user.Name, err)
+			sess.sshConn.Close()
+			continue
+		}
+		for _, addr := range sess.accessAddrs() {
+			if rule := s.matchRule(user, addr); rule == nil || rule.Deny {
+				s.Infof("session#%d: Access to '%s' was revoked, closing session", sess.id, addr)
+				sess.sshConn.Close()
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package chserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// remoteList returns the session's current remotes
+func (sess *session) remoteList() []*chshare.Remote {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	return append([]*chshare.Remote(nil), sess.remotes...)
+}
+
+// openStream records the stream's address, until it's closed
+func (sess *session) openStream(addr string) func() {
+	sess.mut.Lock()
+	sess.streams[addr]++
+	sess.mut.Unlock()
+	return func() {
+		sess.mut.Lock()
+		if sess.streams[addr]--; sess.streams[addr] == 0 {
+			delete(sess.streams, addr)
+		}
+		sess.mut.Unlock()
+	}
+}
+
+// accessAddrs returns the addresses the session is accessing, those of
+// its remotes (except forward socks remotes, whose requests are checked
+// by socksServer) and of its open streams, all of which must stay allowed
+func (sess *session) accessAddrs() []string {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	var addrs []string
+	for _, r := range sess.remotes {
+		if !r.Socks || r.Reverse {
+			addrs = append(addrs, r.UserAddr())
+		}
+	}
+	for addr := range sess.streams {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// checkRemote checks whether the session may open the remote
+func (s *Server) checkRemote(clog *chshare.Logger, sess *session, r *chshare.Remote) error {
+	//forward dns remotes query the server's resolver
+	if r.DNS && !r.Reverse {
+		r.RemoteHost, r.RemotePort, _ = net.SplitHostPort(chshare.DNSResolver())
+	}
+	if r.Reverse && !s.reverseOk {
+		clog.Debugf("Denied reverse port forwarding request, please enable --reverse")
+		return s.Errorf("Reverse port forwaring not enabled on server")
+	}
+	//unix sockets are confined to the socket dir
+	if r.Reverse && r.LocalSocket != "" && !s.socketAllowed(r.LocalSocket) {
+		return s.Errorf("Unix socket %s is outside of the allowed directory", r.LocalSocket)
+	}
+	if !r.Reverse && r.RemoteSocket != "" && !s.socketAllowed(r.RemoteSocket) {
+		return s.Errorf("Unix socket %s is outside of the allowed directory", r.RemoteSocket)
+	}
+	if r.Reverse && r.LocalSocket == "" && !s.reversePorts.contains(r.LocalPort) {
+		return s.Errorf("Reverse port %s is outside of the allowed range %s", r.LocalPort, s.reversePorts)
+	}
+	//socks remotes are refused when connecting, rather
+	//than on each of their connections
+	if r.Socks && !r.Reverse && s.socksServer == nil {
+		clog.Debugf("Denied socks remote, please enable --socks5")
+		return s.Errorf("SOCKS5 is not enabled on the server")
+	}
+	//socks destinations are checked on each request
+	//(the listeners of reverse socks are checked below)
+	if r.Socks && !r.Reverse {
+		return nil
+	}
+	//if user is provided, ensure they have
+	//access to the desired remotes
+	addr := r.UserAddr()
+	if sess.user != nil && !s.checkAccess(clog, sess, "remote", addr) {
+		return s.Errorf("access to '%s' denied", addr)
+	}
+	//then consult the policy
+	if !s.policyAllows(clog, sess, "remote", addr) {
+		return s.Errorf("access to '%s' denied by policy", addr)
+	}
+	return nil
+}
+
+// startReverse listens on the port of the session's reverse remote
+// until it's stopped (see stopReverses) or the session ends
+func (s *Server) startReverse(sess *session, i int, r *chshare.Remote) error {
+	//ports are held by one server of a cluster at a time
+	//(while each server has its own sockets)
+	claimed := r.LocalSocket == ""
+	proto := "tcp"
+	if r.UDP {
+		proto = "udp"
+	}
+	if claimed {
+		if err := s.cluster.claim(proto, r.LocalHost, r.LocalPort); err != nil {
+			return s.Errorf("%s", err)
+		}
+	}
+	release := func() {
+		if claimed {
+			s.cluster.release(proto, r.LocalPort)
+		}
+	}
+	ctx, cancel := context.WithCancel(sess.ctx)
+	proxy := chshare.NewTCPProxy(s.Logger, func() ssh.Conn { return sess.sshConn }, i, r)
+	proxy.RateLimiters = []*chshare.RateLimiter{sess.limiter, s.maxBandwidth}
+	proxy.Activity = sess.activity
+	proxy.Stats = &s.connStats
+	proxy.Bytes = sess.bytes
+	proxy.UDP = s.udp
+	//ports held since a restart are handed back
+	addr := r.LocalAddr()
+	if !r.UDP && r.LocalSocket == "" {
+		proxy.Listener = s.state.take(sess.key, addr)
+	}
+	if err := proxy.Start(ctx); err != nil {
+		cancel()
+		release()
+		return s.Errorf("%s", err)
+	}
+	atomic.AddInt64(&s.metrics.reversePorts, 1)
+	sess.mut.Lock()
+	sess.reverses[reverseKey(r)] = func() {
+		cancel()
+		release()
+		atomic.AddInt64(&s.metrics.reversePorts, -1)
+	}
+	sess.mut.Unlock()
+	return nil
+}
+
+// reverseKey is the key of the reverse remote in the session's
+// reverses, its address, suffixed with /udp for udp remotes
+// (which may share the port of a tcp remote)
+func reverseKey(r *chshare.Remote) string {
+	if r.UDP {
+		return r.LocalAddr() + "/udp"
+	}
+	return r.LocalAddr()
+}
+
+// stopReverses stops the reverse remotes of the keys (see reverseKey), or all
+func (s *Server) stopReverses(sess *session, addrs ...string) {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	if len(addrs) == 0 {
+		for addr := range sess.reverses {
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, addr := range addrs {
+		if stop, ok := sess.reverses[addr]; ok {
+			stop()
+			delete(sess.reverses, addr)
+		}
+	}
+}
+
+// socketAllowed reports whether remotes may use the unix socket,
+// which must be within the socket dir
+func (s *Server) socketAllowed(path string) bool {
+	if s.socketDir == "" || !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(s.socketDir, filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// reverseAddrs returns the addresses of the session's reverse
+// (tcp, not socket) remotes, whose ports are held on restart
+func (sess *session) reverseAddrs() []string {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	var addrs []string
+	for _, r := range sess.remotes {
+		if r.Reverse && !r.UDP && r.LocalSocket == "" {
+			addrs = append(addrs, r.LocalHost+":"+r.LocalPort)
+		}
+	}
+	return addrs
+}
+
+// pushRemote asks the client of the session to open (or close) the
+// remote (which it may close by name), as if it was given to its
+// control API, returning the remote as labelled by the client. The
+// client then adds the remote to the session, see handleRemoteRequest.
+func (s *Server) pushRemote(sess *session, open bool, remote string) (string, error) {
+	name := "remote-close"
+	if open {
+		name = "remote-open"
+		if _, err := chshare.DecodeRemote(remote); err != nil {
+			return "", s.Errorf("Invalid remote '%s': %s", remote, err)
+		}
+	}
+	type reply struct {
+		ok      bool
+		payload []byte
+		err     error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		ok, payload, err := sess.sshConn.SendRequest(name, true, []byte(remote))
+		replies <- reply{ok, payload, err}
+	}()
+	var res reply
+	select {
+	case res = <-replies:
+	case <-time.After(s.timeouts.config):
+		return "", s.Errorf("The client didn't reply, it may not support opening remotes")
+	}
+	if res.err != nil {
+		return "", res.err
+	}
+	if !res.ok {
+		if len(res.payload) == 0 {
+			return "", s.Errorf("The client doesn't support opening remotes")
+		}
+		return "", errors.New(string(res.payload))
+	}
+	return string(res.payload), nil
+}
+
+// handleRemoteRequest adds (remote-add) or removes (remote-del) a
+// remote of the session, as requested by the client, replying with
+// the remote (whose port may differ, see reservePorts), or an error
+func (s *Server) handleRemoteRequest(clog *chshare.Logger, sess *session, req *ssh.Request) {
+	r := &chshare.Remote{}
+	err := json.Unmarshal(req.Payload, r)
+	if err == nil && req.Type == "remote-add" {
+		err = s.addRemote(clog, sess, r)
+	} else if err == nil {
+		err = s.removeRemote(clog, sess, r)
+	}
+	if err != nil {
+		clog.Debugf("Failed: %s", err)
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	b, _ := json.Marshal(r)
+	req.Reply(true, b)
+}
+
+func (s *Server) addRemote(clog *chshare.Logger, sess *session, r *chshare.Remote) error {
+	remotes := sess.remoteList()
+	for _, other := range remotes {
+		if other.String() == r.String() {
+			return s.Errorf("remote %s is already open", r)
+		}
+	}
+	//reverse remotes bind the ports reserved for the client
+	if r.Reverse && s.reverseOk && s.reservations != nil && sess.key != "" {
+		n := 0
+		for _, other := range remotes {
+			if other.Reverse {
+				n++
+			}
+		}
+		if err := s.reservePort(clog, sess.key, n, r); err != nil {
+			return s.Errorf("%s", err)
+		}
+	}
+	if err := s.checkRemote(clog, sess, r); err != nil {
+		return err
+	}
+	if r.Reverse {
+		if err := s.startReverse(sess, len(remotes), r); err != nil {
+			return err
+		}
+	}
+	sess.mut.Lock()
+	sess.remotes = append(sess.remotes, r)
+	sess.mut.Unlock()
+	if r.Reverse {
+		s.state.set(sess.key, sess.reverseAddrs())
+	}
+	clog.Infof("Added remote %s", r)
+	return nil
+}
+
+func (s *Server) removeRemote(clog *chshare.Logger, sess *session, r *chshare.Remote) error {
+	sess.mut.Lock()
+	found := false
+	for i, other := range sess.remotes {
+		if other.String() == r.String() {
+			sess.remotes = append(sess.remotes[:i:i], sess.remotes[i+1:]...)
+			found = true
+			break
+		}
+	}
+	sess.mut.Unlock()
+	if !found {
+		return s.Errorf("remote %s is not open", r)
+	}
+	if r.Reverse {
+		s.stopReverses(sess, reverseKey(r))
+		s.state.set(sess.key, sess.reverseAddrs())
+	}
+	clog.Infof("Removed remote %s", r)
+	return nil
+}
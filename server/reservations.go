@@ -0,0 +1,152 @@
+package chserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// reverseReservations assigns each client's reverse remotes a
+// stable port, which is stored in a file as a JSON object like
+// {"<user>/<client id>#0": 20001}, so that a reconnecting client
+// always binds the same port
+type reverseReservations struct {
+	mut   sync.Mutex
+	path  string
+	ports map[string]int
+}
+
+// newReverseReservations loads the reservations
+// file, returning nil when there is no file
+func newReverseReservations(path string) (*reverseReservations, error) {
+	if path == "" {
+		return nil, nil
+	}
+	r := &reverseReservations{path: path, ports: map[string]int{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read reverse reservations: %s", err)
+	}
+	if err := json.Unmarshal(b, &r.ports); err != nil {
+		return nil, fmt.Errorf("Invalid reverse reservations: %s", err)
+	}
+	return r, nil
+}
+
+// reservationKey identifies a client by its user and
+// client ID, returning "" for anonymous clients
+func reservationKey(user, clientID string) string {
+	switch {
+	case user != "" && clientID != "":
+		return user + "/" + clientID
+	case user != "":
+		return user
+	}
+	return clientID
+}
+
+// reserve returns the reserved port of the key, reserving a port
+// when there is none: the requested port, or a free port within
+// the range (when set, or else a random free port)
+func (r *reverseReservations) reserve(key, host, requested string, ports *reversePorts) (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if port, ok := r.ports[key]; ok {
+		return port, nil
+	}
+	taken := map[int]bool{}
+	for _, port := range r.ports {
+		taken[port] = true
+	}
+	port := 0
+	if p, err := strconv.Atoi(requested); err == nil && p > 0 && !taken[p] && ports.contains(requested) {
+		port = p
+	} else if ports != nil {
+		for p := ports.min; p <= ports.max && port == 0; p++ {
+			if !taken[p] && p > 0 && portFree(host, p) {
+				port = p
+			}
+		}
+		if port == 0 {
+			return 0, fmt.Errorf("No free reverse ports within %s", ports)
+		}
+	} else {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return 0, err
+		}
+		port = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+	}
+	r.ports[key] = port
+	if err := r.save(); err != nil {
+		delete(r.ports, key)
+		return 0, err
+	}
+	return port, nil
+}
+
+func portFree(host string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+func (r *reverseReservations) save() error {
+	b, err := json.MarshalIndent(r.ports, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("Failed to save reverse reservations: %s", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("Failed to save reverse reservations: %s", err)
+	}
+	return nil
+}
+
+// reservePorts replaces the ports of the reverse remotes
+// with those reserved for the client identified by key
+func (s *Server) reservePorts(clog *chshare.Logger, key string, remotes []*chshare.Remote) error {
+	n := 0
+	for _, r := range remotes {
+		if !r.Reverse {
+			continue
+		}
+		if err := s.reservePort(clog, key, n, r); err != nil {
+			return err
+		}
+		n++
+	}
+	return nil
+}
+
+// reservePort replaces the port of the client's nth reverse remote
+// (unix sockets have no port)
+func (s *Server) reservePort(clog *chshare.Logger, key string, n int, r *chshare.Remote) error {
+	if r.LocalSocket != "" {
+		return nil
+	}
+	port, err := s.reservations.reserve(key+"#"+strconv.Itoa(n), r.LocalHost, r.LocalPort, s.reversePorts)
+	if err != nil {
+		return err
+	}
+	if p := strconv.Itoa(port); p != r.LocalPort {
+		clog.Infof("Reverse remote %s is bound to its reserved port %s", r, p)
+		r.LocalPort = p
+	}
+	return nil
+}
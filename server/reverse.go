@@ -0,0 +1,43 @@
+package chserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// reversePorts is the range of ports to which
+// reverse remotes may bind on the server
+type reversePorts struct {
+	min, max int
+}
+
+// newReversePorts parses a range like 20000-25000 (or a
+// single port), returning nil when the range is empty
+func newReversePorts(s string) (*reversePorts, error) {
+	if s == "" {
+		return nil, nil
+	}
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || min < 0 || max > 65535 || min > max {
+		return nil, fmt.Errorf("Invalid reverse port range: %s", s)
+	}
+	return &reversePorts{min, max}, nil
+}
+
+func (p *reversePorts) contains(port string) bool {
+	if p == nil {
+		return true
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= p.min && n <= p.max
+}
+
+func (p *reversePorts) String() string {
+	return fmt.Sprintf("%d-%d", p.min, p.max)
+}
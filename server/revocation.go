@@ -0,0 +1,181 @@
+package chserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	chshare "github.com/jpillora/chisel/share"
+)
+
+// ocspCacheTime is how long OCSP responses without
+// a next update time are cached
+const ocspCacheTime = time.Hour
+
+// revocationChecker rejects verified client certificates which
+// are revoked by the CRL file (re-read whenever it changes) or,
+// when enabled, by the OCSP responder named in the certificate.
+// Failing to reach an OCSP responder is logged, but not fatal
+type revocationChecker struct {
+	*chshare.Logger
+	crlPath  string
+	ocsp     bool
+	client   *http.Client
+	mut      sync.Mutex
+	crl      *x509.RevocationList
+	crlMod   time.Time
+	statuses map[string]ocspStatus
+}
+
+type ocspStatus struct {
+	revoked bool
+	until   time.Time
+}
+
+func newRevocationChecker(c TLSConfig, logger *chshare.Logger) (*revocationChecker, error) {
+	if c.CRL == "" && !c.OCSP {
+		return nil, nil
+	}
+	r := &revocationChecker{
+		Logger:   logger,
+		crlPath:  c.CRL,
+		ocsp:     c.OCSP,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		statuses: map[string]ocspStatus{},
+	}
+	if r.crlPath != "" {
+		if _, err := r.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// loadCRL returns the CRL, reading it again when modified
+func (r *revocationChecker) loadCRL() (*x509.RevocationList, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	info, err := os.Stat(r.crlPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CRL: %s", err)
+	}
+	if r.crl != nil && info.ModTime().Equal(r.crlMod) {
+		return r.crl, nil
+	}
+	b, err := ioutil.ReadFile(r.crlPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CRL: %s", err)
+	}
+	//PEM or DER encoded
+	if block, _ := pem.Decode(b); block != nil && block.Type == "X509 CRL" {
+		b = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CRL: %s", err)
+	}
+	if r.crl != nil {
+		r.Infof("Reloaded CRL %s", r.crlPath)
+	}
+	r.crl, r.crlMod = crl, info.ModTime()
+	return crl, nil
+}
+
+// verify is the tls.Config VerifyPeerCertificate
+// callback, given the verified client chains
+func (r *revocationChecker) verify(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) < 2 {
+		return nil
+	}
+	cert, issuer := chains[0][0], chains[0][1]
+	if r.crlPath != "" {
+		crl, err := r.loadCRL()
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+			if err := crl.CheckSignatureFrom(issuer); err != nil {
+				return fmt.Errorf("Invalid CRL signature: %s", err)
+			}
+			for _, e := range crl.RevokedCertificateEntries {
+				if e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("Client certificate '%s' is revoked", cert.Subject.CommonName)
+				}
+			}
+		}
+	}
+	if r.ocsp && len(cert.OCSPServer) > 0 {
+		revoked, err := r.ocspRevoked(cert, issuer)
+		if err != nil {
+			r.Infof("OCSP check of client certificate '%s' failed: %s", cert.Subject.CommonName, err)
+		} else if revoked {
+			return fmt.Errorf("Client certificate '%s' is revoked", cert.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+func (r *revocationChecker) ocspRevoked(cert, issuer *x509.Certificate) (bool, error) {
+	issuerHash := sha1.Sum(issuer.RawSubjectPublicKeyInfo)
+	key := fmt.Sprintf("%x/%x", issuerHash, cert.SerialNumber)
+	r.mut.Lock()
+	status, ok := r.statuses[key]
+	r.mut.Unlock()
+	if ok && time.Now().Before(status.until) {
+		return status.revoked, nil
+	}
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Unexpected status %d", res.StatusCode)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, err
+	}
+	single, err := ocsp.ParseResponseForCert(b, cert, issuer)
+	if err != nil {
+		return false, fmt.Errorf("Invalid response: %s", err)
+	}
+	//a responder the issuer delegated to must be for OCSP signing
+	if d := single.Certificate; d != nil && !bytes.Equal(d.Raw, issuer.Raw) && !hasExtKeyUsage(d, x509.ExtKeyUsageOCSPSigning) {
+		return false, errors.New("Responder certificate is not for OCSP signing")
+	}
+	if single.Status == ocsp.Unknown {
+		return false, errors.New("Unknown certificate")
+	}
+	status = ocspStatus{revoked: single.Status == ocsp.Revoked, until: single.NextUpdate}
+	if status.until.IsZero() {
+		status.until = time.Now().Add(ocspCacheTime)
+	}
+	r.mut.Lock()
+	r.statuses[key] = status
+	r.mut.Unlock()
+	return status.revoked, nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package chserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyRoutes send normal HTTP requests to the backend of the
+// route with the longest matching path prefix, preferring
+// routes of the request's host, ahead of the --proxy server
+type proxyRoutes []*proxyRoute
+
+type proxyRoute struct {
+	host   string
+	prefix string
+	proxy  http.Handler
+}
+
+// newProxyRoutes parses routes like [<host>]<path-prefix>=<url>,
+// where the prefix is replaced by the path of the URL, if any
+func newProxyRoutes(specs []string) (proxyRoutes, error) {
+	var routes proxyRoutes
+	for _, spec := range specs {
+		pair := strings.SplitN(spec, "=", 2)
+		slash := strings.Index(pair[0], "/")
+		if len(pair) != 2 || slash < 0 {
+			return nil, fmt.Errorf("Invalid proxy route '%s' (expected [<host>]/<path>=<url>)", spec)
+		}
+		r := &proxyRoute{host: strings.ToLower(pair[0][:slash]), prefix: pair[0][slash:]}
+		u, err := url.Parse(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		proxy, err := newSingleHostProxy(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		if u.Path != "" {
+			p := strings.TrimSuffix(u.Path, "/")
+			director := proxy.Director
+			proxy.Director = func(req *http.Request) {
+				director(req)
+				rest := strings.TrimPrefix(req.URL.Path, r.prefix)
+				req.URL.Path = p + "/" + strings.TrimPrefix(rest, "/")
+				req.URL.RawPath = ""
+			}
+		}
+		r.proxy = proxy
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// match finds the proxy of the request's route, if any
+func (routes proxyRoutes) match(req *http.Request) http.Handler {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	var best *proxyRoute
+	for _, r := range routes {
+		if (r.host != "" && r.host != host) || !r.matchPath(req.URL.Path) {
+			continue
+		}
+		if best == nil || len(r.prefix) > len(best.prefix) ||
+			(len(r.prefix) == len(best.prefix) && best.host == "") {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.proxy
+}
+
+// matchPath matches the prefix on whole path segments
+func (r *proxyRoute) matchPath(path string) bool {
+	if !strings.HasPrefix(path, r.prefix) {
+		return false
+	}
+	return strings.HasSuffix(r.prefix, "/") || len(path) == len(r.prefix) || path[len(r.prefix)] == '/'
+}
@@ -1,14 +1,17 @@
 package chserver
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
-	"os"
-	"regexp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	socks5 "github.com/armon/go-socks5"
 	"github.com/gorilla/websocket"
@@ -20,27 +23,254 @@ import (
 
 // Config is the configuration for the chisel service
 type Config struct {
-	KeySeed  string
+	// KeySeed seeds the generation of the host key,
+	// which is otherwise random on each run
+	KeySeed string
+	// KeyAlgorithm is the algorithm of the generated
+	// host key: ecdsa (the default), ed25519 or rsa
+	KeyAlgorithm string
+	// OldKeyFile is the path of the previous host key, while
+	// the host key is rotated, see Server.hostKeyConfig
+	OldKeyFile string
+	// SSHAlgorithms restricts the ciphers, key exchanges
+	// and MACs negotiated by the ssh connections
+	SSHAlgorithms chshare.SSHAlgorithms
+	// KeyFile is the path of a PEM-encoded private key used
+	// as the host key, in place of one generated from KeySeed
+	KeyFile  string
 	AuthFile string
 	Auth     string
 	Proxy    string
 	Socks5   bool
 	Reverse  bool
+	// Socks5Auth requires the SOCKS5 clients of socks remotes to
+	// authenticate as users, whose access lists are also checked
+	Socks5Auth bool
+	// ReversePortRange (like 20000-25000) limits the
+	// ports to which reverse remotes may bind
+	ReversePortRange string
+	// ReverseReservations is the path of a file of the
+	// ports reserved for each client's reverse remotes
+	ReverseReservations string
+	// AuthFileKey (an age identity, or the path of an identity
+	// file) and AuthFilePassphrase decrypt an encrypted auth file
+	AuthFileKey        string
+	AuthFilePassphrase string
+	// Authenticator optionally replaces the built-in
+	// user index when validating client credentials,
+	// and can't be used with AuthURL, LDAP or SQL
+	Authenticator Authenticator
+	// JWTSecret and JWKSURL enable token authentication,
+	// see NewJWTAuthenticator
+	JWTSecret   string
+	JWKSURL     string
+	JWTIssuer   string
+	JWTAudience string
+	// OIDCIssuer enables token authentication using the JWKS
+	// and issuer found in the issuer's discovery document, and
+	// requires the JWTAudience (the client ID of chisel's clients)
+	OIDCIssuer string
+	TLS        TLSConfig
+	// LDAP delegates authentication to a
+	// directory, see NewLDAPAuthenticator
+	LDAP LDAPConfig
+	// SQL looks up users in a database, see NewSQLAuthenticator
+	SQL SQLConfig
+	// Redis loads users into the index, see RedisConfig
+	Redis RedisConfig
+	// ACLAudit logs each access decision, and ACLAuditFile
+	// appends them to a file as JSON lines, see aclEvent
+	ACLAudit     bool
+	ACLAuditFile string
+	// OPAURL is an Open Policy Agent decision consulted
+	// as each tunnel and stream is opened, see opaClient
+	OPAURL string
+	// HookURL receives a JSON event as each session opens and closes
+	HookURL string
+	// MaxSessions limits the concurrent sessions of users
+	// which don't have their own limit (0 is unlimited)
+	MaxSessions int
+	// MaxChannels limits the open channels of users which don't
+	// have their own limit, and MaxSessionChannels limits the open
+	// channels of each session (0 is unlimited)
+	MaxChannels        int
+	MaxSessionChannels int
+	// Bandwidth limits the bytes per second of the sessions of
+	// users which don't have their own limit (0 is unlimited)
+	Bandwidth int64
+	// IdleTimeout closes the sessions of users which don't have
+	// their own timeout, once no data has passed through their
+	// tunnels for this long (0 is never)
+	IdleTimeout time.Duration
+	// UpgradeTimeout limits the TLS handshake and the websocket upgrade
+	// (or request headers), HandshakeTimeout the ssh handshake, and
+	// ConfigTimeout the wait for the client's config (each is 10s when 0)
+	UpgradeTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	ConfigTimeout    time.Duration
+	// MaxBandwidth limits the bytes per second of all
+	// sessions of the server combined (0 is unlimited)
+	MaxBandwidth int64
+	// ACLResolve resolves the hostnames of remotes, and of hostname
+	// access list entries, so that they are also matched by their IP
+	// addresses, see chshare.ACLRule.MatchResolved
+	ACLResolve bool
+	// LoginLimit is the number of failed logins from an IP
+	// address, or for a username, after which they are locked out
+	// for LoginLockout (doubling with each lockout, 0 disables)
+	LoginLimit   int
+	LoginLockout time.Duration
+	// AllowCIDR and DenyCIDR restrict the source IP addresses
+	// of clients, checked before the websocket upgrade
+	AllowCIDR []string
+	DenyCIDR  []string
+	// TrustProxy are the CIDRs of reverse proxies
+	// whose forwarded client IPs are trusted
+	TrustProxy []string
+	// AllowCountries and DenyCountries restrict the countries
+	// (ISO codes) of clients, found in the GeoIPDB MaxMind DB
+	GeoIPDB        string
+	AllowCountries []string
+	DenyCountries  []string
+	// AdminToken enables the admin API (see handleAdmin) for
+	// requests with the bearer token, served on AdminAddr when
+	// set, and ReloadRevoke closes sessions whose remotes are
+	// no longer allowed after the users are reloaded
+	AdminToken   string
+	AdminAddr    string
+	ReloadRevoke bool
+	// SessionIPBinding binds each user to the source IP of their
+	// sessions until this long after their last session ends
+	SessionIPBinding time.Duration
+	// Listen are the addresses on which the server listens,
+	// in place of those given to Start, see listenAddr
+	Listen []string
+	// ProxyProtocol requires a PROXY protocol header
+	// on every connection, see proxyProtoListener
+	ProxyProtocol bool
+	// ProxyRoutes send requests to further backends, see proxyRoutes
+	ProxyRoutes []string
+	// VHosts are the behaviours of host names, see vhosts
+	VHosts []string
+	// WsPath is the only path on which clients
+	// may connect, when set
+	WsPath string
+	// DrainTimeout enables draining on SIGTERM, see Drain
+	DrainTimeout time.Duration
+	// MetricsAddr is the address on which
+	// Prometheus metrics are served at /metrics
+	MetricsAddr string
+	// MaxConnsPerIP limits the concurrent connections
+	// from each source IP address (0 is unlimited)
+	MaxConnsPerIP int
+	// MaxClients limits the connected clients of the
+	// server combined, denying any more (0 is unlimited)
+	MaxClients int
+	// Vault provides the key seed, TLS key pair and
+	// auth file contents, see VaultConfig
+	Vault VaultConfig
+	// Cluster shares reverse ports with other servers, see cluster
+	Cluster ClusterConfig
+	// StateFile stores the reverse ports of sessions, which are
+	// held for StateGrace after a restart, see sessionState
+	StateFile  string
+	StateGrace time.Duration
+	// AuthURL delegates authentication to an HTTP
+	// service, see NewAuthURLAuthenticator
+	AuthURL       string
+	AuthURLCaCert string
+	// AuthURLClientCert and AuthURLClientKey are PEM files used
+	// to authenticate this server to the AuthURL service
+	AuthURLClientCert string
+	AuthURLClientKey  string
+	// AuthURLCacheTTL and AuthURLFailedCacheTTL enable caching
+	// of successful and rejected AuthURL logins respectively
+	AuthURLCacheTTL       time.Duration
+	AuthURLFailedCacheTTL time.Duration
+	// AuthURLTimeout, AuthURLRetries and AuthURLBreaker
+	// (consecutive failures) protect logins from a slow
+	// or failing AuthURL service, see AuthURLConfig
+	AuthURLTimeout         time.Duration
+	AuthURLRetries         int
+	AuthURLBreaker         int
+	AuthURLBreakerCooldown time.Duration
+	// AuthURLHeaders are added to each AuthURL request and
+	// AuthURLSecret enables HMAC request signatures
+	AuthURLHeaders http.Header
+	AuthURLSecret  string
+	// UDP configures the flows of udp remotes
+	UDP chshare.UDPOptions
+	// SocketDir is the directory of the unix sockets which
+	// remotes may listen on (when reverse) or connect to,
+	// which they may not when unset, see socketAllowed
+	SocketDir string
+	// TUN is the address (like 10.8.0.1/24) of the TUN device
+	// routing the packets of clients' tun addresses, see tunServer
+	TUN string
 }
 
 // Server respresent a chisel service
 type Server struct {
 	*chshare.Logger
+	auth         Authenticator
 	connStats    chshare.ConnStats
 	fingerprint  string
 	httpServer   *chshare.HTTPServer
 	reverseProxy *httputil.ReverseProxy
 	sessCount    int32
 	sessions     *chshare.Users
-	socksServer  *socks5.Server
+	active       *sessionIndex
+	socksServer  *chshare.SocksServer
+	socksAuth    bool
 	sshConfig    *ssh.ServerConfig
+	hostKey      ssh.PublicKey
+	oldKey       struct {
+		config      *ssh.ServerConfig
+		fingerprint string
+	}
 	users        *chshare.UserIndex
 	reverseOk    bool
+	certMut      sync.RWMutex
+	cert         *tls.Certificate
+	sniCerts     []*tls.Certificate
+	vhosts       vhosts
+	proxyRoutes  proxyRoutes
+	limiter      *loginLimiter
+	hooks        *hookSender
+	ipFilter     *ipFilter
+	geoIPFilter  *geoIPFilter
+	bandwidth    *bandwidthIndex
+	maxBandwidth *chshare.RateLimiter
+	aclResolve   bool
+	idleTimeout  time.Duration
+	timeouts     struct{ upgrade, handshake, config time.Duration }
+	opa          *opaClient
+	audit        *aclAuditor
+	reversePorts *reversePorts
+	reservations *reverseReservations
+	ipConns      *ipConnLimiter
+	maxClients   int
+	authURL      *authURLAuthenticator
+	adminToken   string
+	adminAddr    string
+	ipBindings   *ipBindings
+	metrics      *metrics
+	metricsAddr  string
+	drainTimeout time.Duration
+	listenAddrs  []*listenAddr
+	proxyProto   bool
+	trustProxies trustedProxies
+	wsPath       string
+	acme         *acmeManager
+	polls        *pollTunnels
+	cluster      *cluster
+	state        *sessionState
+	draining     int32
+	maintenance  int32
+	udp          chshare.UDPOptions
+	socketDir    string
+	tun          *tunServer
+	vault        *vaultSecret
 }
 
 var upgrader = websocket.Upgrader{
@@ -51,77 +281,370 @@ var upgrader = websocket.Upgrader{
 
 // NewServer creates and returns a new chisel server
 func NewServer(config *Config) (*Server, error) {
+	//Vault's secrets replace those of the config
+	var secrets *vaultSecrets
+	if config.Vault.Path != "" {
+		var err error
+		if secrets, err = fetchVaultSecrets(config.Vault); err != nil {
+			return nil, err
+		}
+		if secrets.Key != "" {
+			config.KeySeed = secrets.Key
+		}
+		if secrets.TLSKey != "" && secrets.TLSCert != "" {
+			config.TLS.KeyPEM = []byte(secrets.TLSKey)
+			config.TLS.CertPEM = []byte(secrets.TLSCert)
+		}
+		//each would replace the users of the other
+		if len(secrets.AuthFile) > 0 && config.AuthFile != "" {
+			return nil, &ConfigError{Setting: "AuthFile", Err: errors.New("The users can't come from both an auth file and Vault")}
+		}
+	}
+	s, err := newServer(config, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connect(config, secrets); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CheckConfig checks the config, and the files it names (like the
+// auth file, keys and TLS certificates), without creating a server.
+// Unlike NewServer, it doesn't create the TUN device, contact Vault,
+// Redis, the cluster, a database or an OIDC issuer, or open the audit
+// and state files, so only the users of the auth file (and Auth) are
+// loaded for CheckACL.
+func CheckConfig(config *Config) (*ConfigCheck, error) {
+	s, err := newServer(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigCheck{server: s}, nil
+}
+
+// ConfigCheck is a checked config (see CheckConfig)
+type ConfigCheck struct {
+	server *Server
+}
+
+// CheckACL evaluates the access list of the named user for
+// an address (see Server.CheckACL)
+func (c *ConfigCheck) CheckACL(name, addr string) (*chshare.ACLRule, error) {
+	return c.server.CheckACL(name, addr)
+}
+
+// newServer builds the server from its config, secrets and local
+// files, leaving its devices and connections to connect
+func newServer(config *Config, secrets *vaultSecrets) (*Server, error) {
 	s := &Server{
 		httpServer: chshare.NewHTTPServer(),
 		Logger:     chshare.NewLogger("server"),
 		sessions:   chshare.NewUsers(),
+		active:     newSessionIndex(config.MaxSessions, config.MaxChannels, config.MaxSessionChannels),
+		bandwidth:  newBandwidthIndex(config.Bandwidth),
 		reverseOk:  config.Reverse,
+		aclResolve: config.ACLResolve,
+		polls:      newPollTunnels(),
+	}
+	s.idleTimeout = config.IdleTimeout
+	//half open connections are closed at each phase
+	s.timeouts.upgrade = config.UpgradeTimeout
+	s.timeouts.handshake = config.HandshakeTimeout
+	s.timeouts.config = config.ConfigTimeout
+	for _, t := range []*time.Duration{&s.timeouts.upgrade, &s.timeouts.handshake, &s.timeouts.config} {
+		if *t <= 0 {
+			*t = 10 * time.Second
+		}
+	}
+	s.httpServer.ReadHeaderTimeout = s.timeouts.upgrade
+	//tunnels may also be carried by HTTP/2 streams,
+	//with TLS or, without, by prior knowledge (h2c)
+	s.httpServer.Protocols = &http.Protocols{}
+	s.httpServer.Protocols.SetHTTP1(true)
+	s.httpServer.Protocols.SetHTTP2(true)
+	s.httpServer.Protocols.SetUnencryptedHTTP2(true)
+	s.metrics = newMetrics()
+	s.metricsAddr = config.MetricsAddr
+	s.drainTimeout = config.DrainTimeout
+	if config.SocketDir != "" {
+		dir, err := filepath.Abs(config.SocketDir)
+		if err != nil {
+			return nil, &ConfigError{Setting: "SocketDir", Err: err}
+		}
+		s.socketDir = dir
+	}
+	s.udp = config.UDP
+	if err := s.udp.Validate(); err != nil {
+		return nil, &ConfigError{Setting: "UDP", Err: err}
+	}
+	if config.TUN != "" {
+		if _, _, err := net.ParseCIDR(config.TUN); err != nil {
+			return nil, &ConfigError{Setting: "TUN", Err: err}
+		}
+	}
+	s.proxyProto = config.ProxyProtocol
+	if s.wsPath = config.WsPath; s.wsPath != "" && !strings.HasPrefix(s.wsPath, "/") {
+		s.wsPath = "/" + s.wsPath
+	}
+	if config.MaxBandwidth > 0 {
+		s.maxBandwidth = chshare.NewRateLimiter(config.MaxBandwidth)
 	}
 	s.Info = true
 	s.users = chshare.NewUserIndex(s.Logger)
+	s.users.OnRevoke = func(name string) {
+		if n := s.active.closeUser(name); n > 0 {
+			s.Infof("Closed %d sessions of user '%s'", n, name)
+		}
+	}
+	if config.ReloadRevoke {
+		s.users.OnReload = s.revokeSessions
+	}
+	s.adminToken = config.AdminToken
+	s.adminAddr = config.AdminAddr
+	if s.adminAddr != "" && s.adminToken == "" {
+		return nil, errors.New("The admin API requires an admin token")
+	}
+	if config.AuthFileKey != "" || config.AuthFilePassphrase != "" {
+		if chshare.FIPS() {
+			return nil, &ConfigError{Setting: "AuthFileKey", Err: errors.New("age encryption is not allowed in FIPS mode")}
+		}
+		d, err := newAgeDecrypter(config.AuthFileKey, config.AuthFilePassphrase)
+		if err != nil {
+			return nil, err
+		}
+		s.users.Decrypter = d
+	}
+	ipFilter, err := newIPFilter(config.AllowCIDR, config.DenyCIDR)
+	if err != nil {
+		return nil, err
+	}
+	s.ipFilter = ipFilter
+	if s.trustProxies, err = parseCIDRs(config.TrustProxy); err != nil {
+		return nil, err
+	}
+	if s.geoIPFilter, err = newGeoIPFilter(config.GeoIPDB, config.AllowCountries, config.DenyCountries); err != nil {
+		return nil, err
+	}
+	if s.reversePorts, err = newReversePorts(config.ReversePortRange); err != nil {
+		return nil, err
+	}
+	if s.reservations, err = newReverseReservations(config.ReverseReservations); err != nil {
+		return nil, err
+	}
+	s.ipConns = newIPConnLimiter(config.MaxConnsPerIP)
+	s.maxClients = config.MaxClients
+	s.ipBindings = newIPBindings(config.SessionIPBinding)
+	s.limiter = newLoginLimiter(config.LoginLimit, config.LoginLockout, s.Logger)
+	if secrets != nil && len(secrets.AuthFile) > 0 {
+		if err := s.users.LoadUsersJSON(secrets.authFile()); err != nil {
+			return nil, err
+		}
+	}
 	if config.AuthFile != "" {
 		if err := s.users.LoadUsers(config.AuthFile); err != nil {
-			return nil, err
+			return nil, &ConfigError{Setting: "AuthFile", Err: err}
 		}
 	}
 	if config.Auth != "" {
-		u := &chshare.User{Addrs: []*regexp.Regexp{chshare.UserAllowAll}}
+		u := &chshare.User{Addrs: []*chshare.ACLRule{chshare.UserAllowAll}}
 		u.Name, u.Pass = chshare.ParseAuth(config.Auth)
 		if u.Name != "" {
 			s.users.AddUser(u)
 		}
 	}
-	//generate private key (optionally using seed)
-	key, _ := chshare.GenerateKey(config.KeySeed)
-	//convert into ssh.PrivateKey
-	private, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		log.Fatal("Failed to parse key")
+	if err := checkAuthBackends(config, secrets != nil && len(secrets.AuthFile) > 0); err != nil {
+		return nil, err
+	}
+	s.auth = config.Authenticator
+	if s.auth == nil && config.AuthURL != "" {
+		client, err := newAuthURLClient(config.AuthURLCaCert, config.AuthURLClientCert, config.AuthURLClientKey)
+		if err != nil {
+			return nil, err
+		}
+		s.auth = NewAuthURLAuthenticator(AuthURLConfig{
+			URL:              config.AuthURL,
+			Client:           client,
+			CacheTTL:         config.AuthURLCacheTTL,
+			FailedCacheTTL:   config.AuthURLFailedCacheTTL,
+			Timeout:          config.AuthURLTimeout,
+			Retries:          config.AuthURLRetries,
+			BreakerThreshold: config.AuthURLBreaker,
+			BreakerCooldown:  config.AuthURLBreakerCooldown,
+			Headers:          config.AuthURLHeaders,
+			Secret:           config.AuthURLSecret,
+			Logger:           s.Logger,
+		}, s.users)
+		s.authURL = s.auth.(*authURLAuthenticator)
+		s.authURL.latency = s.metrics.authURL
+	}
+	if s.auth == nil && config.LDAP.URL != "" {
+		auth, err := NewLDAPAuthenticator(config.LDAP, s.users)
+		if err != nil {
+			return nil, err
+		}
+		s.auth = auth
+	}
+	//or else the tokens the issuer signed for any
+	//of its applications would be accepted
+	if config.OIDCIssuer != "" && config.JWTAudience == "" {
+		return nil, &ConfigError{Setting: "JWTAudience", Err: errors.New("An audience (the client ID) is required with an OIDC issuer")}
+	}
+	//load the private key, or generate it (optionally using seed)
+	var private ssh.Signer
+	if config.KeyFile != "" {
+		if private, err = chshare.LoadKeyFile(config.KeyFile); err != nil {
+			return nil, &ConfigError{Setting: "KeyFile", Err: err}
+		}
+	} else {
+		key, err := chshare.GenerateKeyAlgo(config.KeyAlgorithm, config.KeySeed)
+		if err != nil {
+			return nil, &ConfigError{Setting: "KeySeed", Err: err}
+		}
+		//convert into ssh.PrivateKey
+		if private, err = chshare.ParseKey(key); err != nil {
+			return nil, &ConfigError{Setting: "KeySeed", Err: err}
+		}
 	}
 	//fingerprint this key
-	s.fingerprint = chshare.FingerprintKey(private.PublicKey())
+	s.fingerprint = chshare.FingerprintKey(private.PublicKey()) +
+		" (" + chshare.FingerprintKeySHA256(private.PublicKey()) + ")"
 	//create ssh config
-	s.sshConfig = &ssh.ServerConfig{
-		ServerVersion:    "SSH-" + chshare.ProtocolVersion + "-server",
-		PasswordCallback: s.authUser,
+	if s.sshConfig, err = s.newSSHConfig(private, config.SSHAlgorithms); err != nil {
+		return nil, err
 	}
-	s.sshConfig.AddHostKey(private)
-	//setup reverse proxy
-	if config.Proxy != "" {
-		u, err := url.Parse(config.Proxy)
+	s.hostKey = private.PublicKey()
+	if config.OldKeyFile != "" {
+		old, err := chshare.LoadKeyFile(config.OldKeyFile)
 		if err != nil {
+			return nil, &ConfigError{Setting: "OldKeyFile", Err: err}
+		}
+		if s.oldKey.config, err = s.newSSHConfig(old, config.SSHAlgorithms); err != nil {
 			return nil, err
 		}
-		if u.Host == "" {
-			return nil, s.Errorf("Missing protocol (%s)", u)
+		s.oldKey.fingerprint = chshare.FingerprintKey(old.PublicKey()) +
+			" (" + chshare.FingerprintKeySHA256(old.PublicKey()) + ")"
+	}
+	//setup tls
+	if config.TLS.Key != "" || config.TLS.Cert != "" || len(config.TLS.KeyPEM) > 0 || len(config.TLS.CertPEM) > 0 || len(config.TLS.Domains) > 0 {
+		if s.httpServer.TLSConfig, err = s.newTLSConfig(config.TLS); err != nil {
+			return nil, &ConfigError{Setting: "TLS", Err: err}
 		}
-		s.reverseProxy = httputil.NewSingleHostReverseProxy(u)
-		//always use proxy host
-		s.reverseProxy.Director = func(r *http.Request) {
-			r.URL.Scheme = u.Scheme
-			r.URL.Host = u.Host
-			r.Host = u.Host
+	}
+	//setup reverse proxy
+	if config.Proxy != "" {
+		if s.reverseProxy, err = newSingleHostProxy(config.Proxy); err != nil {
+			return nil, err
 		}
 	}
+	if s.proxyRoutes, err = newProxyRoutes(config.ProxyRoutes); err != nil {
+		return nil, err
+	}
+	if s.vhosts, err = newVHosts(config.VHosts); err != nil {
+		return nil, err
+	}
+	for _, a := range config.Listen {
+		addr, err := s.parseListenAddr(a)
+		if err != nil {
+			return nil, &ConfigError{Setting: "Listen", Err: err}
+		}
+		s.listenAddrs = append(s.listenAddrs, addr)
+	}
 	//setup socks server (not listening on any port!)
+	if config.Socks5Auth && !config.Socks5 {
+		return nil, &ConfigError{Setting: "Socks5Auth", Err: errors.New("requires Socks5")}
+	}
+	s.socksAuth = config.Socks5Auth
 	if config.Socks5 {
-		socksConfig := &socks5.Config{}
-		if s.Debug {
-			socksConfig.Logger = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
-		} else {
-			socksConfig.Logger = log.New(ioutil.Discard, "", 0)
-		}
-		s.socksServer, err = socks5.New(socksConfig)
+		s.socksServer, err = s.newSocksServer(socks5.PermitAll(), nil)
 		if err != nil {
 			return nil, err
 		}
 		s.Infof("SOCKS5 server enabled")
 	}
+	return s, nil
+}
+
+// connect creates the server's TUN device, connects to its
+// Redis, cluster, database and OIDC issuer, opens its audit
+// and state files, and starts watching for reloads
+func (s *Server) connect(config *Config, secrets *vaultSecrets) error {
+	tun, err := newTunServer(s.Logger, config.TUN)
+	if err != nil {
+		return &ConfigError{Setting: "TUN", Err: err}
+	}
+	s.tun = tun
+	if s.cluster, err = newCluster(config.Cluster, s.Logger); err != nil {
+		return err
+	}
+	if s.state, err = newSessionState(config.StateFile, config.StateGrace, s.Logger); err != nil {
+		return err
+	}
+	if s.audit, err = newACLAuditor(config.ACLAudit, config.ACLAuditFile); err != nil {
+		return err
+	}
+	if config.OPAURL != "" {
+		s.opa = newOPAClient(config.OPAURL)
+	}
+	if config.HookURL != "" {
+		s.hooks = newHookSender(config.HookURL, s.Logger)
+	}
+	if config.Redis.URL != "" {
+		if _, err := newRedisUsers(config.Redis, s.users, s.Logger); err != nil {
+			return err
+		}
+	}
+	if s.auth == nil && config.SQL.DSN != "" {
+		if config.SQL.Logger == nil {
+			config.SQL.Logger = s.Logger
+		}
+		auth, err := NewSQLAuthenticator(config.SQL)
+		if err != nil {
+			return err
+		}
+		s.auth = auth
+	}
+	if s.auth == nil {
+		//users loaded from a file (or Vault) may all be removed by
+		//a reload, after which none (rather than all) are allowed
+		s.auth = &userIndexAuthenticator{
+			users:    s.users,
+			required: config.AuthFile != "" || config.Redis.URL != "" || secrets != nil && len(secrets.AuthFile) > 0,
+		}
+	}
+	if config.OIDCIssuer != "" {
+		p, err := chshare.DiscoverOIDC(config.OIDCIssuer)
+		if err != nil {
+			return err
+		}
+		if config.JWKSURL == "" {
+			config.JWKSURL = p.JWKSURI
+		}
+		config.JWTIssuer = p.Issuer
+	}
+	if config.JWTSecret != "" || config.JWKSURL != "" {
+		s.auth = NewJWTAuthenticator(&chshare.JWTVerifier{
+			Secret:   []byte(config.JWTSecret),
+			JWKSURL:  config.JWKSURL,
+			Issuer:   config.JWTIssuer,
+			Audience: config.JWTAudience,
+		}, s.users, s.auth)
+		s.Infof("Token authentication enabled")
+	}
+	if secrets != nil {
+		s.Infof("Loaded secrets from Vault")
+		s.vault = &vaultSecret{VaultConfig: config.Vault, key: secrets.Key, users: config.AuthFile == ""}
+	}
+	go s.watchReload()
 	//print when reverse tunnelling is enabled
 	if config.Reverse {
 		s.Infof("Reverse tunnelling enabled")
+		if s.reversePorts != nil {
+			s.Infof("Reverse ports limited to %s", s.reversePorts)
+		}
 	}
-	return s, nil
+	return nil
 }
 
 // Run is responsible for starting the chisel service
@@ -136,18 +659,62 @@ func (s *Server) Run(host, port string) error {
 // Start is responsible for kicking off the http server
 func (s *Server) Start(host, port string) error {
 	s.Infof("Fingerprint %s", s.fingerprint)
-	if s.users.Len() > 0 {
+	if s.oldKey.config != nil {
+		s.Infof("Rotating from the old fingerprint %s", s.oldKey.fingerprint)
+	}
+	if a, ok := s.auth.(*userIndexAuthenticator); !ok || a.required || s.users.Len() > 0 {
 		s.Infof("User authenication enabled")
 	}
 	if s.reverseProxy != nil {
 		s.Infof("Reverse proxy enabled")
 	}
-	s.Infof("Listening on %s:%s...", host, port)
+	addrs, err := s.systemdAddrs()
+	if err != nil {
+		return err
+	}
+	addrs = append(addrs, s.listenAddrs...)
+	if len(addrs) == 0 {
+		addr, err := s.parseListenAddr(host + ":" + port)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+	//http-01 challenges are answered on port 80
+	for _, a := range addrs {
+		if _, p, _ := net.SplitHostPort(a.addr); s.acme != nil && !a.tls && !a.unix && !a.raw && p == "80" {
+			s.acme.http01 = true
+		}
+	}
+	if s.adminAddr != "" {
+		if err := s.serveAdmin(s.adminAddr); err != nil {
+			return err
+		}
+	}
+	if s.metricsAddr != "" {
+		if err := s.serveMetrics(s.metricsAddr); err != nil {
+			return err
+		}
+	}
+	if s.drainTimeout > 0 {
+		go s.watchDrain(s.drainTimeout)
+	}
+	listeners, err := s.listen(addrs)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		s.Infof("Listening on %s...", a)
+	}
 	h := http.Handler(http.HandlerFunc(s.handleClientHandler))
 	if s.Debug {
 		h = requestlog.Wrap(h)
 	}
-	return s.httpServer.GoListenAndServe(host+":"+port, h)
+	s.httpServer.GoServe(h, listeners...)
+	if s.acme != nil {
+		go s.acme.run()
+	}
+	return nil
 }
 
 // Wait waits for the http server to close
@@ -162,19 +729,54 @@ func (s *Server) Close() error {
 
 // authUser is responsible for validating the ssh user / password combination
 func (s *Server) authUser(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-	// check if user authenication is enable and it not allow all
-	if s.users.Len() == 0 {
-		return nil, nil
-	}
-	// check the user exists and has matching password
 	n := c.User()
-	user, found := s.users.Get(n)
-	if !found || user.Pass != string(password) {
+	keys := []string{"user " + n}
+	if host, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil {
+		keys = append(keys, "address "+host)
+	}
+	if d := s.limiter.locked(keys...); d > 0 {
+		s.Debugf("Login denied for user: %s (locked out for %s)", n, d.Round(time.Second))
+		s.metrics.authenticated(false)
+		return nil, errors.New("Too many failed logins")
+	}
+	user, err := s.auth.Authenticate(n, string(password), c)
+	if err == nil && user != nil && user.Expired() {
+		err = errors.New("User has expired")
+	}
+	if err != nil {
 		s.Debugf("Login failed for user: %s", n)
-		return nil, errors.New("Invalid authentication for username: %s")
+		//outages of the authenticator's backend aren't counted
+		if errors.Is(err, ErrInvalidCredentials) {
+			s.limiter.failed(keys...)
+		}
+		s.metrics.authenticated(false)
+		return nil, err
+	}
+	s.limiter.succeeded(keys...)
+	s.metrics.authenticated(true)
+	//replace the variables in the user's access list
+	if user != nil {
+		if user, err = user.Expand(); err != nil {
+			s.Infof("Login denied for user: %s (%s)", n, err)
+			return nil, err
+		}
 	}
 	// insert the user session map
-	// @note: this should probably have a lock on it given the map isn't thread-safe??
-	s.sessions.Set(string(c.SessionID()), user)
+	if user != nil {
+		s.sessions.Set(string(c.SessionID()), user)
+	}
 	return nil, nil
 }
+
+// newAgeDecrypter creates a decrypter from an age
+// identity or identity file path and/or a passphrase
+func newAgeDecrypter(key, passphrase string) (*chshare.AgeDecrypter, error) {
+	if key != "" && !strings.HasPrefix(strings.ToUpper(key), "AGE-SECRET-KEY-") {
+		b, err := ioutil.ReadFile(key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read age identity file: %s", err)
+		}
+		key = string(b)
+	}
+	return chshare.NewAgeDecrypter(key, passphrase)
+}
@@ -0,0 +1,179 @@
+package chserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// session is a connected and authenticated client
+type session struct {
+	id       int32
+	user     *chshare.User
+	sshConn  ssh.Conn
+	start    time.Time
+	remoteIP string
+	//key identifies the client, see reservationKey
+	key string
+	//remotes may be added and removed during the session
+	//(see addRemote), guarded by mut, along with reverses
+	mut     sync.Mutex
+	remotes []*chshare.Remote
+	//reverses stop the reverse remotes, see reverseKey
+	reverses map[string]func()
+	//streams counts the open streams of each address
+	streams map[string]int
+	//ctx ends with the session
+	ctx context.Context
+	//limiter is shared by the sessions of the user
+	limiter *chshare.RateLimiter
+	//channels is the number of open channels,
+	//guarded by the sessionIndex
+	channels int
+	//socksServer checks the destinations of the
+	//user's socks requests, see socksRules
+	socksServer *chshare.SocksServer
+	//activity tracks the session's tunnels
+	activity *chshare.Activity
+	//bytes counts the traffic of the session's tunnels
+	bytes *chshare.ByteCounter
+}
+
+// sessionIndex tracks the active sessions of the server
+type sessionIndex struct {
+	sync.Mutex
+	inner map[int32]*session
+	//maxSessions and maxChannels apply
+	//to users without their own limit
+	maxSessions        int
+	maxChannels        int
+	maxSessionChannels int
+}
+
+func newSessionIndex(maxSessions, maxChannels, maxSessionChannels int) *sessionIndex {
+	return &sessionIndex{
+		inner:              map[int32]*session{},
+		maxSessions:        maxSessions,
+		maxChannels:        maxChannels,
+		maxSessionChannels: maxSessionChannels,
+	}
+}
+
+// add inserts the session, unless its user is
+// already at their maximum number of sessions
+func (i *sessionIndex) add(s *session) bool {
+	i.Lock()
+	defer i.Unlock()
+	max := i.maxSessions
+	if s.user != nil && s.user.MaxSessions > 0 {
+		max = s.user.MaxSessions
+	}
+	if s.user != nil && max > 0 {
+		count := 0
+		for _, other := range i.inner {
+			if other.user != nil && other.user.Name == s.user.Name {
+				count++
+			}
+		}
+		if count >= max {
+			return false
+		}
+	}
+	i.inner[s.id] = s
+	return true
+}
+
+// openChannel counts a new channel of the session, unless the
+// session or its user is at their maximum number of channels
+func (i *sessionIndex) openChannel(s *session) error {
+	i.Lock()
+	defer i.Unlock()
+	if i.maxSessionChannels > 0 && s.channels >= i.maxSessionChannels {
+		return fmt.Errorf("session has %d open channels", s.channels)
+	}
+	max := i.maxChannels
+	if s.user != nil && s.user.MaxChannels > 0 {
+		max = s.user.MaxChannels
+	}
+	if s.user != nil && max > 0 {
+		count := 0
+		for _, other := range i.inner {
+			if other.user != nil && other.user.Name == s.user.Name {
+				count += other.channels
+			}
+		}
+		if count >= max {
+			return fmt.Errorf("user '%s' has %d open channels", s.user.Name, count)
+		}
+	}
+	s.channels++
+	return nil
+}
+
+func (i *sessionIndex) closeChannel(s *session) {
+	i.Lock()
+	s.channels--
+	i.Unlock()
+}
+
+func (i *sessionIndex) len() int {
+	i.Lock()
+	defer i.Unlock()
+	return len(i.inner)
+}
+
+func (i *sessionIndex) del(id int32) {
+	i.Lock()
+	delete(i.inner, id)
+	i.Unlock()
+}
+
+// get returns the session with the id, or nil
+func (i *sessionIndex) get(id int32) *session {
+	i.Lock()
+	defer i.Unlock()
+	return i.inner[id]
+}
+
+// close closes the session with the id,
+// returning false when there is none
+func (i *sessionIndex) close(id int32) bool {
+	i.Lock()
+	defer i.Unlock()
+	s, ok := i.inner[id]
+	if ok {
+		s.sshConn.Close()
+	}
+	return ok
+}
+
+// closeAll closes all of the sessions,
+// returning the number of sessions closed
+func (i *sessionIndex) closeAll() int {
+	i.Lock()
+	defer i.Unlock()
+	for _, s := range i.inner {
+		s.sshConn.Close()
+	}
+	return len(i.inner)
+}
+
+// closeUser closes the sessions of the named user,
+// returning the number of sessions closed
+func (i *sessionIndex) closeUser(name string) int {
+	i.Lock()
+	defer i.Unlock()
+	n := 0
+	for _, s := range i.inner {
+		if s.user != nil && s.user.Name == name {
+			s.sshConn.Close()
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,105 @@
+package chserver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	socks5 "github.com/armon/go-socks5"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// newSocksServer creates a SOCKS5 server (not listening
+// on any port!) which permits requests using rules, and
+// authenticates its clients with creds (when given)
+func (s *Server) newSocksServer(rules socks5.RuleSet, creds socks5.CredentialStore) (*chshare.SocksServer, error) {
+	config := &socks5.Config{Rules: rules, Credentials: creds}
+	if s.Debug {
+		config.Logger = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
+	} else {
+		config.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	return chshare.NewSocksServer(config)
+}
+
+// socksRules only permits CONNECT requests to the destinations
+// in the access list of the session's user (and, with --socks5-auth,
+// of the SOCKS client's user) which are allowed by the policy (if any)
+type socksRules struct {
+	*Server
+	sess *session
+	log  *chshare.Logger
+	//users are the authenticated users of SOCKS clients
+	users sync.Map
+}
+
+// Valid authenticates a SOCKS client as one of the
+// server's users, as when logging in (see authUser)
+func (r *socksRules) Valid(name, pass string) bool {
+	key := "socks user " + name
+	if d := r.limiter.locked(key); d > 0 {
+		r.log.Debugf("SOCKS login denied for user: %s (locked out for %s)", name, d.Round(time.Second))
+		return false
+	}
+	user, err := r.auth.Authenticate(name, pass, r.sess.sshConn)
+	if err == nil && user == nil {
+		err = errors.New("no users")
+	} else if err == nil && user.Expired() {
+		err = errors.New("user has expired")
+	}
+	if err == nil {
+		user, err = user.Expand()
+	}
+	if err != nil {
+		r.log.Infof("SOCKS login failed for user: %s (%s)", name, err)
+		if errors.Is(err, ErrInvalidCredentials) {
+			r.limiter.failed(key)
+		}
+		return false
+	}
+	r.limiter.succeeded(key)
+	r.users.Store(name, user)
+	return true
+}
+
+func (r *socksRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		r.log.Debugf("Denied SOCKS command %d", req.Command)
+		return ctx, false
+	}
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(req.DestAddr.Port))
+	if r.sess.user != nil && !r.checkAccess(r.log, r.sess, "socks", addr) {
+		r.log.Infof("Denied SOCKS access to '%s'", addr)
+		return ctx, false
+	}
+	if r.socksAuth && !r.socksUserAllows(req, addr) {
+		r.log.Infof("Denied SOCKS access to '%s' (for SOCKS user)", addr)
+		return ctx, false
+	}
+	return ctx, r.policyAllows(r.log, r.sess, "socks", addr)
+}
+
+// socksUserAllows checks the access list
+// of the SOCKS client's authenticated user
+func (r *socksRules) socksUserAllows(req *socks5.Request, addr string) bool {
+	if req.AuthContext == nil {
+		return false
+	}
+	v, ok := r.users.Load(req.AuthContext.Payload["Username"])
+	if !ok {
+		return false
+	}
+	rule := r.matchRule(v.(*chshare.User), addr)
+	return rule != nil && !rule.Deny
+}
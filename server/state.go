@@ -0,0 +1,133 @@
+package chserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// sessionState stores the reverse ports of each client's session in
+// a file, as a JSON object like {"<user>/<client id>": ["0.0.0.0:2222"]},
+// so that a restarted server binds them again right away, holding their
+// connections (in the listen backlog) until the client reconnects, or
+// else until the grace period ends. Sessions closed by a draining
+// server stay in the file, as their clients are expected back
+type sessionState struct {
+	*chshare.Logger
+	mut    sync.Mutex
+	path   string
+	ports  map[string][]string
+	parked map[string]net.Listener
+}
+
+// newSessionState loads the state file, returning nil when there is none
+func newSessionState(path string, grace time.Duration, logger *chshare.Logger) (*sessionState, error) {
+	if path == "" {
+		return nil, nil
+	}
+	s := &sessionState{
+		Logger: logger.Fork("state"),
+		path:   path,
+		ports:  map[string][]string{},
+		parked: map[string]net.Listener{},
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read session state: %s", err)
+	}
+	if err := json.Unmarshal(b, &s.ports); err != nil {
+		return nil, fmt.Errorf("Invalid session state: %s", err)
+	}
+	for key, addrs := range s.ports {
+		for _, addr := range addrs {
+			l, err := net.Listen("tcp4", addr)
+			if err != nil {
+				s.Infof("Failed to hold port %s of '%s': %s", addr, key, err)
+				continue
+			}
+			s.parked[addr] = l
+		}
+	}
+	if len(s.parked) > 0 {
+		s.Infof("Holding %d reverse ports for %s while their clients reconnect", len(s.parked), grace)
+		time.AfterFunc(grace, s.expire)
+	}
+	return s, nil
+}
+
+// take returns the held listener of the client's address, if any
+func (s *sessionState) take(key, addr string) net.Listener {
+	if s == nil {
+		return nil
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, a := range s.ports[key] {
+		if l, ok := s.parked[addr]; ok && a == addr {
+			delete(s.parked, addr)
+			return l
+		}
+	}
+	return nil
+}
+
+// expire closes the listeners of clients which haven't reconnected
+func (s *sessionState) expire() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if len(s.parked) == 0 {
+		return
+	}
+	for addr, l := range s.parked {
+		l.Close()
+		for key, addrs := range s.ports {
+			for _, a := range addrs {
+				if a == addr {
+					delete(s.ports, key)
+				}
+			}
+		}
+	}
+	s.Infof("Released %d reverse ports of clients which didn't reconnect", len(s.parked))
+	s.parked = map[string]net.Listener{}
+	s.save()
+}
+
+// set stores the reverse ports of the client's session
+func (s *sessionState) set(key string, addrs []string) {
+	if s == nil || key == "" {
+		return
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if len(addrs) == 0 {
+		delete(s.ports, key)
+	} else {
+		s.ports[key] = addrs
+	}
+	s.save()
+}
+
+func (s *sessionState) save() {
+	b, err := json.MarshalIndent(s.ports, "", "  ")
+	if err != nil {
+		s.Infof("Failed to save: %s", err)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		s.Infof("Failed to save: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		s.Infof("Failed to save: %s", err)
+	}
+}
@@ -0,0 +1,99 @@
+package chserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	chshare "github.com/jpillora/chisel/share"
+)
+
+// isH2Tunnel reports whether the request is a tunnel carried by
+// its HTTP/2 stream (a POST with the protocol header) rather than
+// by a websocket, see the client's --transport
+func isH2Tunnel(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodPost && req.Header.Get(chshare.H2ProtocolHeader) != ""
+}
+
+// upgrade accepts the tunnel's connection
+func (s *Server) upgrade(w http.ResponseWriter, req *http.Request) (net.Conn, error) {
+	if !isH2Tunnel(req) {
+		u := upgrader
+		u.HandshakeTimeout = s.timeouts.upgrade
+		wsConn, err := u.Upgrade(w, req, nil)
+		if err != nil {
+			return nil, err
+		}
+		return chshare.NewWebSocketConn(wsConn), nil
+	}
+	//the response headers are sent right away,
+	//with the response body streaming the tunnel
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	return withRemoteAddr(chshare.NewHTTPStreamConn(req.Body, w, rc.Flush, nil), req), nil
+}
+
+// withRemoteAddr gives a tunnel carried by HTTP requests
+// the remote address of the request
+func withRemoteAddr(conn net.Conn, req *http.Request) net.Conn {
+	addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return conn
+	}
+	return &forwardedConn{Conn: conn, addr: addr}
+}
+
+// rawListener hands its connections straight to the tunnel
+// handler, without any HTTP, so that it's served (and closed)
+// with the http server's other listeners, but never returns
+// a connection to it
+type rawListener struct {
+	net.Listener
+	handle func(net.Conn)
+}
+
+func (l *rawListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		go l.handle(conn)
+	}
+}
+
+// handleRaw runs a tunnel spoken directly over TCP or TLS,
+// which is authenticated by the ssh password (or by the
+// client certificate) since there are no HTTP headers
+func (s *Server) handleRaw(conn net.Conn) {
+	defer conn.Close()
+	id := atomic.AddInt32(&s.sessCount, 1)
+	clog := s.Fork("session#%d", id)
+	var state *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeouts.upgrade)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			clog.Debugf("Failed TLS handshake (%s)", err)
+			return
+		}
+		cs := tlsConn.ConnectionState()
+		state = &cs
+	}
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	certUser, status := s.admit(clog, ip, state)
+	if status != 0 {
+		return
+	}
+	defer s.release(ip)
+	s.handleTunnel(clog, id, conn, ip, certUser, "", "")
+}
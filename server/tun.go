@@ -0,0 +1,209 @@
+package chserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// tunServer routes the IP packets of its TUN device to the
+// sessions of the clients (see the client's --tun) to whose
+// tun addresses they're sent, and theirs to the device
+type tunServer struct {
+	*chshare.Logger
+	dev    *chshare.TUN
+	ip     net.IP
+	subnet *net.IPNet
+	mut    sync.Mutex
+	//peers are the tun channels, by client address
+	peers map[string]*tunPeer
+}
+
+// newTunServer creates the TUN device of the address
+// (like 10.8.0.1/24), or returns nil when it's empty
+func newTunServer(logger *chshare.Logger, addr string) (*tunServer, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ip, subnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := chshare.OpenTUN(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	t := &tunServer{
+		Logger: logger.Fork("tun"),
+		dev:    dev,
+		ip:     ip,
+		subnet: subnet,
+		peers:  map[string]*tunPeer{},
+	}
+	t.Infof("Device %s has address %s", dev.Name, addr)
+	go t.route()
+	return t, nil
+}
+
+// route sends the packets of the device to their clients
+func (t *tunServer) route() {
+	buf := chshare.NewPacketBuffer()
+	for {
+		n, err := t.dev.Read(buf)
+		if err != nil {
+			t.Infof("Device closed: %s", err)
+			return
+		}
+		_, dst, ok := chshare.PacketAddrs(buf[:n])
+		if !ok {
+			continue
+		}
+		//(peers are removed under the lock, closing their queue)
+		t.mut.Lock()
+		peer, ok := t.peers[dst.String()]
+		if ok {
+			peer.send(buf[:n])
+		}
+		t.mut.Unlock()
+		if !ok {
+			t.Debugf("Dropped packet to %s (no client)", dst)
+		}
+	}
+}
+
+// handleTunChannel relays the packets of a client's tun channel (whose
+// extra data is the client's tun address) once it's been allowed
+func (s *Server) handleTunChannel(clog *chshare.Logger, sess *session, ch ssh.NewChannel) {
+	t := s.tun
+	if t == nil {
+		clog.Debugf("Denied tun channel, please enable --tun")
+		ch.Reject(ssh.Prohibited, "TUN is not enabled on the server")
+		return
+	}
+	ip := net.ParseIP(string(ch.ExtraData()))
+	if ip == nil || !t.subnet.Contains(ip) || ip.Equal(t.ip) {
+		ch.Reject(ssh.Prohibited, fmt.Sprintf("Invalid tun address %s (outside of %s)", ch.ExtraData(), t.subnet))
+		return
+	}
+	addr := chshare.TUNPrefix + ip.String()
+	if sess.user != nil && !s.checkAccess(clog, sess, "tun", addr) {
+		ch.Reject(ssh.Prohibited, fmt.Sprintf("access to '%s' denied", addr))
+		return
+	}
+	if !s.policyAllows(clog, sess, "tun", addr) {
+		ch.Reject(ssh.Prohibited, fmt.Sprintf("access to '%s' denied by policy", addr))
+		return
+	}
+	//claim the address
+	peer := &tunPeer{packets: make(chan []byte, tunQueue)}
+	t.mut.Lock()
+	_, used := t.peers[ip.String()]
+	if !used {
+		t.peers[ip.String()] = peer
+	}
+	t.mut.Unlock()
+	if used {
+		ch.Reject(ssh.Prohibited, fmt.Sprintf("Tun address %s is in use", ip))
+		return
+	}
+	defer func() {
+		t.mut.Lock()
+		delete(t.peers, ip.String())
+		t.mut.Unlock()
+		close(peer.packets)
+	}()
+	stream, reqs, err := ch.Accept()
+	if err != nil {
+		clog.Debugf("Failed to accept tun channel: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	rwc := sess.bytes.Count(sess.activity.Track(chshare.LimitRate(stream, sess.limiter, s.maxBandwidth)))
+	defer rwc.Close()
+	go peer.write(rwc)
+	clog.Infof("Tun address %s", ip)
+	access := &tunAccess{server: s, clog: clog, sess: sess}
+	buf := chshare.NewPacketBuffer()
+	for {
+		b, err := chshare.ReadPacket(rwc, buf)
+		if err != nil {
+			return
+		}
+		//clients may only send from their own address
+		if src, _, ok := chshare.PacketAddrs(b); !ok || !src.Equal(ip) {
+			continue
+		}
+		//and to the addresses of their access list
+		if sess.user != nil && !access.allows(b) {
+			continue
+		}
+		if _, err := t.dev.Write(b); err != nil {
+			clog.Debugf("Tun write failed: %s", err)
+		}
+	}
+}
+
+// tunAccess matches the destinations of a client's packets against
+// its user's access list, caching the decisions for a few seconds
+// (so that reloads and time windows still apply)
+type tunAccess struct {
+	server    *Server
+	clog      *chshare.Logger
+	sess      *session
+	decisions map[string]bool
+	expires   time.Time
+}
+
+func (a *tunAccess) allows(packet []byte) bool {
+	dst, ok := chshare.PacketDestination(packet)
+	if !ok {
+		return false
+	}
+	if now := time.Now(); now.After(a.expires) || len(a.decisions) >= 4096 {
+		a.decisions = map[string]bool{}
+		a.expires = now.Add(10 * time.Second)
+	}
+	allowed, ok := a.decisions[dst]
+	if !ok {
+		rule := a.server.matchRule(a.sess.user, dst)
+		allowed = rule != nil && !rule.Deny
+		a.decisions[dst] = allowed
+		if !allowed {
+			a.clog.Debugf("Dropped packets to %s (denied)", dst)
+		}
+	}
+	return allowed
+}
+
+// tunQueue is the number of packets queued for each
+// client, beyond which they're dropped (as IP allows)
+const tunQueue = 256
+
+// tunPeer queues the packets of a client's tun channel, so
+// a slow client doesn't hold up the packets of the others
+type tunPeer struct {
+	packets chan []byte
+}
+
+// send queues a copy of the packet, unless the queue is full
+func (p *tunPeer) send(b []byte) {
+	select {
+	case p.packets <- append([]byte(nil), b...):
+	default:
+	}
+}
+
+// write frames the queued packets onto the stream
+func (p *tunPeer) write(stream io.Writer) {
+	for b := range p.packets {
+		if err := chshare.WritePacket(stream, b); err != nil {
+			return
+		}
+	}
+}
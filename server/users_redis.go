@@ -0,0 +1,191 @@
+package chserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	"github.com/jpillora/chisel/share"
+)
+
+// RedisConfig loads users from a Redis hash, where each field is a
+// username and each value is a JSON object like
+//
+//	{"password": "<pass or hash>", "addrs": ["<addr-regex>", ...]}
+//
+// Publishing a username on the channel reloads that user (removing
+// them when they no longer exist), publishing "*" reloads all users.
+type RedisConfig struct {
+	URL string
+	// Key is the users hash, defaults to chisel:users
+	Key string
+	// Channel announces changes, defaults to chisel:users
+	Channel string
+}
+
+type redisUser struct {
+	Password string   `json:"password"`
+	Addrs    []string `json:"addrs"`
+}
+
+// redisUsers keeps a user index in sync with Redis
+type redisUsers struct {
+	RedisConfig
+	*chshare.Logger
+	users *chshare.UserIndex
+	mut   sync.Mutex
+	names map[string]bool
+}
+
+func newRedisUsers(c RedisConfig, users *chshare.UserIndex, logger *chshare.Logger) (*redisUsers, error) {
+	if c.Key == "" {
+		c.Key = "chisel:users"
+	}
+	if c.Channel == "" {
+		c.Channel = "chisel:users"
+	}
+	r := &redisUsers{
+		RedisConfig: c,
+		Logger:      logger.Fork("redis"),
+		users:       users,
+		names:       map[string]bool{},
+	}
+	if err := r.loadAll(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+func (r *redisUsers) watch() {
+	b := &backoff.Backoff{Max: 30 * time.Second}
+	for {
+		err := r.subscribe(b)
+		d := b.Duration()
+		r.Infof("Subscription failed: %s, reconnecting in %s", err, d)
+		time.Sleep(d)
+	}
+}
+
+func (r *redisUsers) subscribe(b *backoff.Backoff) error {
+	conn, err := dialRedis(r.URL, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	if _, err := conn.do("SUBSCRIBE", r.Channel); err != nil {
+		return err
+	}
+	//catch up on changes missed while disconnected
+	if err := r.loadAll(); err != nil {
+		return err
+	}
+	b.Reset()
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		name, _ := msg[2].(string)
+		if name == "*" {
+			err = r.loadAll()
+		} else {
+			err = r.load(name)
+		}
+		if err != nil {
+			r.Infof("Failed to reload users: %s", err)
+		}
+	}
+}
+
+// loadAll replaces all of the users which came from Redis
+func (r *redisUsers) loadAll() error {
+	conn, err := dialRedis(r.URL, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("Redis connection failed: %s", err)
+	}
+	defer conn.close()
+	reply, err := conn.do("HGETALL", r.Key)
+	if err != nil {
+		return err
+	}
+	list, _ := reply.([]interface{})
+	users := map[string]*chshare.User{}
+	for i := 0; i+1 < len(list); i += 2 {
+		name, _ := list[i].(string)
+		value, _ := list[i+1].(string)
+		user, err := parseRedisUser(name, value)
+		if err != nil {
+			return err
+		}
+		users[name] = user
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for name := range r.names {
+		if _, ok := users[name]; !ok {
+			r.users.RemoveUser(name)
+			delete(r.names, name)
+		}
+	}
+	for name, user := range users {
+		r.users.UpdateUser(user)
+		r.names[name] = true
+	}
+	r.Debugf("Loaded %d users", len(users))
+	return nil
+}
+
+// load reloads a single user
+func (r *redisUsers) load(name string) error {
+	conn, err := dialRedis(r.URL, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("Redis connection failed: %s", err)
+	}
+	defer conn.close()
+	reply, err := conn.do("HGET", r.Key, name)
+	if err != nil {
+		return err
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if reply == nil {
+		if r.names[name] {
+			r.users.RemoveUser(name)
+			delete(r.names, name)
+			r.Debugf("Removed user: %s", name)
+		}
+		return nil
+	}
+	value, _ := reply.(string)
+	user, err := parseRedisUser(name, value)
+	if err != nil {
+		return err
+	}
+	r.users.UpdateUser(user)
+	r.names[name] = true
+	r.Debugf("Updated user: %s", name)
+	return nil
+}
+
+func parseRedisUser(name, value string) (*chshare.User, error) {
+	raw := redisUser{}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("Invalid JSON for user: %s (%s)", name, err)
+	}
+	if err := chshare.ValidatePassword(raw.Password); err != nil {
+		return nil, fmt.Errorf("Invalid password hash for user: %s (%s)", name, err)
+	}
+	addrs, err := chshare.ParseAddrs(raw.Addrs)
+	if err != nil {
+		return nil, err
+	}
+	return &chshare.User{Name: name, Pass: raw.Password, Addrs: addrs}, nil
+}
@@ -0,0 +1,123 @@
+package chserver
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultConfig fetches server secrets from a HashiCorp Vault secret
+// (KV version 1 or 2), which may contain the fields "key" (the key
+// seed), "tls_key" and "tls_cert" (PEM-encoded), and "authfile" (the
+// contents of an auth file). The secret is fetched again on SIGHUP.
+type VaultConfig struct {
+	// Addr is the Vault server, e.g. https://vault:8200
+	Addr  string
+	Token string
+	// Path of the secret, e.g. secret/data/chisel
+	Path string
+}
+
+type vaultSecrets struct {
+	Key      string          `json:"key"`
+	TLSKey   string          `json:"tls_key"`
+	TLSCert  string          `json:"tls_cert"`
+	AuthFile json.RawMessage `json:"authfile"`
+}
+
+// authFile returns the auth file contents, which may
+// be stored as a JSON string or as the object itself
+func (v *vaultSecrets) authFile() []byte {
+	var s string
+	if err := json.Unmarshal(v.AuthFile, &s); err == nil {
+		return []byte(s)
+	}
+	return v.AuthFile
+}
+
+func fetchVaultSecrets(c VaultConfig) (*vaultSecrets, error) {
+	if c.Addr == "" || c.Token == "" {
+		return nil, errors.New("Vault requires an address and a token")
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(c.Addr, "/")+"/v1/"+strings.TrimPrefix(c.Path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.Token)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Vault request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Vault request failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, fmt.Errorf("Invalid Vault response: %s", err)
+	}
+	//kv version 2 nests the secret and adds metadata
+	var v2 struct {
+		Data     json.RawMessage `json:"data"`
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	data := body.Data
+	if err := json.Unmarshal(data, &v2); err == nil && v2.Data != nil && v2.Metadata != nil {
+		data = v2.Data
+	}
+	secrets := &vaultSecrets{}
+	if err := json.Unmarshal(data, secrets); err != nil {
+		return nil, fmt.Errorf("Invalid Vault secret: %s", err)
+	}
+	return secrets, nil
+}
+
+// vaultSecret is the Vault secret fetched again by Reload
+type vaultSecret struct {
+	VaultConfig
+	//key is the key seed the server started with
+	key string
+	//users is set when the users come from Vault
+	users bool
+}
+
+// reloadVault re-fetches the Vault secret, replacing the TLS
+// certificate and reloading users, unless they're loaded from
+// an auth file
+func (s *Server) reloadVault() error {
+	secrets, err := fetchVaultSecrets(s.vault.VaultConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to reload secrets: %s", err)
+	}
+	if secrets.Key != s.vault.key {
+		s.Infof("The key seed in Vault has changed, restart to use it")
+	}
+	if secrets.TLSKey != "" && secrets.TLSCert != "" && s.httpServer.TLSConfig != nil {
+		cert, err := tls.X509KeyPair([]byte(secrets.TLSCert), []byte(secrets.TLSKey))
+		if err != nil {
+			return fmt.Errorf("Failed to reload TLS certificate: %s", err)
+		}
+		s.setCertificate(&cert)
+	}
+	if len(secrets.AuthFile) > 0 && !s.vault.users {
+		s.Infof("Ignoring the authfile in Vault, the users come from the auth file")
+	} else if len(secrets.AuthFile) > 0 {
+		if err := s.users.LoadUsersJSON(secrets.authFile()); err != nil {
+			return fmt.Errorf("Failed to reload users: %s", err)
+		}
+	}
+	s.Infof("Reloaded secrets from Vault")
+	return nil
+}
@@ -0,0 +1,85 @@
+package chserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// vhosts selects the behaviour of the server for each host
+// name, requested with SNI (or the Host header, without TLS):
+// "tunnel" for the chisel endpoint (the default), or the URL
+// of a server to proxy all of the host's requests to.
+// Names may start with a wildcard (like *.example.com)
+type vhosts map[string]http.Handler
+
+func newVHosts(specs []string) (vhosts, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	v := vhosts{}
+	for _, spec := range specs {
+		pair := strings.SplitN(spec, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("Invalid virtual host '%s' (expected <host>=tunnel or <host>=<url>)", spec)
+		}
+		host := strings.ToLower(pair[0])
+		if pair[1] == "tunnel" {
+			v[host] = nil
+			continue
+		}
+		proxy, err := newSingleHostProxy(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		v[host] = proxy
+	}
+	return v, nil
+}
+
+// proxy is the proxy of the request's host, or nil when
+// the host is a tunnel endpoint (or isn't listed)
+func (v vhosts) proxy(r *http.Request) http.Handler {
+	if v == nil {
+		return nil
+	}
+	host := r.Host
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		host = r.TLS.ServerName
+	} else if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if p, ok := v[host]; ok {
+		return p
+	}
+	for i := strings.Index(host, "."); i >= 0; i = strings.Index(host, ".") {
+		host = host[i+1:]
+		if p, ok := v["*."+host]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// newSingleHostProxy proxies requests to the target server
+func newSingleHostProxy(target string) (*httputil.ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Missing protocol (%s)", u)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	//always use proxy host
+	proxy.Director = func(r *http.Request) {
+		r.URL.Scheme = u.Scheme
+		r.URL.Host = u.Host
+		r.Host = u.Host
+	}
+	return proxy, nil
+}
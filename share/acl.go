@@ -0,0 +1,438 @@
+package chshare
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ACLRule is an entry of a user's access list. Entries are regular
+// expressions matched against the requested address, unless they
+// are of the form <cidr>:<ports>, where <ports> is a port, a range
+// of ports like 80-443, or * (any port), or <host>:<ports> where
+// <ports> is a range or *, or the host is a wildcard like *.example.com
+// (matching any of its subdomains). For example 10.0.0.0/8:22,
+// db:8000-8999, *.example.com:443, [fd00::/8]:80-443 or
+// R:127.0.0.0/8:* (for reverse remotes). The address of a UDP
+// remote is prefixed with udp: (after any R:), and so is only
+// matched by entries like udp:10.0.0.1:161 or udp:10.0.0.0/8:*.
+// Likewise, regular expressions are matched against the address
+// without its R: and udp: prefixes, and only match the remotes of
+// their own prefixes (written after any ^), so ^10\.0\.0\.1:53$ only
+// matches TCP and ^R:udp:0\.0\.0\.0:53$ only reverse UDP remotes.
+// Regular expressions which match everything, like .* and ^.*$,
+// still match every address (of any scope).
+// Unix sockets are addressed like unix:/var/run/docker.sock, and the
+// tun addresses of clients like tun:10.8.0.2, both only matched by
+// regular expressions.
+// Entries prefixed with ! deny access to the addresses they match,
+// entries may be followed by time windows (see aclWindow), and
+// may contain variables like ${user} (see User.Expand).
+type ACLRule struct {
+	// Rule is the entry as written
+	Rule string
+	// Deny is set by the ! prefix
+	Deny    bool
+	re      *regexp.Regexp
+	reverse bool
+	ipnet   *net.IPNet
+	host    string
+	ports   portRange
+	windows []aclWindow
+	//template is set for entries with variables
+	template bool
+	//wildcard is set for hosts like *.example.com
+	wildcard bool
+	udp      bool
+	//any is set for the entry which matches every address
+	any bool
+}
+
+const udpPrefix = "udp:"
+
+// splitACLScope removes the R: and udp: prefixes of s
+func splitACLScope(s string) (reverse, udp bool, rest string) {
+	if strings.HasPrefix(s, revPrefix) {
+		s, reverse = strings.TrimPrefix(s, revPrefix), true
+	}
+	if strings.HasPrefix(s, udpPrefix) {
+		s, udp = strings.TrimPrefix(s, udpPrefix), true
+	}
+	return reverse, udp, s
+}
+
+type portRange struct {
+	min, max int
+}
+
+func (p portRange) contains(port int) bool {
+	return port >= p.min && port <= p.max
+}
+
+// ParseACLRule parses an access list entry, where
+// "" and "*" allow access to any address
+func ParseACLRule(s string) (*ACLRule, error) {
+	if isACLTemplate(s) {
+		return parseACLTemplate(s)
+	}
+	if strings.HasPrefix(s, "!") {
+		allow, err := ParseACLRule(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		deny := *allow
+		deny.Rule = s
+		deny.Deny = true
+		return &deny, nil
+	}
+	addr, windows, err := parseACLWindows(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(windows) > 0 {
+		r, err := ParseACLRule(addr)
+		if err != nil {
+			return nil, err
+		}
+		windowed := *r
+		windowed.Rule = s
+		windowed.windows = windows
+		return &windowed, nil
+	}
+	if s == "" || s == "*" {
+		return UserAllowAll, nil
+	}
+	r := &ACLRule{Rule: s}
+	if ok, err := r.parseAddr(s); ok {
+		return r, err
+	}
+	if err := r.parseRegexp(s); err != nil {
+		return nil, err
+	}
+	r.parseLiteral(s)
+	return r, nil
+}
+
+// parseRegexp compiles the regular expression of the entry,
+// after removing the R: and udp: prefixes of its scope
+func (r *ACLRule) parseRegexp(s string) error {
+	anchor := ""
+	if strings.HasPrefix(s, "^") {
+		anchor, s = "^", s[1:]
+	}
+	r.reverse, r.udp, s = splitACLScope(s)
+	re, err := regexp.Compile(anchor + s)
+	if err != nil {
+		return fmt.Errorf("Invalid address regex '%s'", r.Rule)
+	}
+	r.re = re
+	r.any = !r.reverse && !r.udp && isMatchAll(anchor+s)
+	return nil
+}
+
+// isMatchAll reports whether the regular expression matches any
+// string, being made up of only anchors and repeats of any character
+func isMatchAll(s string) bool {
+	re, err := syntax.Parse(s, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	subs := []*syntax.Regexp{uncapture(re.Simplify())}
+	if subs[0].Op == syntax.OpConcat {
+		subs = subs[0].Sub
+	}
+	repeats := false
+	for _, sub := range subs {
+		sub = uncapture(sub)
+		switch sub.Op {
+		case syntax.OpBeginText, syntax.OpEndText, syntax.OpBeginLine, syntax.OpEndLine:
+		case syntax.OpStar, syntax.OpPlus:
+			if op := uncapture(sub.Sub[0]).Op; op != syntax.OpAnyChar && op != syntax.OpAnyCharNotNL {
+				return false
+			}
+			repeats = true
+		default:
+			return false
+		}
+	}
+	return repeats
+}
+
+func uncapture(re *syntax.Regexp) *syntax.Regexp {
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	return re
+}
+
+// parseLiteral records the host and port of regular expressions
+// which are written as a plain <host>:<port>, used by MatchResolved
+func (r *ACLRule) parseLiteral(s string) {
+	reverse, udp, s := splitACLScope(s)
+	host, port, ok := splitACLAddr(s)
+	if !ok || !isACLHostname(host) || net.ParseIP(host) != nil {
+		return
+	}
+	p, err := parsePort(port)
+	if err != nil {
+		return
+	}
+	r.host = strings.ToLower(host)
+	r.ports = portRange{p, p}
+	r.reverse = reverse
+	r.udp = udp
+}
+
+// parseAddr parses <host>:<ports> entries, where the host is a
+// CIDR, or <ports> is a range or *, returning false when s is not
+// of this form (it is then a regular expression)
+func (r *ACLRule) parseAddr(s string) (bool, error) {
+	r.reverse, r.udp, s = splitACLScope(s)
+	host, ports, ok := splitACLAddr(s)
+	if !ok || !(strings.Contains(host, "/") || ports == "*" || isPortRange(ports) || isACLWildcard(host)) {
+		return false, nil
+	}
+	var err error
+	if r.ports, err = parsePortRange(ports); err != nil {
+		return true, fmt.Errorf("Invalid port range in '%s': %s", r.Rule, err)
+	}
+	if strings.Contains(host, "/") {
+		if _, r.ipnet, err = net.ParseCIDR(host); err != nil {
+			return true, fmt.Errorf("Invalid CIDR in '%s'", r.Rule)
+		}
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if isACLHostname(host) {
+		r.host = strings.ToLower(host)
+	} else if isACLWildcard(host) {
+		r.host = strings.ToLower(host[1:])
+		r.wildcard = true
+	} else {
+		return true, fmt.Errorf("Invalid host in '%s'", r.Rule)
+	}
+	return true, nil
+}
+
+var (
+	portRangeRegExp   = regexp.MustCompile(`^[0-9]*-[0-9]*$`)
+	aclHostnameRegExp = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+)
+
+func isPortRange(s string) bool {
+	return portRangeRegExp.MatchString(s)
+}
+
+func isACLHostname(s string) bool {
+	return aclHostnameRegExp.MatchString(s)
+}
+
+// isACLWildcard reports whether s is a hostname prefixed with *.
+func isACLWildcard(s string) bool {
+	return strings.HasPrefix(s, "*.") && isACLHostname(s[2:])
+}
+
+// splitACLAddr splits <host>:<ports>, where
+// IPv6 hosts may be enclosed in brackets
+func splitACLAddr(s string) (string, string, bool) {
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "]:")
+		if i < 0 {
+			return "", "", false
+		}
+		return s[1:i], s[i+2:], true
+	}
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+func parsePortRange(s string) (portRange, error) {
+	if s == "*" {
+		return portRange{0, 65535}, nil
+	}
+	min, max := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		min, max = s[:i], s[i+1:]
+	}
+	lo, err := parsePort(min)
+	if err != nil {
+		return portRange{}, err
+	}
+	hi, err := parsePort(max)
+	if err != nil {
+		return portRange{}, err
+	}
+	if lo > hi {
+		return portRange{}, fmt.Errorf("the range %d-%d is reversed", lo, hi)
+	}
+	return portRange{lo, hi}, nil
+}
+
+func parsePort(s string) (int, error) {
+	if s == "" {
+		return 0, errors.New("missing port")
+	}
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 || p > 65535 {
+		return 0, fmt.Errorf("'%s' is not a port (0-65535)", s)
+	}
+	return p, nil
+}
+
+// Match reports whether the rule matches the address, of the
+// form <host>:<port> or R:<host>:<port> for reverse remotes
+func (r *ACLRule) Match(addr string) bool {
+	//templates only match once expanded
+	if r.template || !r.Active(time.Now()) {
+		return false
+	}
+	if r.any {
+		return true
+	}
+	reverse, udp, rest := splitACLScope(addr)
+	if reverse != r.reverse || udp != r.udp {
+		return false
+	}
+	if r.re != nil {
+		return r.re.MatchString(rest)
+	}
+	host, port, err := net.SplitHostPort(rest)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || !r.ports.contains(p) {
+		return false
+	}
+	if r.host != "" {
+		return r.matchHost(host)
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && r.ipnet.Contains(ip)
+}
+
+// matchHost compares the host to the rule's host, where
+// wildcards (stored as .example.com) match any subdomain
+func (r *ACLRule) matchHost(host string) bool {
+	host = strings.ToLower(host)
+	if r.wildcard {
+		return strings.HasSuffix(host, r.host) && len(host) > len(r.host)
+	}
+	return host == r.host
+}
+
+// Resolver looks up the IP addresses of a host
+type Resolver func(host string) ([]net.IP, error)
+
+// cached returns a resolver which looks up each host once
+func (resolve Resolver) cached() Resolver {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	results := map[string]result{}
+	return func(host string) ([]net.IP, error) {
+		host = strings.ToLower(host)
+		r, ok := results[host]
+		if !ok {
+			r.ips, r.err = resolve(host)
+			results[host] = r
+		}
+		return r.ips, r.err
+	}
+}
+
+// MatchResolved is Match, except that a requested hostname also
+// matches by any of its IP addresses, and a requested IP address
+// also matches hostname entries (like db:5432) which resolve to it
+func (r *ACLRule) MatchResolved(addr string, resolve Resolver) bool {
+	if r.Match(addr) {
+		return true
+	}
+	if !r.Active(time.Now()) {
+		return false
+	}
+	reverse, udp, rest := splitACLScope(addr)
+	prefix := strings.TrimSuffix(addr, rest)
+	//unix sockets (and tun addresses) have nothing to resolve
+	if strings.HasPrefix(rest, socketPrefix) || strings.HasPrefix(rest, TUNPrefix) {
+		return false
+	}
+	host, port, err := net.SplitHostPort(rest)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := resolve(host)
+		if err != nil {
+			return false
+		}
+		for _, ip := range ips {
+			if r.Match(prefix + net.JoinHostPort(ip.String(), port)) {
+				return true
+			}
+		}
+		return false
+	}
+	if r.host == "" || r.wildcard || r.reverse != reverse || r.udp != udp {
+		return false
+	}
+	if p, err := strconv.Atoi(port); err != nil || !r.ports.contains(p) {
+		return false
+	}
+	ips, err := resolve(r.host)
+	if err != nil {
+		return false
+	}
+	for _, rip := range ips {
+		if rip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether t is within one of the rule's
+// time windows (rules without windows are always active)
+func (r *ACLRule) Active(t time.Time) bool {
+	for _, w := range r.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return len(r.windows) == 0
+}
+
+// Windowed reports whether the rule has time windows
+func (r *ACLRule) Windowed() bool {
+	return len(r.windows) > 0
+}
+
+func (r *ACLRule) String() string {
+	return r.Rule
+}
+
+// ParseAddrs parses a list of access list entries, see ParseACLRule
+func ParseAddrs(remotes []string) ([]*ACLRule, error) {
+	var addrs []*ACLRule
+	for _, s := range remotes {
+		r, err := ParseACLRule(s)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, r)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,75 @@
+package chshare
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Access list entries may contain variables like ${user}, which
+// are replaced with the user's values as they authenticate (see
+// User.Expand). Values are literal within regular expressions.
+var (
+	aclVarRegExp      = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+	aclVarValueRegExp = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+)
+
+func isACLTemplate(s string) bool {
+	return aclVarRegExp.MatchString(s)
+}
+
+// parseACLTemplate validates the template using a placeholder
+// value (0, which is valid as either a host or a port)
+func parseACLTemplate(s string) (*ACLRule, error) {
+	sample, err := ParseACLRule(aclVarRegExp.ReplaceAllString(s, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template '%s': %s", s, err)
+	}
+	return &ACLRule{Rule: s, Deny: sample.Deny, template: true}, nil
+}
+
+// expand returns the rule with its variables replaced
+func (r *ACLRule) expand(vars map[string]string) (*ACLRule, error) {
+	if !r.template {
+		return r, nil
+	}
+	var err error
+	replace := func(quote bool) string {
+		return aclVarRegExp.ReplaceAllStringFunc(r.Rule, func(v string) string {
+			name := v[2 : len(v)-1]
+			value, ok := vars[name]
+			if !ok {
+				err = fmt.Errorf("Unknown variable '%s' in '%s'", v, r.Rule)
+			} else if !aclVarValueRegExp.MatchString(value) {
+				err = fmt.Errorf("Invalid value '%s' for variable '%s' in '%s'", value, v, r.Rule)
+			}
+			if quote {
+				return regexp.QuoteMeta(value)
+			}
+			return value
+		})
+	}
+	s := replace(false)
+	if err != nil {
+		return nil, err
+	}
+	expanded, err := ParseACLRule(s)
+	if err != nil {
+		return nil, err
+	}
+	if expanded.re != nil {
+		return ParseACLRule(replace(true))
+	}
+	return expanded, nil
+}
+
+func expandRules(rules []*ACLRule, vars map[string]string) ([]*ACLRule, error) {
+	var expanded []*ACLRule
+	for _, r := range rules {
+		e, err := r.expand(vars)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, e)
+	}
+	return expanded, nil
+}
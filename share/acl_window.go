@@ -0,0 +1,280 @@
+package chshare
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aclWindow is a period of time in which an access list entry applies.
+// Windows follow the entry's address, each prefixed with @:
+//
+//	@Mon-Fri 09:00-17:00 Europe/Berlin  (days and/or times of the week)
+//	@2030-01-02T00:00:00Z/2030-01-03T00:00:00Z  (an RFC3339 period)
+//	@cron(* 9-16 * * 1-5) UTC  (the minutes matching a cron expression)
+//
+// where the time zone is optional (defaulting to the server's).
+type aclWindow interface {
+	contains(t time.Time) bool
+}
+
+// parseACLWindows splits the entry into its address and windows
+func parseACLWindows(s string) (string, []aclWindow, error) {
+	i := strings.Index(s, " @")
+	if i < 0 {
+		return s, nil, nil
+	}
+	addr := strings.TrimSpace(s[:i])
+	var windows []aclWindow
+	for _, w := range strings.Split(s[i+2:], " @") {
+		window, err := parseACLWindow(strings.TrimSpace(w))
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid time window '@%s': %s", strings.TrimSpace(w), err)
+		}
+		windows = append(windows, window)
+	}
+	return addr, windows, nil
+}
+
+func parseACLWindow(s string) (aclWindow, error) {
+	if strings.HasPrefix(s, "cron(") {
+		i := strings.IndexByte(s, ')')
+		if i < 0 {
+			return nil, errors.New("missing )")
+		}
+		loc, err := parseWindowLocation(strings.TrimSpace(s[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		return parseCronWindow(s[5:i], loc)
+	}
+	if i := strings.IndexByte(s, '/'); i > 0 && s[0] >= '0' && s[0] <= '9' {
+		from, err := time.Parse(time.RFC3339, s[:i])
+		if err != nil {
+			return nil, err
+		}
+		to, err := time.Parse(time.RFC3339, s[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if !to.After(from) {
+			return nil, errors.New("the period ends before it starts")
+		}
+		return &periodWindow{from, to}, nil
+	}
+	return parseWeeklyWindow(s)
+}
+
+func parseWindowLocation(s string) (*time.Location, error) {
+	if s == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(s)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone '%s'", s)
+	}
+	return loc, nil
+}
+
+// periodWindow is a single period of time
+type periodWindow struct {
+	from, to time.Time
+}
+
+func (w *periodWindow) contains(t time.Time) bool {
+	return !t.Before(w.from) && t.Before(w.to)
+}
+
+// weeklyWindow is a set of days and a time of day
+// range, which may end after midnight
+type weeklyWindow struct {
+	days     [7]bool
+	from, to int //minutes since midnight
+	loc      *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWeeklyWindow(s string) (*weeklyWindow, error) {
+	w := &weeklyWindow{from: 0, to: 24 * 60, loc: time.Local}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, errors.New("empty window")
+	}
+	days, times := false, false
+	for i, f := range fields {
+		switch {
+		case !times && strings.Contains(f, ":"):
+			parts := strings.Split(f, "-")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("'%s' is not a time range (like 09:00-17:00)", f)
+			}
+			var err error
+			if w.from, err = parseTimeOfDay(parts[0]); err != nil {
+				return nil, err
+			}
+			if w.to, err = parseTimeOfDay(parts[1]); err != nil {
+				return nil, err
+			}
+			times = true
+		case !days && !times && isWeekdays(f):
+			for _, d := range strings.Split(f, ",") {
+				parts := strings.Split(strings.ToLower(d), "-")
+				from, ok1 := weekdays[parts[0]]
+				to, ok2 := weekdays[parts[len(parts)-1]]
+				if !ok1 || !ok2 || len(parts) > 2 {
+					return nil, fmt.Errorf("'%s' is not a day or range of days (like Mon-Fri)", d)
+				}
+				for day := from; ; day = (day + 1) % 7 {
+					w.days[day] = true
+					if day == to {
+						break
+					}
+				}
+			}
+			days = true
+		case i == len(fields)-1:
+			loc, err := parseWindowLocation(f)
+			if err != nil {
+				return nil, err
+			}
+			w.loc = loc
+		default:
+			return nil, fmt.Errorf("unexpected '%s'", f)
+		}
+	}
+	if !days {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	return w, nil
+}
+
+func isWeekdays(s string) bool {
+	for _, d := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '-' }) {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		h, err1 := strconv.Atoi(parts[0])
+		m, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil && h >= 0 && m >= 0 && m < 60 && (h < 24 || h == 24 && m == 0) {
+			return h*60 + m, nil
+		}
+	}
+	return 0, fmt.Errorf("'%s' is not a time of day (like 09:00)", s)
+}
+
+func (w *weeklyWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	day := t.Weekday()
+	now := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return w.days[day] && now >= w.from && now < w.to
+	}
+	//the range crosses midnight, so it may have started the day before
+	yesterday := (day + 6) % 7
+	return (w.days[day] && now >= w.from) || (w.days[yesterday] && now < w.to)
+}
+
+// cronWindow contains the minutes matching a cron expression
+// of the form "<minute> <hour> <day of month> <month> <day of week>"
+type cronWindow struct {
+	fields [5]uint64
+	//cron matches either day field when both are restricted
+	anyDom, anyDow bool
+	loc            *time.Location
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCronWindow(s string, loc *time.Location) (*cronWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, errors.New("a cron expression has 5 fields")
+	}
+	w := &cronWindow{loc: loc}
+	for i, f := range fields {
+		bits, err := parseCronField(f, cronRanges[i][0], cronRanges[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron field '%s': %s", f, err)
+		}
+		w.fields[i] = bits
+	}
+	//sunday is 0 or 7
+	if w.fields[4]&(1<<7) != 0 {
+		w.fields[4] |= 1
+	}
+	w.anyDom = fields[2] == "*"
+	w.anyDow = fields[4] == "*"
+	return w, nil
+}
+
+func parseCronField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, errors.New("invalid step")
+			}
+			step = s
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.New("invalid value")
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.New("invalid value")
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range (%d-%d)", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (w *cronWindow) contains(t time.Time) bool {
+	t = t.In(w.loc)
+	has := func(i, v int) bool {
+		return w.fields[i]&(1<<uint(v)) != 0
+	}
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	switch {
+	case w.anyDom && w.anyDow:
+		return true
+	case w.anyDom:
+		return dow
+	case w.anyDow:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,57 @@
+package chshare
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Activity records the time of the last read
+// or write through the connections it tracks
+type Activity struct {
+	last int64
+}
+
+// NewActivity creates an Activity, last active now
+func NewActivity() *Activity {
+	a := &Activity{}
+	a.Touch()
+	return a
+}
+
+// Touch marks the activity as active now
+func (a *Activity) Touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// Idle returns the time since the activity was last active
+func (a *Activity) Idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// Track returns rwc, touching the activity on each read
+// and write (or rwc unchanged when the activity is nil)
+func (a *Activity) Track(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	if a == nil {
+		return rwc
+	}
+	return &activityRWC{ReadWriteCloser: rwc, activity: a}
+}
+
+type activityRWC struct {
+	io.ReadWriteCloser
+	activity *Activity
+}
+
+func (c *activityRWC) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.activity.Touch()
+	}
+	return n, err
+}
+
+func (c *activityRWC) Write(p []byte) (int, error) {
+	c.activity.Touch()
+	return c.ReadWriteCloser.Write(p)
+}
@@ -0,0 +1,231 @@
+package chshare
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ageIntro         = "age-encryption.org/v1\n"
+	ageArmorType     = "AGE ENCRYPTED FILE"
+	ageChunkSize     = 64 * 1024
+	ageMaxScryptLogN = 20
+)
+
+// AgeDecrypter decrypts files encrypted with age (https://age-encryption.org)
+// to an X25519 identity, or with a passphrase
+type AgeDecrypter struct {
+	identities [][32]byte
+	passphrase string
+}
+
+// NewAgeDecrypter creates an AgeDecrypter from the contents of
+// an identity file (containing AGE-SECRET-KEY-1... lines)
+// and/or a passphrase
+func NewAgeDecrypter(identities, passphrase string) (*AgeDecrypter, error) {
+	d := &AgeDecrypter{passphrase: passphrase}
+	for _, line := range strings.Split(identities, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, key, err := bech32Decode(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid age identity: %s", err)
+		}
+		if hrp != "age-secret-key-" || len(key) != 32 {
+			return nil, errors.New("Invalid age identity: not an X25519 secret key")
+		}
+		var k [32]byte
+		copy(k[:], key)
+		d.identities = append(d.identities, k)
+	}
+	if len(d.identities) == 0 && passphrase == "" {
+		return nil, errors.New("An age identity or passphrase is required")
+	}
+	return d, nil
+}
+
+// IsAgeEncrypted detects files encrypted with age,
+// in either the binary or the armored format
+func IsAgeEncrypted(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return bytes.HasPrefix(b, []byte(ageIntro)) ||
+		bytes.HasPrefix(b, []byte("-----BEGIN "+ageArmorType+"-----"))
+}
+
+type ageStanza struct {
+	args []string
+	body []byte
+}
+
+// Decrypt decrypts the given age file
+func (d *AgeDecrypter) Decrypt(file []byte) ([]byte, error) {
+	if t := bytes.TrimSpace(file); bytes.HasPrefix(t, []byte("-----BEGIN")) {
+		block, _ := pem.Decode(t)
+		if block == nil || block.Type != ageArmorType {
+			return nil, errors.New("Invalid age armor")
+		}
+		file = block.Bytes
+	}
+	stanzas, header, mac, payload, err := parseAgeHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	var fileKey []byte
+	for _, s := range stanzas {
+		if fileKey, err = d.unwrap(s, len(stanzas)); err != nil {
+			return nil, err
+		}
+		if fileKey != nil {
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, errors.New("No matching age identity or passphrase")
+	}
+	h := hmac.New(sha256.New, hkdfSHA256(fileKey, nil, "header", 32))
+	h.Write(header)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return nil, errors.New("Invalid age header MAC")
+	}
+	if len(payload) < 16 {
+		return nil, errors.New("Invalid age payload")
+	}
+	var key [32]byte
+	copy(key[:], hkdfSHA256(fileKey, payload[:16], "payload", 32))
+	payload = payload[16:]
+	var out []byte
+	var nonce [12]byte
+	for counter := uint64(0); ; counter++ {
+		n := ageChunkSize + 16
+		last := len(payload) <= n
+		if last {
+			n = len(payload)
+			nonce[11] = 1
+		}
+		binary.BigEndian.PutUint64(nonce[3:11], counter)
+		chunk, err := chacha20Poly1305Open(&key, &nonce, payload[:n])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+		payload = payload[n:]
+		if last {
+			return out, nil
+		}
+	}
+}
+
+// unwrap returns the file key from the stanza,
+// or nil when it isn't for this decrypter
+func (d *AgeDecrypter) unwrap(s *ageStanza, count int) ([]byte, error) {
+	var key [32]byte
+	switch {
+	case len(s.args) == 2 && s.args[0] == "X25519":
+		share, err := base64.RawStdEncoding.Strict().DecodeString(s.args[1])
+		if err != nil || len(share) != 32 {
+			return nil, errors.New("Invalid age X25519 stanza")
+		}
+		var theirs, shared, ours [32]byte
+		copy(theirs[:], share)
+		for _, id := range d.identities {
+			curve25519.ScalarMult(&shared, &id, &theirs)
+			if shared == [32]byte{} {
+				return nil, errors.New("Invalid age X25519 share")
+			}
+			curve25519.ScalarBaseMult(&ours, &id)
+			salt := append(append([]byte{}, share...), ours[:]...)
+			copy(key[:], hkdfSHA256(shared[:], salt, "age-encryption.org/v1/X25519", 32))
+			if fileKey, err := ageUnwrapKey(&key, s.body); err == nil {
+				return fileKey, nil
+			}
+		}
+	case len(s.args) == 3 && s.args[0] == "scrypt" && d.passphrase != "":
+		if count != 1 {
+			return nil, errors.New("An age scrypt stanza must be the only stanza")
+		}
+		salt, err := base64.RawStdEncoding.Strict().DecodeString(s.args[1])
+		if err != nil || len(salt) != 16 {
+			return nil, errors.New("Invalid age scrypt stanza")
+		}
+		logN, err := strconv.Atoi(s.args[2])
+		if err != nil || logN <= 0 || logN > ageMaxScryptLogN || s.args[2] != strconv.Itoa(logN) {
+			return nil, errors.New("Invalid or too expensive age scrypt work factor")
+		}
+		salt = append([]byte("age-encryption.org/v1/scrypt"), salt...)
+		derived, err := scrypt.Key([]byte(d.passphrase), salt, 1<<uint(logN), 8, 1, 32)
+		if err != nil {
+			return nil, err
+		}
+		copy(key[:], derived)
+		fileKey, err := ageUnwrapKey(&key, s.body)
+		if err != nil {
+			return nil, errors.New("Incorrect age passphrase")
+		}
+		return fileKey, nil
+	}
+	return nil, nil
+}
+
+func ageUnwrapKey(key *[32]byte, body []byte) ([]byte, error) {
+	if len(body) != 32 {
+		return nil, errors.New("Invalid age file key")
+	}
+	return chacha20Poly1305Open(key, &[12]byte{}, body)
+}
+
+// parseAgeHeader splits an age file into its stanzas, the
+// header bytes covered by the MAC, the MAC and the payload
+func parseAgeHeader(file []byte) ([]*ageStanza, []byte, []byte, []byte, error) {
+	invalid := errors.New("Invalid age header")
+	if !bytes.HasPrefix(file, []byte(ageIntro)) {
+		return nil, nil, nil, nil, errors.New("Unsupported age version")
+	}
+	var stanzas []*ageStanza
+	var current *ageStanza
+	rest := file[len(ageIntro):]
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return nil, nil, nil, nil, invalid
+		}
+		line := string(rest[:i])
+		offset := len(file) - len(rest)
+		rest = rest[i+1:]
+		if current != nil {
+			b, err := base64.RawStdEncoding.Strict().DecodeString(line)
+			if err != nil || len(line) > 64 {
+				return nil, nil, nil, nil, invalid
+			}
+			current.body = append(current.body, b...)
+			if len(line) < 64 {
+				current = nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "--- ") {
+			mac, err := base64.RawStdEncoding.Strict().DecodeString(line[4:])
+			if err != nil || len(stanzas) == 0 {
+				return nil, nil, nil, nil, invalid
+			}
+			return stanzas, file[:offset+3], mac, rest, nil
+		}
+		if !strings.HasPrefix(line, "-> ") {
+			return nil, nil, nil, nil, invalid
+		}
+		current = &ageStanza{args: strings.Split(line[3:], " ")}
+		stanzas = append(stanzas, current)
+	}
+}
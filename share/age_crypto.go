@@ -0,0 +1,97 @@
+package chshare
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The primitives used by age, ChaCha20-Poly1305 and HKDF-SHA-256
+// of golang.org/x/crypto (and its scrypt), and Bech32
+
+var errAgeDecrypt = errors.New("Decryption failed")
+
+// chacha20Poly1305Open decrypts and authenticates
+// a ciphertext sealed without additional data
+func chacha20Poly1305Open(key *[32]byte, nonce *[12]byte, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce[:], sealed, nil)
+	if err != nil {
+		return nil, errAgeDecrypt
+	}
+	return plaintext, nil
+}
+
+func hkdfSHA256(secret, salt []byte, info string, n int) []byte {
+	out := make([]byte, n)
+	//only fails beyond 255 blocks of output
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out)
+	return out
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Decode returns the human-readable part and data of s
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("Mixed case Bech32 string")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("Invalid Bech32 string")
+	}
+	hrp := s[:pos]
+	var values []byte
+	for _, h := range hrp {
+		values = append(values, byte(h>>5))
+	}
+	values = append(values, 0)
+	for _, h := range hrp {
+		values = append(values, byte(h&31))
+	}
+	var data []byte
+	for _, c := range s[pos+1:] {
+		i := strings.IndexRune(bech32Charset, c)
+		if i < 0 {
+			return "", nil, errors.New("Invalid Bech32 character")
+		}
+		data = append(data, byte(i))
+	}
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range append(values, data...) {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	if chk != 1 {
+		return "", nil, errors.New("Invalid Bech32 checksum")
+	}
+	//convert from 5 to 8 bit groups
+	var out []byte
+	acc, n := uint32(0), uint(0)
+	for _, v := range data[:len(data)-6] {
+		acc = acc<<5 | uint32(v)
+		n += 5
+		if n >= 8 {
+			n -= 8
+			out = append(out, byte(acc>>n))
+		}
+	}
+	if n >= 5 || acc&(1<<n-1) != 0 {
+		return "", nil, errors.New("Invalid Bech32 padding")
+	}
+	return hrp, out, nil
+}
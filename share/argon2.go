@@ -0,0 +1,103 @@
+package chshare
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+	//defaults follow the RFC 9106 second recommended option
+	argon2DefaultTime    = 3
+	argon2DefaultMemory  = 64 * 1024
+	argon2DefaultThreads = 4
+	//hashes beyond these bounds are rejected, as each login
+	//would cost the server too much memory or time
+	argon2MaxTime    = 16
+	argon2MaxMemory  = 1024 * 1024
+	argon2MaxThreads = 64
+)
+
+type argon2Params struct {
+	time, memory uint32
+	threads      uint8
+}
+
+func argon2idHash(pass string, p argon2Params) (string, error) {
+	if p.time == 0 {
+		p.time = argon2DefaultTime
+	}
+	if p.memory == 0 {
+		p.memory = argon2DefaultMemory
+	}
+	if p.threads == 0 {
+		p.threads = argon2DefaultThreads
+	}
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pass), salt, p.time, p.memory, p.threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func argon2idVerify(hash, pass string) (bool, error) {
+	p, salt, key, err := argon2idDecode(hash)
+	if err != nil {
+		return false, err
+	}
+	got := argon2.IDKey([]byte(pass), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+// argon2idDecode parses "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>"
+func argon2idDecode(hash string) (p argon2Params, salt, key []byte, err error) {
+	invalid := errors.New("Invalid argon2id hash")
+	parts := splitDollar(hash)
+	if len(parts) != 5 || parts[0] != "argon2id" {
+		return p, nil, nil, invalid
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[1], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, invalid
+	}
+	if _, err := fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, invalid
+	}
+	if p.time == 0 || p.time > argon2MaxTime ||
+		p.threads == 0 || p.threads > argon2MaxThreads ||
+		p.memory < 8*uint32(p.threads) || p.memory > argon2MaxMemory {
+		return p, nil, nil, invalid
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return p, nil, nil, invalid
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(key) == 0 {
+		return p, nil, nil, invalid
+	}
+	return p, salt, key, nil
+}
+
+func splitDollar(s string) []string {
+	var parts []string
+	if len(s) == 0 || s[0] != '$' {
+		return nil
+	}
+	start := 1
+	for i := 1; i <= len(s); i++ {
+		if i == len(s) || s[i] == '$' {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return parts
+}
@@ -0,0 +1,54 @@
+package chshare
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	bcryptMinCost     = bcrypt.MinCost
+	bcryptMaxCost     = bcrypt.MaxCost
+	bcryptDefaultCost = bcrypt.DefaultCost
+)
+
+func bcryptHash(pass string, cost int) (string, error) {
+	if cost == 0 {
+		cost = bcryptDefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// bcryptDecode checks "$2a$10$<22 char salt><31 char hash>",
+// returning its cost
+func bcryptDecode(hash string) (int, error) {
+	invalid := errors.New("Invalid bcrypt hash")
+	if len(hash) != 60 || hash[0] != '$' || hash[1] != '2' || hash[3] != '$' || hash[6] != '$' {
+		return 0, invalid
+	}
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return 0, invalid
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil || cost < bcryptMinCost || cost > bcryptMaxCost {
+		return 0, invalid
+	}
+	return cost, nil
+}
+
+func bcryptVerify(hash, pass string) (bool, error) {
+	if _, err := bcryptDecode(hash); err != nil {
+		return false, err
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
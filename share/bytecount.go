@@ -0,0 +1,64 @@
+package chshare
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// ByteCounter counts the bytes read from and
+// written to the connections it tracks
+type ByteCounter struct {
+	read    int64
+	written int64
+	//parent (optional) also counts the bytes
+	parent *ByteCounter
+}
+
+// NewByteCounter creates a ByteCounter which
+// adds its bytes to the parent's (when not nil)
+func NewByteCounter(parent *ByteCounter) *ByteCounter {
+	return &ByteCounter{parent: parent}
+}
+
+func (c *ByteCounter) add(read, written int64) {
+	for ; c != nil; c = c.parent {
+		atomic.AddInt64(&c.read, read)
+		atomic.AddInt64(&c.written, written)
+	}
+}
+
+// Count returns rwc, counting the bytes read and written
+// (or rwc unchanged when the counter is nil)
+func (c *ByteCounter) Count(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	if c == nil {
+		return rwc
+	}
+	return &countedRWC{ReadWriteCloser: rwc, counter: c}
+}
+
+// BytesRead returns the bytes read so far
+func (c *ByteCounter) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+// BytesWritten returns the bytes written so far
+func (c *ByteCounter) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+type countedRWC struct {
+	io.ReadWriteCloser
+	counter *ByteCounter
+}
+
+func (c *countedRWC) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.counter.add(int64(n), 0)
+	return n, err
+}
+
+func (c *countedRWC) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.counter.add(0, int64(n))
+	return n, err
+}
@@ -8,8 +8,14 @@ import (
 type Config struct {
 	Version string
 	Remotes []*Remote
+	//ClientID optionally identifies the client, see the client's --id
+	ClientID string `json:",omitempty"`
 }
 
+// MaintenanceError rejects the config of clients connecting to
+// a server in maintenance mode, which then retry later
+const MaintenanceError = "Server is in maintenance mode, retrying later"
+
 func DecodeConfig(b []byte) (*Config, error) {
 	c := &Config{}
 	err := json.Unmarshal(b, c)
@@ -0,0 +1,61 @@
+package chshare
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// H2ProtocolHeader carries the protocol version of tunnels over
+// HTTP/2 streams (or polling requests), in place of the websocket
+// subprotocol
+const H2ProtocolHeader = "Chisel-Protocol"
+
+// PollHeader carries the ID of a tunnel over polling requests,
+// or "open" to open one
+const PollHeader = "Chisel-Poll"
+
+// httpStream carries the tunnel over the request and response
+// bodies of an HTTP/2 stream, reading one and writing the other
+type httpStream struct {
+	io.ReadCloser
+	mut    sync.Mutex
+	w      io.Writer
+	flush  func() error
+	closeW func() error
+	closed bool
+}
+
+// NewHTTPStreamConn creates a net.Conn reading the body and
+// writing to w, flushing each write (when flush is set) and
+// closing w with closeW (when set)
+func NewHTTPStreamConn(body io.ReadCloser, w io.Writer, flush, closeW func() error) net.Conn {
+	return NewRWCConn(&httpStream{ReadCloser: body, w: w, flush: flush, closeW: closeW})
+}
+
+func (s *httpStream) Write(b []byte) (int, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	//server responses can't be written once closed
+	if s.closed {
+		return 0, errors.New("stream closed")
+	}
+	n, err := s.w.Write(b)
+	if err == nil && s.flush != nil {
+		err = s.flush()
+	}
+	return n, err
+}
+
+func (s *httpStream) Close() error {
+	//closing the request body unblocks any client write
+	if s.closeW != nil {
+		s.closeW()
+	}
+	err := s.ReadCloser.Close()
+	s.mut.Lock()
+	s.closed = true
+	s.mut.Unlock()
+	return err
+}
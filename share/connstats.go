@@ -22,6 +22,16 @@ func (c *ConnStats) Close() {
 	atomic.AddInt32(&c.open, -1)
 }
 
+// Total returns the number of connections so far
+func (c *ConnStats) Total() int32 {
+	return atomic.LoadInt32(&c.count)
+}
+
+// Active returns the number of open connections
+func (c *ConnStats) Active() int32 {
+	return atomic.LoadInt32(&c.open)
+}
+
 func (c *ConnStats) String() string {
 	return fmt.Sprintf("[%d/%d]", atomic.LoadInt32(&c.open), atomic.LoadInt32(&c.count))
 }
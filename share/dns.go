@@ -0,0 +1,47 @@
+package chshare
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// DNSRemote is the remote of the streams of dns
+// remotes (suffixed with /udp for their queries over udp)
+const DNSRemote = "dns"
+
+// DNSResolver returns the address of the host's resolver, the first
+// nameserver of /etc/resolv.conf (or else 127.0.0.1:53), to which
+// the queries of dns remotes are forwarded
+func DNSResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			//without any zone, as of fe80::1%eth0
+			host := strings.SplitN(fields[1], "%", 2)[0]
+			if net.ParseIP(host) != nil {
+				return net.JoinHostPort(host, "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// DNSStreamRemote returns the remote of a stream (as requested by its
+// channel), where the streams of dns remotes are sent to the resolver
+func DNSStreamRemote(remote string) string {
+	switch remote {
+	case DNSRemote:
+		return DNSResolver()
+	case DNSRemote + udpSuffix:
+		return DNSResolver() + udpSuffix
+	}
+	return remote
+}
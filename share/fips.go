@@ -0,0 +1,91 @@
+package chshare
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// fips is set in builds with the fips tag, or by SetFIPS
+var fips = fipsBuild
+
+// SetFIPS enables FIPS mode for the process, which is always enabled
+// in builds with the fips tag (go build -tags fips). In FIPS mode, the
+// tunnel's SSH and TLS connections are restricted to FIPS 140 approved
+// algorithms, and keys can't be derived from a seed
+func SetFIPS() {
+	fips = true
+}
+
+// FIPS reports whether FIPS mode is enabled
+func FIPS() bool {
+	return fips
+}
+
+// The FIPS approved SSH algorithms, see SSHAlgorithms.Apply
+var (
+	fipsSSHCiphers = []string{
+		"aes128-gcm@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+	}
+	fipsSSHKeyExchanges = []string{
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+	}
+	fipsSSHMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+	}
+)
+
+var (
+	fipsTLSCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	fipsTLSCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+)
+
+// FIPSTLS restricts the TLS config to FIPS approved versions, cipher
+// suites and curves in FIPS mode, failing when it allows others. Those
+// it doesn't set default to the approved ones. TLS 1.3 cipher suites
+// can't be restricted, though are all AES-GCM once the Go runtime's
+// own FIPS mode is enabled too (GODEBUG=fips140=on)
+func FIPSTLS(c *tls.Config) error {
+	if !fips {
+		return nil
+	}
+	if c.MinVersion == 0 {
+		c.MinVersion = tls.VersionTLS12
+	} else if c.MinVersion < tls.VersionTLS12 {
+		return fmt.Errorf("TLS versions below 1.2 are not allowed in FIPS mode")
+	}
+	if len(c.CipherSuites) == 0 {
+		c.CipherSuites = fipsTLSCipherSuites
+	}
+	for _, id := range c.CipherSuites {
+		if !containsUint16(fipsTLSCipherSuites, id) {
+			return fmt.Errorf("TLS cipher suite %s is not allowed in FIPS mode", tls.CipherSuiteName(id))
+		}
+	}
+	if len(c.CurvePreferences) == 0 {
+		c.CurvePreferences = fipsTLSCurves
+	}
+	for _, curve := range c.CurvePreferences {
+		found := false
+		for _, f := range fipsTLSCurves {
+			found = found || f == curve
+		}
+		if !found {
+			return fmt.Errorf("TLS curve %s is not allowed in FIPS mode", curve)
+		}
+	}
+	return nil
+}
+
+func containsUint16(list []uint16, v uint16) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package chshare
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FlagSetting is the value of a flag in a flag file
+type FlagSetting struct {
+	Name  string
+	Value string
+	Line  int
+}
+
+// ReadFlagFile reads a YAML file mapping flag names to their values,
+// or to lists of values for repeatable flags, like:
+//
+//	port: 443
+//	listen:
+//	  - 0.0.0.0:443
+//	  - unix:/run/chisel.sock
+//	tls:
+//	  key: /etc/chisel/key.pem
+//	  cert: /etc/chisel/cert.pem
+//
+// where keys grouped under another (like tls) are prefixed with its
+// name (so tls-key). Only this simple subset of YAML is supported
+func ReadFlagFile(path string) ([]FlagSetting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var settings []FlagSetting
+	//parent is the last top level key without a value,
+	//whose children are either list items or grouped keys
+	parent, parentLine, children, list := "", 0, 0, false
+	missing := func() error {
+		if parent != "" && children == 0 {
+			return fmt.Errorf("%s:%d: missing value of '%s'", path, parentLine, parent)
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripYAMLComment(scanner.Text())
+		text := strings.TrimSpace(line)
+		if text == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("%s:%d: indent with spaces, not tabs", path, n)
+		}
+		indented := line[0] == ' '
+		//list items
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			if parent == "" || (children > 0 && !list) {
+				return nil, fmt.Errorf("%s:%d: list item without a key", path, n)
+			}
+			list = true
+			v, err := unquoteYAML(strings.TrimSpace(strings.TrimPrefix(text, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+			settings = append(settings, FlagSetting{Name: parent, Value: v, Line: n})
+			children++
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 || (i+1 < len(text) && text[i+1] != ' ') {
+			return nil, fmt.Errorf("%s:%d: expected <key>: <value>", path, n)
+		}
+		key, value := text[:i], strings.TrimSpace(text[i+1:])
+		if indented {
+			if parent == "" || list {
+				return nil, fmt.Errorf("%s:%d: unexpected indent", path, n)
+			}
+			key = parent + "-" + key
+			children++
+		} else {
+			if err := missing(); err != nil {
+				return nil, err
+			}
+			parent, parentLine, children, list = "", 0, 0, false
+			if value == "" {
+				parent, parentLine = key, n
+				continue
+			}
+		}
+		if value == "" {
+			return nil, fmt.Errorf("%s:%d: missing value of '%s'", path, n, key)
+		}
+		//inline lists, like [a, b]
+		values := []string{value}
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			values = strings.Split(value[1:len(value)-1], ",")
+		}
+		for _, v := range values {
+			v, err := unquoteYAML(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+			settings = append(settings, FlagSetting{Name: key, Value: v, Line: n})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := missing(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// stripYAMLComment removes a # comment (at the start of
+// the line or after a space) which isn't inside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return strings.TrimRight(line[:i], " ")
+		}
+	}
+	return line
+}
+
+func unquoteYAML(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("invalid quoted value %s", v)
+		}
+		return strings.Replace(v[1:len(v)-1], "''", "'", -1), nil
+	}
+	return v, nil
+}
@@ -1,6 +1,7 @@
 package chshare
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
@@ -11,7 +12,7 @@ import (
 //adds graceful shutdowns
 type HTTPServer struct {
 	*http.Server
-	listener  net.Listener
+	listeners []net.Listener
 	running   chan error
 	isRunning bool
 	closer    sync.Once
@@ -20,9 +21,8 @@ type HTTPServer struct {
 //NewHTTPServer creates a new HTTPServer
 func NewHTTPServer() *HTTPServer {
 	return &HTTPServer{
-		Server:   &http.Server{},
-		listener: nil,
-		running:  make(chan error, 1),
+		Server:  &http.Server{},
+		running: make(chan error, 1),
 	}
 }
 
@@ -31,26 +31,42 @@ func (h *HTTPServer) GoListenAndServe(addr string, handler http.Handler) error {
 	if err != nil {
 		return err
 	}
+	if h.TLSConfig != nil {
+		l = tls.NewListener(l, h.TLSConfig)
+	}
+	h.GoServe(handler, l)
+	return nil
+}
+
+//GoServe serves the handler on each of the listeners,
+//until one of them fails or the server is closed
+func (h *HTTPServer) GoServe(handler http.Handler, listeners ...net.Listener) {
 	h.isRunning = true
 	h.Handler = handler
-	h.listener = l
-	go func() {
-		h.closeWith(h.Serve(l))
-	}()
-	return nil
+	h.listeners = listeners
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			h.closeWith(h.Serve(l))
+		}(l)
+	}
 }
 
 func (h *HTTPServer) closeWith(err error) {
-	if !h.isRunning {
-		return
-	}
-	h.isRunning = false
-	h.running <- err
+	h.closer.Do(func() {
+		h.isRunning = false
+		h.running <- err
+	})
 }
 
 func (h *HTTPServer) Close() error {
 	h.closeWith(nil)
-	return h.listener.Close()
+	var err error
+	for _, l := range h.listeners {
+		if e := l.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (h *HTTPServer) Wait() error {
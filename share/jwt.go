@@ -0,0 +1,327 @@
+package chshare
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTClaims are the decoded claims of a verified token
+type JWTClaims map[string]interface{}
+
+// String returns the claim as a string (or "" when missing)
+func (c JWTClaims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim which is either a list of strings or a
+// space separated string (as used by the OAuth2 "scope" claim)
+func (c JWTClaims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var out []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// JWTVerifier validates JSON Web Tokens, signed either using
+// a shared HMAC secret or a key found in a JWKS document
+type JWTVerifier struct {
+	Secret   []byte
+	JWKSURL  string
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+	Client   *http.Client
+	lock     sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+}
+
+const jwksRefreshInterval = time.Hour
+
+// IsJWT reports whether s looks like a compact serialised JWT
+func IsJWT(s string) bool {
+	return strings.Count(s, ".") == 2 && strings.HasPrefix(s, "eyJ")
+}
+
+// Verify checks the token signature and its registered
+// claims, returning all claims when the token is valid
+func (v *JWTVerifier) Verify(token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Invalid token header: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Invalid token signature encoding")
+	}
+	if err := v.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	claims := JWTClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Invalid token claims: %s", err)
+	}
+	if err := v.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// SignJWT serialises the claims as a token signed
+// with the HMAC secret using HS256
+func SignJWT(claims JWTClaims, secret []byte) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(crypto.SHA256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (v *JWTVerifier) verifyClaims(claims JWTClaims) error {
+	now := time.Now()
+	leeway := v.Leeway
+	if leeway == 0 {
+		leeway = 30 * time.Second
+	}
+	numeric := func(name string) (time.Time, bool) {
+		f, ok := claims[name].(float64)
+		if !ok {
+			return time.Time{}, false
+		}
+		return time.Unix(int64(f), 0), true
+	}
+	exp, ok := numeric("exp")
+	if !ok {
+		return errors.New("Token has no expiry")
+	}
+	if now.After(exp.Add(leeway)) {
+		return errors.New("Token expired")
+	}
+	if nbf, ok := numeric("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return errors.New("Token not yet valid")
+	}
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return errors.New("Token issuer mismatch")
+	}
+	if v.Audience != "" {
+		found := false
+		for _, aud := range claims.Strings("aud") {
+			if aud == v.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("Token audience mismatch")
+		}
+	}
+	return nil
+}
+
+func (v *JWTVerifier) verifySignature(alg, kid string, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("Unsupported token algorithm: %s", alg)
+	}
+	var ch crypto.Hash
+	switch alg[2:] {
+	case "256":
+		ch = crypto.SHA256
+	case "384":
+		ch = crypto.SHA384
+	case "512":
+		ch = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported token algorithm: %s", alg)
+	}
+	switch alg[:2] {
+	case "HS":
+		if len(v.Secret) == 0 {
+			return errors.New("HMAC signed tokens are not accepted")
+		}
+		mac := hmac.New(ch.New, v.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("Invalid token signature")
+		}
+		return nil
+	case "RS", "ES":
+		key, err := v.key(kid)
+		if err != nil {
+			return err
+		}
+		d := ch.New()
+		d.Write(signed)
+		digest := d.Sum(nil)
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if alg[:2] == "RS" && rsa.VerifyPKCS1v15(k, ch, digest, sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if alg[:2] == "ES" && len(sig) == 2*size {
+				r := new(big.Int).SetBytes(sig[:size])
+				s := new(big.Int).SetBytes(sig[size:])
+				if ecdsa.Verify(k, digest, r, s) {
+					return nil
+				}
+			}
+		}
+		return errors.New("Invalid token signature")
+	}
+	return fmt.Errorf("Unsupported token algorithm: %s", alg)
+}
+
+// key returns the JWKS key with the given ID, refreshing
+// the key set when the ID is unknown or the set is stale
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	if v.JWKSURL == "" {
+		return nil, errors.New("Asymmetrically signed tokens are not accepted")
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	key, found := v.keys[kid]
+	stale := time.Since(v.fetched) > jwksRefreshInterval
+	//rate limit refreshes caused by unknown key IDs
+	if stale || (!found && time.Since(v.fetched) > time.Minute) {
+		keys, err := v.fetchKeys()
+		if err != nil {
+			if !found {
+				return nil, &JWKSError{err}
+			}
+		} else {
+			v.keys = keys
+			v.fetched = time.Now()
+			key, found = v.keys[kid]
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown token key ID: %s", kid)
+	}
+	return key, nil
+}
+
+// JWKSError is the error of a token which couldn't be verified
+// as the JWKS couldn't be fetched (rather than being invalid)
+type JWKSError struct {
+	Err error
+}
+
+func (e *JWKSError) Error() string {
+	return e.Err.Error()
+}
+
+func (v *JWTVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Get(v.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch JWKS: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("Invalid JWKS: %s", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
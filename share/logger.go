@@ -2,10 +2,20 @@ package chshare
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
 
+// logOutput is written by new loggers, see SetLogOutput
+var logOutput io.Writer = os.Stdout
+
+// SetLogOutput sets the output of loggers created from now on,
+// like os.Stderr when stdout carries a tunnel
+func SetLogOutput(w io.Writer) {
+	logOutput = w
+}
+
 //Logger is ...
 type Logger struct {
 	prefix      string
@@ -20,7 +30,7 @@ func NewLogger(prefix string) *Logger {
 func NewLoggerFlag(prefix string, flag int) *Logger {
 	l := &Logger{
 		prefix: prefix,
-		logger: log.New(os.Stdout, "", flag),
+		logger: log.New(logOutput, "", flag),
 		Info:   false,
 		Debug:  false,
 	}
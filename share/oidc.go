@@ -0,0 +1,40 @@
+package chshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OIDCProvider is the OpenID Connect discovery
+// document of an issuer (the fields used by chisel)
+type OIDCProvider struct {
+	Issuer                      string `json:"issuer"`
+	JWKSURI                     string `json:"jwks_uri"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// DiscoverOIDC fetches the issuer's
+// /.well-known/openid-configuration
+func DiscoverOIDC(issuer string) (*OIDCProvider, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery failed: %s", resp.Status)
+	}
+	p := &OIDCProvider{}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, fmt.Errorf("Invalid OIDC discovery document: %s", err)
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("OIDC issuer mismatch (%s)", p.Issuer)
+	}
+	return p, nil
+}
@@ -0,0 +1,71 @@
+package chshare
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// Supported password hashing algorithms
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// HashPassword hashes pass using the given algorithm
+// (bcrypt or argon2id) with the default cost parameters
+func HashPassword(pass, algo string) (string, error) {
+	switch algo {
+	case HashBcrypt:
+		return bcryptHash(pass, bcryptDefaultCost)
+	case HashArgon2id:
+		return argon2idHash(pass, argon2Params{})
+	}
+	return "", fmt.Errorf("Unknown hash algorithm: %s", algo)
+}
+
+// IsPasswordHash detects, by prefix, whether the
+// stored password is a bcrypt or argon2id hash
+func IsPasswordHash(stored string) bool {
+	return passwordHashAlgo(stored) != ""
+}
+
+func passwordHashAlgo(stored string) string {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"),
+		strings.HasPrefix(stored, "$2b$"),
+		strings.HasPrefix(stored, "$2y$"):
+		return HashBcrypt
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return HashArgon2id
+	}
+	return ""
+}
+
+// ValidatePassword ensures a stored password hash is well formed
+func ValidatePassword(stored string) error {
+	var err error
+	switch passwordHashAlgo(stored) {
+	case HashBcrypt:
+		_, err = bcryptDecode(stored)
+	case HashArgon2id:
+		_, _, _, err = argon2idDecode(stored)
+	}
+	return err
+}
+
+// CheckPassword compares pass against the stored password,
+// which may either be plaintext or a bcrypt/argon2id hash
+func CheckPassword(stored, pass string) bool {
+	var ok bool
+	var err error
+	switch passwordHashAlgo(stored) {
+	case HashBcrypt:
+		ok, err = bcryptVerify(stored, pass)
+	case HashArgon2id:
+		ok, err = argon2idVerify(stored, pass)
+	default:
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1
+	}
+	return err == nil && ok
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
@@ -18,12 +19,30 @@ type TCPProxy struct {
 	id     int
 	count  int
 	remote *Remote
+	// RateLimiters limit the bytes sent and received by the proxy
+	RateLimiters []*RateLimiter
+	// Activity (optional) tracks the proxy's connections
+	Activity *Activity
+	// Stats and Bytes (optional) count the proxy's
+	// connections and the bytes sent through them
+	Stats *ConnStats
+	Bytes *ByteCounter
+	// Listener (optional) is already bound to the remote's address
+	Listener net.Listener
+	// UDP configures the flows of udp remotes
+	UDP UDPOptions
+	// SocksAuth (<user>:<pass>) authenticates the SOCKS5
+	// requests of transparent remotes, when required
+	SocksAuth string
+	// tproxy is set when a transparent remote's
+	// listener accepts TPROXY-ed connections
+	tproxy bool
 }
 
 func NewTCPProxy(logger *Logger, ssh GetSSHConn, index int, remote *Remote) *TCPProxy {
 	id := index + 1
 	return &TCPProxy{
-		Logger: logger.Fork("proxy#%d:%s", id, remote),
+		Logger: logger.Fork("proxy#%d:%s", id, remote.Label()),
 		ssh:    ssh,
 		id:     id,
 		remote: remote,
@@ -31,14 +50,59 @@ func NewTCPProxy(logger *Logger, ssh GetSSHConn, index int, remote *Remote) *TCP
 }
 
 func (p *TCPProxy) Start(ctx context.Context) error {
-	l, err := net.Listen("tcp4", p.remote.LocalHost+":"+p.remote.LocalPort)
-	if err != nil {
-		return fmt.Errorf("%s: %s", p.Logger.Prefix(), err)
+	if p.remote.UDP {
+		return p.startUDP(ctx)
+	}
+	//dns remotes take queries over both
+	if p.remote.DNS {
+		if err := p.startUDP(ctx); err != nil {
+			return err
+		}
+	}
+	l := p.Listener
+	if l == nil && p.remote.Transparent {
+		var err error
+		if l, p.tproxy, err = listenTransparent(p.remote.LocalHost + ":" + p.remote.LocalPort); err != nil {
+			return fmt.Errorf("%s: %s", p.Logger.Prefix(), err)
+		}
+	} else if l == nil && p.remote.LocalSocket != "" {
+		var err error
+		if l, err = listenSocket(p.remote.LocalSocket); err != nil {
+			return fmt.Errorf("%s: %s", p.Logger.Prefix(), err)
+		}
+	} else if l == nil {
+		var err error
+		l, err = net.Listen("tcp4", p.remote.LocalHost+":"+p.remote.LocalPort)
+		if err != nil {
+			return fmt.Errorf("%s: %s", p.Logger.Prefix(), err)
+		}
 	}
 	go p.listen(ctx, l)
 	return nil
 }
 
+// listenSocket listens on the unix socket, which only its owner
+// may connect to, replacing the socket of an earlier listener
+// which is gone (though not one still in use)
+func listenSocket(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
 func (p *TCPProxy) listen(ctx context.Context, l net.Listener) {
 	p.Infof("Listening")
 	done := make(chan struct{})
@@ -66,6 +130,28 @@ func (p *TCPProxy) listen(ctx context.Context, l net.Listener) {
 	}
 }
 
+// ServeStdio pipes stdin and stdout through a stream of the
+// remote, returning once they (or the stream) are closed
+func (p *TCPProxy) ServeStdio() {
+	p.accept(stdio{})
+}
+
+// stdio is the process's stdin and stdout
+type stdio struct{}
+
+func (stdio) Read(b []byte) (int, error) {
+	return os.Stdin.Read(b)
+}
+
+func (stdio) Write(b []byte) (int, error) {
+	return os.Stdout.Write(b)
+}
+
+func (stdio) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
 func (p *TCPProxy) accept(src io.ReadWriteCloser) {
 	defer src.Close()
 	p.count++
@@ -77,14 +163,38 @@ func (p *TCPProxy) accept(src io.ReadWriteCloser) {
 		l.Debugf("No remote connection")
 		return
 	}
+	//transparent remotes are socks requests
+	//of the connection's original destination
+	remote, addr := p.remote.Remote(), ""
+	if p.remote.Transparent {
+		var err error
+		if addr, err = originalDst(src.(net.Conn), p.tproxy, p.remote.LocalPort); err != nil {
+			l.Infof("Transparent error: %s", err)
+			return
+		}
+		remote = "socks"
+	}
 	//ssh request for tcp connection for this proxy's remote
-	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(p.remote.Remote()))
+	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(remote))
 	if err != nil {
 		l.Infof("Stream error: %s", err)
 		return
 	}
 	go ssh.DiscardRequests(reqs)
+	if addr != "" {
+		if err := SocksConnect(dst, addr, p.SocksAuth); err != nil {
+			l.Infof("Stream error: %s: %s", addr, err)
+			dst.Close()
+			return
+		}
+		l.Debugf("Connected to %s", addr)
+	}
+	if p.Stats != nil {
+		p.Stats.New()
+		p.Stats.Open()
+		defer p.Stats.Close()
+	}
 	//then pipe
-	s, r := Pipe(src, dst)
+	s, r := Pipe(src, p.Bytes.Count(p.Activity.Track(LimitRate(dst, p.RateLimiters...))))
 	l.Debugf("Close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
 }
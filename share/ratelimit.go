@@ -0,0 +1,140 @@
+package chshare
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket which limits the bytes
+// per second passing through it, allowing bursts of up
+// to one second's worth of bytes
+type RateLimiter struct {
+	mut    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter of the given
+// bytes per second (0 is unlimited)
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	l := &RateLimiter{last: time.Now()}
+	l.SetRate(bytesPerSec)
+	return l
+}
+
+// SetRate changes the bytes per second of the limiter
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mut.Lock()
+	l.rate = float64(bytesPerSec)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.mut.Unlock()
+}
+
+// Rate returns the bytes per second of the limiter
+func (l *RateLimiter) Rate() int64 {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return int64(l.rate)
+}
+
+// Wait blocks until n bytes may pass through the limiter
+func (l *RateLimiter) Wait(n int) {
+	l.mut.Lock()
+	if l.rate <= 0 {
+		l.mut.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	//reserve the bytes, waiting out any shortfall
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mut.Unlock()
+	time.Sleep(wait)
+}
+
+// chunk is the largest read or write which is
+// passed through the limiter in one piece
+func (l *RateLimiter) chunk() int {
+	const min = 1024
+	if r := int(l.Rate() / 10); r > min {
+		return r
+	}
+	return min
+}
+
+// rateLimitedRWC passes the bytes read and
+// written through each of its limiters
+type rateLimitedRWC struct {
+	io.ReadWriteCloser
+	limiters []*RateLimiter
+}
+
+// LimitRate limits the bytes read from and written to rwc,
+// returning rwc unchanged when none of the limiters are set
+func LimitRate(rwc io.ReadWriteCloser, limiters ...*RateLimiter) io.ReadWriteCloser {
+	var set []*RateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			set = append(set, l)
+		}
+	}
+	if len(set) == 0 {
+		return rwc
+	}
+	return &rateLimitedRWC{ReadWriteCloser: rwc, limiters: set}
+}
+
+func (c *rateLimitedRWC) chunk() int {
+	n := c.limiters[0].chunk()
+	for _, l := range c.limiters[1:] {
+		if m := l.chunk(); m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+func (c *rateLimitedRWC) wait(n int) {
+	for _, l := range c.limiters {
+		l.Wait(n)
+	}
+}
+
+func (c *rateLimitedRWC) Read(p []byte) (int, error) {
+	if max := c.chunk(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := c.ReadWriteCloser.Read(p)
+	c.wait(n)
+	return n, err
+}
+
+func (c *rateLimitedRWC) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		b := p
+		if max := c.chunk(); len(b) > max {
+			b = b[:max]
+		}
+		c.wait(len(b))
+		n, err := c.ReadWriteCloser.Write(b)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
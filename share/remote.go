@@ -2,6 +2,7 @@ package chshare
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
 	"regexp"
 	"strings"
@@ -21,38 +22,142 @@ import (
 //     local  192.168.0.1:3000
 //     remote google.com:80
 
+//   ssh=R:2222:localhost:22 ->
+//     named ssh, labelling it in logs
+//   5353:1.1.1.1:53/udp ->
+//     local  127.0.0.1:5353 (udp)
+//     remote 1.1.1.1:53 (udp)
+//   R:/var/run/docker.sock:unix:/var/run/docker.sock ->
+//     local  unix:/var/run/docker.sock (on the server)
+//     remote unix:/var/run/docker.sock
+//   0.0.0.0:12345:transparent ->
+//     local  0.0.0.0:12345 (redirected by iptables)
+//     remote the original destination, via socks
+//   dns ->
+//     local  127.0.0.1:53 (udp and tcp)
+//     remote the other side's resolver
+
 type Remote struct {
 	LocalHost, LocalPort, RemoteHost, RemotePort string
 	Socks, Reverse                               bool
+	// Name (optional) labels the remote in logs
+	Name string
+	// UDP remotes relay datagrams, see UDPOptions
+	UDP bool
+	// LocalSocket and RemoteSocket are the paths of unix
+	// sockets, in place of the local or remote host and port
+	LocalSocket, RemoteSocket string
+	// Stdio remotes pipe the client's stdin and
+	// stdout, in place of listening, see ServeStdio
+	Stdio bool
+	// Transparent (socks) remotes accept connections redirected by
+	// iptables, connecting to their original destinations
+	Transparent bool
+	// DNS remotes forward DNS queries (over both udp and tcp) to the
+	// resolver of the other side, see DNSResolver (the server sets
+	// the remote host and port of forward remotes to its resolver)
+	DNS bool
 }
 
 const revPrefix = "R:"
 
+const udpSuffix = "/udp"
+
+const socketPrefix = "unix:"
+
+// UnixRemote returns the path of the remote of a unix socket
+// stream (as requested by its channel), rather than the port
+// of a host named unix
+func UnixRemote(remote string) (string, bool) {
+	if path := strings.TrimPrefix(remote, socketPrefix); path != remote && !isPort(path) {
+		return path, true
+	}
+	return remote, false
+}
+
+// UDPRemote returns the address of the remote of
+// a udp stream (as requested by its channel)
+func UDPRemote(remote string) (string, bool) {
+	if strings.HasSuffix(remote, udpSuffix) {
+		return strings.TrimSuffix(remote, udpSuffix), true
+	}
+	return remote, false
+}
+
+var remoteNameRegExp = regexp.MustCompile(`^[\w.-]+$`)
+
 func DecodeRemote(s string) (*Remote, error) {
+	name := ""
+	if i := strings.Index(s, "="); i >= 0 {
+		name, s = s[:i], s[i+1:]
+		if !remoteNameRegExp.MatchString(name) {
+			return nil, errors.New("Invalid name")
+		}
+	}
 	reverse := false
 	if strings.HasPrefix(s, revPrefix) {
 		s = strings.TrimPrefix(s, revPrefix)
 		reverse = true
 	}
-	parts := strings.Split(s, ":")
+	udp := false
+	if strings.HasSuffix(s, udpSuffix) {
+		s = strings.TrimSuffix(s, udpSuffix)
+		udp = true
+	}
+	parts := splitRemote(s)
 	if len(parts) <= 0 || len(parts) >= 5 {
 		return nil, errors.New("Invalid remote")
 	}
-	r := &Remote{Reverse: reverse}
+	r := &Remote{Reverse: reverse, Name: name, UDP: udp}
+	//unix sockets are the first (local) or last (remote) part
+	if path, ok := socketPath(parts[len(parts)-1]); ok && len(parts) > 1 {
+		r.RemoteSocket, parts = path, parts[:len(parts)-1]
+	}
+	if path, ok := socketPath(parts[0]); ok {
+		r.LocalSocket, parts = path, parts[1:]
+	}
+	if udp && (r.LocalSocket != "" || r.RemoteSocket != "") {
+		return nil, errors.New("unix sockets incompatible with udp")
+	}
+	if r.RemoteSocket != "" {
+		//the rest is the local address
+		switch {
+		case len(parts) == 0 && r.LocalSocket != "":
+		case len(parts) == 1 && isPort(parts[0]):
+			r.LocalPort = parts[0]
+		case len(parts) == 2 && isHost(parts[0]) && isPort(parts[1]):
+			r.LocalHost, r.LocalPort = parts[0], parts[1]
+		default:
+			return nil, errors.New("Invalid local address")
+		}
+		parts = nil
+	} else if len(parts) == 0 {
+		return nil, errors.New("Missing remote")
+	}
+	//keyword remotes ("socks", "transparent" or
+	//"dns") have no remote host and port
+	keyword := false
 	for i := len(parts) - 1; i >= 0; i-- {
 		p := parts[i]
-		//last part "socks"?
-		if i == len(parts)-1 && p == "socks" {
-			if reverse {
-				// TODO allow reverse+socks by having client
-				// automatically start local SOCKS5 server
-				return nil, errors.New("'socks' incompatible with reverse port forwarding")
+		//last part a keyword?
+		if i == len(parts)-1 && (p == "socks" || p == "transparent" || p == "dns") {
+			if udp {
+				return nil, fmt.Errorf("'%s' incompatible with udp", p)
+			}
+			if p == "transparent" && (reverse || r.LocalSocket != "") {
+				return nil, errors.New("'transparent' incompatible with reverse port forwarding and unix sockets")
 			}
-			r.Socks = true
+			if p == "dns" && r.LocalSocket != "" {
+				return nil, errors.New("'dns' incompatible with unix sockets")
+			}
+			r.Socks = p != "dns"
+			r.Transparent = p == "transparent"
+			r.DNS = p == "dns"
+			keyword = true
 			continue
 		}
 		if isPort(p) {
-			if !r.Socks && r.RemotePort == "" {
+			if !keyword && r.RemotePort == "" {
 				r.RemotePort = p
 				r.LocalPort = p
 			} else {
@@ -60,34 +165,65 @@ func DecodeRemote(s string) (*Remote, error) {
 			}
 			continue
 		}
-		if !r.Socks && (r.RemotePort == "" && r.LocalPort == "") {
+		if !keyword && (r.RemotePort == "" && r.LocalPort == "") {
 			return nil, errors.New("Missing ports")
 		}
 		if !isHost(p) {
 			return nil, errors.New("Invalid host")
 		}
-		if !r.Socks && r.RemoteHost == "" {
+		if !keyword && r.RemoteHost == "" {
 			r.RemoteHost = p
 		} else {
 			r.LocalHost = p
 		}
 	}
-	if r.LocalHost == "" {
-		if r.Socks {
+	if r.LocalSocket != "" {
+		r.LocalHost, r.LocalPort = "", ""
+	} else if r.LocalHost == "" {
+		if keyword {
 			r.LocalHost = "127.0.0.1"
 		} else {
 			r.LocalHost = "0.0.0.0"
 		}
 	}
-	if r.LocalPort == "" && r.Socks {
+	if r.LocalPort == "" && r.Socks && r.LocalSocket == "" {
 		r.LocalPort = "1080"
 	}
-	if !r.Socks && r.RemoteHost == "" {
+	if r.LocalPort == "" && r.DNS {
+		r.LocalPort = "53"
+	}
+	if !keyword && r.RemoteHost == "" && r.RemoteSocket == "" {
 		r.RemoteHost = "0.0.0.0"
 	}
 	return r, nil
 }
 
+// splitRemote splits the remote by colons, keeping unix: with the
+// socket path which follows it (though not a host named unix)
+func splitRemote(s string) []string {
+	var parts []string
+	for _, p := range strings.Split(s, ":") {
+		if n := len(parts); n > 0 && parts[n-1] == "unix" && !isPort(p) {
+			parts[n-1] += ":" + p
+			continue
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// socketPath returns the path of a unix socket,
+// given as an absolute path, or prefixed with unix:
+func socketPath(s string) (string, bool) {
+	if strings.HasPrefix(s, socketPrefix) && len(s) > len(socketPrefix) {
+		return strings.TrimPrefix(s, socketPrefix), true
+	}
+	if strings.HasPrefix(s, "/") {
+		return s, true
+	}
+	return "", false
+}
+
 var isPortRegExp = regexp.MustCompile(`^\d+$`)
 
 func isPort(s string) bool {
@@ -111,12 +247,66 @@ func (r *Remote) String() string {
 	if r.Reverse {
 		tag = revPrefix
 	}
-	return tag + r.LocalHost + ":" + r.LocalPort + "=>" + r.Remote()
+	return tag + r.LocalAddr() + "=>" + r.Remote()
+}
+
+// LocalAddr is the address on which the remote
+// listens, prefixed with unix: for sockets
+func (r *Remote) LocalAddr() string {
+	if r.Stdio {
+		return "stdio"
+	}
+	if r.LocalSocket != "" {
+		return socketPrefix + r.LocalSocket
+	}
+	return r.LocalHost + ":" + r.LocalPort
+}
+
+// Label is the remote prefixed with its name, if any
+func (r *Remote) Label() string {
+	if r.Name != "" {
+		return r.Name + "=" + r.String()
+	}
+	return r.String()
+}
+
+// UserAddr is the address checked against a user's
+// access list: the remote address, or the listening
+// address for reverse port forwarding (see ACLRule)
+func (r *Remote) UserAddr() string {
+	addr := r.RemoteHost + ":" + r.RemotePort
+	if r.RemoteSocket != "" {
+		addr = socketPrefix + r.RemoteSocket
+	}
+	if r.Reverse {
+		addr = r.LocalAddr()
+	}
+	//(queries of forward dns remotes are
+	//checked as sent to the resolver)
+	if r.UDP || r.DNS && !r.Reverse {
+		addr = udpPrefix + addr
+	}
+	if r.Reverse {
+		addr = revPrefix + addr
+	}
+	return addr
 }
 
 func (r *Remote) Remote() string {
+	if r.Transparent {
+		return "transparent"
+	}
+	if r.DNS {
+		return DNSRemote
+	}
 	if r.Socks {
 		return "socks"
 	}
+	if r.UDP {
+		return r.RemoteHost + ":" + r.RemotePort + udpSuffix
+	}
+	if r.RemoteSocket != "" {
+		return socketPrefix + r.RemoteSocket
+	}
 	return r.RemoteHost + ":" + r.RemotePort
 }
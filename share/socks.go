@@ -0,0 +1,158 @@
+package chshare
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	socks5 "github.com/armon/go-socks5"
+)
+
+// SocksServer serves the connections of socks remotes (not listening
+// on any port!), which are either SOCKS5 or HTTP proxy requests (CONNECT,
+// or of http:// URLs), both authenticated and permitted in the same way
+type SocksServer struct {
+	socks *socks5.Server
+	creds socks5.CredentialStore
+	rules socks5.RuleSet
+}
+
+// NewSocksServer creates a SocksServer of the SOCKS5 config,
+// whose Credentials and Rules also apply to HTTP proxy requests
+func NewSocksServer(config *socks5.Config) (*SocksServer, error) {
+	socks, err := socks5.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &SocksServer{socks: socks, creds: config.Credentials, rules: config.Rules}, nil
+}
+
+// sniffedConn is a connection whose first bytes were peeked
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ServeConn serves the SOCKS5 or HTTP proxy requests of the connection,
+// telling them apart by their first byte (the SOCKS version)
+func (s *SocksServer) ServeConn(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	conn = &sniffedConn{Conn: conn, r: r}
+	if b[0] == 5 {
+		return s.socks.ServeConn(conn)
+	}
+	defer conn.Close()
+	return s.serveHTTP(conn, r)
+}
+
+// serveHTTP serves an HTTP proxy request, piping a CONNECT request's
+// connection to its destination, or else forwarding the request (of an
+// http:// URL) and its response, after which the connection is closed
+func (s *SocksServer) serveHTTP(conn net.Conn, r *bufio.Reader) error {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return err
+	}
+	reply := func(code int, header string) error {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header)
+		return fmt.Errorf("HTTP proxy request of %s: %s", req.Host, http.StatusText(code))
+	}
+	auth := &socks5.AuthContext{Method: socks5.NoAuth, Payload: map[string]string{}}
+	if s.creds != nil {
+		user, pass, ok := proxyAuth(req)
+		if !ok || !s.creds.Valid(user, pass) {
+			return reply(http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"chisel\"\r\n")
+		}
+		auth = &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: map[string]string{"Username": user}}
+	}
+	connect := req.Method == http.MethodConnect
+	host := req.Host
+	if !connect {
+		if req.URL.Scheme != "http" {
+			return reply(http.StatusBadRequest, "")
+		}
+		host = req.URL.Host
+		if req.URL.Port() == "" {
+			host = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	dest, err := addrSpec(host)
+	if err != nil {
+		return reply(http.StatusBadRequest, "")
+	}
+	ctx, ok := s.rules.Allow(context.Background(), &socks5.Request{
+		Version:     5,
+		Command:     socks5.ConnectCommand,
+		AuthContext: auth,
+		DestAddr:    dest,
+	})
+	if !ok {
+		return reply(http.StatusForbidden, "")
+	}
+	var d net.Dialer
+	target, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return reply(http.StatusBadGateway, "")
+	}
+	defer target.Close()
+	if connect {
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return err
+		}
+	} else {
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		req.Close = true
+		if err := req.Write(target); err != nil {
+			return err
+		}
+	}
+	Pipe(conn, target)
+	return nil
+}
+
+// proxyAuth returns the basic credentials of the
+// request's Proxy-Authorization header, if any
+func proxyAuth(req *http.Request) (string, string, bool) {
+	const prefix = "Basic "
+	h := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(h[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	user, pass := ParseAuth(string(b))
+	return user, pass, user != ""
+}
+
+// addrSpec returns the SOCKS destination of the host:port
+func addrSpec(hostPort string) (*socks5.AddrSpec, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return nil, errors.New("invalid port")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &socks5.AddrSpec{IP: ip, Port: n}, nil
+	}
+	return &socks5.AddrSpec{FQDN: host, Port: n}, nil
+}
@@ -2,38 +2,119 @@ package chshare
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
 
 	"github.com/jpillora/sizestr"
+	xed25519 "golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 )
 
+// The host key algorithms of GenerateKeyAlgo
+const (
+	KeyECDSA   = "ecdsa"
+	KeyED25519 = "ed25519"
+	KeyRSA     = "rsa"
+)
+
 func GenerateKey(seed string) ([]byte, error) {
+	return GenerateKeyAlgo(KeyECDSA, seed)
+}
+
+// GenerateKeyAlgo returns a new PEM-encoded private key of the algorithm
+// (ECDSA P-256, ED25519 or 3072 bit RSA), derived from the seed when it's
+// set. RSA keys can't be seeded, as their generation isn't deterministic
+func GenerateKeyAlgo(algo, seed string) ([]byte, error) {
 	var r io.Reader
 	if seed == "" {
 		r = rand.Reader
+	} else if fips {
+		return nil, fmt.Errorf("Keys can't be derived from a seed in FIPS mode")
 	} else {
 		r = NewDetermRand([]byte(seed))
 	}
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), r)
+	switch algo {
+	case KeyECDSA, "":
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), r)
+		if err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to marshal ECDSA private key: %v", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil
+	case KeyED25519:
+		_, priv, err := ed25519.GenerateKey(r)
+		if err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to marshal ED25519 private key: %v", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), nil
+	case KeyRSA:
+		if seed != "" {
+			return nil, fmt.Errorf("RSA keys can't be generated from a seed")
+		}
+		priv, err := rsa.GenerateKey(r, 3072)
+		if err != nil {
+			return nil, err
+		}
+		b := x509.MarshalPKCS1PrivateKey(priv)
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: b}), nil
+	}
+	return nil, fmt.Errorf("Unknown key algorithm '%s' (expected ecdsa, ed25519 or rsa)", algo)
+}
+
+// LoadKeyFile reads a PEM-encoded private key, like one written
+// by chisel server --keygen, or an unencrypted OpenSSH key
+func LoadKeyFile(path string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Failed to read key file: %s", err)
+	}
+	signer, err := ParseKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse key file %s: %s", path, err)
 	}
-	b, err := x509.MarshalECPrivateKey(priv)
+	if fips && signer.PublicKey().Type() == ssh.KeyAlgoDSA {
+		return nil, fmt.Errorf("DSA keys are not allowed in FIPS mode")
+	}
+	return signer, nil
+}
+
+// ParseKey parses a PEM-encoded private key, including the
+// PKCS#8 ED25519 keys of GenerateKeyAlgo, which ssh.ParsePrivateKey
+// doesn't support
+func ParseKey(b []byte) (ssh.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return ssh.ParsePrivateKey(b)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to marshal ECDSA private key: %v", err)
+		return nil, err
 	}
-	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		key = xed25519.PrivateKey(k)
+	}
+	return ssh.NewSignerFromKey(key)
 }
 
+// FingerprintKey returns the legacy MD5 fingerprint of the key, as
+// colon separated hex (see FingerprintKeySHA256 for OpenSSH's format)
 func FingerprintKey(k ssh.PublicKey) string {
 	bytes := md5.Sum(k.Marshal())
 	strbytes := make([]string, len(bytes))
@@ -43,8 +124,103 @@ func FingerprintKey(k ssh.PublicKey) string {
 	return strings.Join(strbytes, ":")
 }
 
+// FingerprintHeader carries the host key fingerprints (comma separated)
+// which the client pins, so that a server rotating its host key presents
+// an expected one
+const FingerprintHeader = "Chisel-Fingerprint"
+
+// FingerprintKeySHA256 returns the fingerprint of the key as
+// shown by OpenSSH, like SHA256:<base64 of the key's hash>
+func FingerprintKeySHA256(k ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(k)
+}
+
+// MatchFingerprint reports whether the key has the expected fingerprint,
+// or a prefix of it, in either the SHA256 or the legacy MD5 format (which
+// never matches in FIPS mode)
+func MatchFingerprint(k ssh.PublicKey, expect string) bool {
+	if strings.HasPrefix(expect, "SHA256:") {
+		return strings.HasPrefix(FingerprintKeySHA256(k), expect)
+	}
+	return !fips && strings.HasPrefix(FingerprintKey(k), expect)
+}
+
+// SSHAlgorithms restricts the algorithms negotiated by the tunnel's
+// ssh connection, in order of preference, each defaulting to those of
+// golang.org/x/crypto/ssh when empty
+type SSHAlgorithms struct {
+	Ciphers      []string
+	KeyExchanges []string
+	MACs         []string
+}
+
+var (
+	sshCiphers = []string{
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	}
+	sshKeyExchanges = []string{
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	sshMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// Apply sets the algorithms of the ssh config, failing on any unknown
+// algorithm. Names may omit their @<domain> suffix, like
+// chacha20-poly1305 or curve25519-sha256. In FIPS mode, only (and by
+// default) the FIPS approved algorithms are allowed
+func (a SSHAlgorithms) Apply(c *ssh.Config) error {
+	ciphers, kex, macs := sshCiphers, sshKeyExchanges, sshMACs
+	if fips {
+		ciphers, kex, macs = fipsSSHCiphers, fipsSSHKeyExchanges, fipsSSHMACs
+	}
+	var err error
+	if c.Ciphers, err = sshAlgorithms("cipher", a.Ciphers, ciphers); err != nil {
+		return err
+	}
+	if c.KeyExchanges, err = sshAlgorithms("key exchange", a.KeyExchanges, kex); err != nil {
+		return err
+	}
+	c.MACs, err = sshAlgorithms("MAC", a.MACs, macs)
+	return err
+}
+
+// sshAlgorithms returns the known algorithms of the names, or in FIPS
+// mode, all of them by default
+func sshAlgorithms(kind string, names, known []string) ([]string, error) {
+	if len(names) == 0 && fips {
+		return known, nil
+	}
+	var algos []string
+	for _, name := range names {
+		found := false
+		for _, k := range known {
+			if strings.EqualFold(k, name) || strings.HasPrefix(strings.ToLower(k), strings.ToLower(name)+"@") {
+				algos = append(algos, k)
+				found = true
+			}
+		}
+		if !found && fips {
+			return nil, fmt.Errorf("SSH %s '%s' is not allowed in FIPS mode (expected one of %s)", kind, name, strings.Join(known, ", "))
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown SSH %s '%s' (expected one of %s)", kind, name, strings.Join(known, ", "))
+		}
+	}
+	return algos, nil
+}
+
 func HandleTCPStream(l *Logger, connStats *ConnStats, src io.ReadWriteCloser, remote string) {
-	dst, err := net.Dial("tcp", remote)
+	network := "tcp"
+	if path, ok := UnixRemote(remote); ok {
+		network, remote = "unix", path
+	}
+	dst, err := net.Dial(network, remote)
 	if err != nil {
 		l.Debugf("Remote failed (%s)", err)
 		src.Close()
@@ -0,0 +1,95 @@
+package chshare
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SocksConnect makes the SOCKS5 CONNECT request of the address (like
+// a transparent remote's original destination) on the stream, whose
+// host name (if any) the server resolves, authenticating with auth
+// (<user>:<pass>) when the server requires it
+func SocksConnect(stream io.ReadWriter, addr, auth string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	if p <= 0 || p > 65535 || host == "" || len(host) > 255 {
+		return fmt.Errorf("invalid destination %s", addr)
+	}
+	user, pass := ParseAuth(auth)
+	methods := []byte{5, 1, 0}
+	if user != "" {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err := stream.Write(methods); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		return err
+	}
+	switch b[1] {
+	case 0:
+	case 2:
+		if user == "" || len(user) > 255 || len(pass) > 255 {
+			return errors.New("the server requires SOCKS5 auth")
+		}
+		req := append([]byte{1, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err := stream.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(stream, b); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return errors.New("SOCKS5 auth failed")
+		}
+	default:
+		return errors.New("the server requires SOCKS5 auth")
+	}
+	req := []byte{5, 1, 0, 1}
+	if ip := net.ParseIP(host); ip == nil {
+		req[3] = 3
+		req = append(append(req, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, ip4...)
+	} else {
+		req[3] = 4
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(p>>8), byte(p))
+	if _, err := stream.Write(req); err != nil {
+		return err
+	}
+	//the reply ends with the bound address, of its type
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(stream, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("SOCKS5 request failed (code %d)", reply[1])
+	}
+	n := 0
+	switch reply[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case 3:
+		if _, err := io.ReadFull(stream, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	}
+	_, err = io.ReadFull(stream, make([]byte, n+2))
+	return err
+}
@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package chshare
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// soOriginalDst is the destination of a REDIRECT-ed connection
+	soOriginalDst = 80
+	// ipTransparent lets a listener accept TPROXY-ed connections
+	ipTransparent = 19
+)
+
+// listenTransparent listens on the address of a transparent remote,
+// accepting TPROXY-ed connections too when permitted (with the
+// CAP_NET_ADMIN capability), which it reports
+func listenTransparent(addr string) (net.Listener, bool, error) {
+	tproxy := false
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			tproxy = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1) == nil
+		})
+	}}
+	l, err := lc.Listen(context.Background(), "tcp4", addr)
+	return l, tproxy, err
+}
+
+// originalDst returns the destination of a connection redirected by
+// iptables: REDIRECT-ed connections have their original destination
+// (SO_ORIGINAL_DST), while TPROXY-ed ones are accepted on it (though
+// not on the listener's own port, as when connecting to it directly)
+func originalDst(conn net.Conn, tproxy bool, listenPort string) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var mreq *syscall.IPv6Mreq
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+	}); err != nil {
+		return "", err
+	}
+	if serr == nil {
+		//the sockaddr_in of the original destination
+		b := mreq.Multiaddr
+		port := int(b[2])<<8 | int(b[3])
+		return net.JoinHostPort(net.IPv4(b[4], b[5], b[6], b[7]).String(), strconv.Itoa(port)), nil
+	}
+	local := conn.LocalAddr().String()
+	if _, port, _ := net.SplitHostPort(local); tproxy && port != listenPort {
+		return local, nil
+	}
+	return "", errors.New("connection wasn't redirected by iptables")
+}
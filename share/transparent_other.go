@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package chshare
+
+import (
+	"errors"
+	"net"
+)
+
+func listenTransparent(addr string) (net.Listener, bool, error) {
+	return nil, false, errors.New("transparent remotes are only supported on Linux")
+}
+
+func originalDst(conn net.Conn, tproxy bool, listenPort string) (string, error) {
+	return "", errors.New("transparent remotes are only supported on Linux")
+}
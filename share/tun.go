@@ -0,0 +1,122 @@
+package chshare
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// TUNPrefix addresses the tun channels of clients, like tun:10.8.0.2,
+// which are only matched by regular expressions (see ACLRule)
+const TUNPrefix = "tun:"
+
+// maxPacketSize is the largest IP packet which may be framed
+const maxPacketSize = 65535
+
+// TUN is a TUN device, whose IP packets are relayed
+// over the tun channels of client sessions
+type TUN struct {
+	io.ReadWriteCloser
+	// Name is the name of the device, like tun0
+	Name string
+}
+
+// OpenTUN creates a TUN device (on Linux, with the CAP_NET_ADMIN
+// capability) with the address (like 10.8.0.1/24), routing
+// the networks of routes (like 192.168.1.0/24) through it
+func OpenTUN(addr string, routes []string) (*TUN, error) {
+	dev, err := openTUN()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create TUN device: %s", err)
+	}
+	cmds := [][]string{
+		{"addr", "add", addr, "dev", dev.Name},
+		{"link", "set", "dev", dev.Name, "up"},
+	}
+	for _, r := range routes {
+		cmds = append(cmds, []string{"route", "add", r, "dev", dev.Name})
+	}
+	for _, args := range cmds {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("Failed to configure TUN device: ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+	}
+	return dev, nil
+}
+
+// NewPacketBuffer returns a buffer fitting any packet
+func NewPacketBuffer() []byte {
+	return make([]byte, 2+maxPacketSize)
+}
+
+// WritePacket writes the IP packet to the stream of a tun
+// channel, framed with its (2 byte, big endian) length
+func WritePacket(w io.Writer, b []byte) error {
+	if len(b) > maxPacketSize {
+		return fmt.Errorf("packet of %d bytes is too large", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadPacket reads the next IP packet framed on the stream of a tun
+// channel (see WritePacket), into buf (see NewPacketBuffer)
+func ReadPacket(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(r, buf[2:2+n]); err != nil {
+		return nil, err
+	}
+	return buf[2 : 2+n], nil
+}
+
+// PacketDestination returns the destination of an IPv4 or IPv6
+// packet as an access list address: <ip>:<port> for TCP,
+// udp:<ip>:<port> for UDP, and <ip>:0 for other protocols (like
+// ICMP) and for the fragments after the first
+func PacketDestination(b []byte) (string, bool) {
+	_, dst, ok := PacketAddrs(b)
+	if !ok {
+		return "", false
+	}
+	var proto byte
+	var header []byte
+	if b[0]>>4 == 4 {
+		//only the first fragment has the transport header
+		if n := int(b[0]&0x0f) * 4; n >= 20 && len(b) >= n && binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 {
+			proto, header = b[9], b[n:]
+		}
+	} else {
+		proto, header = b[6], b[40:]
+	}
+	if (proto == 6 || proto == 17) && len(header) >= 4 {
+		addr := net.JoinHostPort(dst.String(), strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4]))))
+		if proto == 17 {
+			addr = udpPrefix + addr
+		}
+		return addr, true
+	}
+	return net.JoinHostPort(dst.String(), "0"), true
+}
+
+// PacketAddrs returns the source and destination
+// addresses of an IPv4 or IPv6 packet
+func PacketAddrs(b []byte) (src, dst net.IP, ok bool) {
+	if len(b) >= 20 && b[0]>>4 == 4 {
+		return net.IP(b[12:16]), net.IP(b[16:20]), true
+	}
+	if len(b) >= 40 && b[0]>>4 == 6 {
+		return net.IP(b[8:24]), net.IP(b[24:40]), true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package chshare
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunSetIFF = 0x400454ca
+	iffTUN    = 0x0001
+	iffNoPI   = 0x1000
+)
+
+// openTUN creates a TUN device (named by the kernel), without
+// packet information, so each read and write is an IP packet
+func openTUN() (*TUN, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	//struct ifreq, of the name and flags
+	var req [40]byte
+	*(*uint16)(unsafe.Pointer(&req[syscall.IFNAMSIZ])) = iffTUN | iffNoPI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIFF, uintptr(unsafe.Pointer(&req[0]))); errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	name := string(bytes.TrimRight(req[:syscall.IFNAMSIZ], "\x00"))
+	//non-blocking, so closing the file ends its reads
+	return &TUN{ReadWriteCloser: os.NewFile(uintptr(fd), "/dev/net/tun"), Name: name}, nil
+}
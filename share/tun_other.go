@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package chshare
+
+import "errors"
+
+func openTUN() (*TUN, error) {
+	return nil, errors.New("TUN devices are only supported on Linux")
+}
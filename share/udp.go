@@ -0,0 +1,264 @@
+package chshare
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultUDPIdleTimeout closes the flows of udp remotes
+	// after a minute without datagrams in either direction
+	DefaultUDPIdleTimeout = time.Minute
+	// DefaultUDPMaxSize fits jumbo frames
+	DefaultUDPMaxSize = 9000
+	// maxUDPSize is the largest datagram which may be framed
+	maxUDPSize = 65535
+)
+
+// UDPOptions configure the flows of udp remotes, each of which is the
+// datagrams of one source address, carried by one ssh channel
+type UDPOptions struct {
+	// IdleTimeout closes flows without datagrams for the
+	// duration (DefaultUDPIdleTimeout when 0)
+	IdleTimeout time.Duration
+	// MaxSize is the size of the largest datagram relayed, larger
+	// ones are dropped (DefaultUDPMaxSize when 0)
+	MaxSize int
+}
+
+// Validate checks the options, setting their defaults
+func (o *UDPOptions) Validate() error {
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = DefaultUDPIdleTimeout
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = DefaultUDPMaxSize
+	} else if o.MaxSize > maxUDPSize {
+		return fmt.Errorf("Invalid UDP max size %d (the largest is %d)", o.MaxSize, maxUDPSize)
+	}
+	return nil
+}
+
+// udpFlow relays the datagrams of one source address, over a stream
+// framing each datagram with its (2 byte, big endian) length
+type udpFlow struct {
+	stream io.ReadWriteCloser
+	idle   *time.Timer
+	write  sync.Mutex
+	buf    []byte
+	log    *Logger
+}
+
+func newUDPFlow(stream io.ReadWriteCloser, opts UDPOptions) *udpFlow {
+	f := &udpFlow{stream: stream, buf: make([]byte, 2+opts.MaxSize)}
+	f.idle = time.AfterFunc(opts.IdleTimeout, func() { stream.Close() })
+	return f
+}
+
+// send frames the datagram onto the stream
+func (f *udpFlow) send(b []byte, opts UDPOptions) error {
+	f.write.Lock()
+	defer f.write.Unlock()
+	f.idle.Reset(opts.IdleTimeout)
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := f.stream.Write(frame)
+	return err
+}
+
+// receive reads the next datagram from the stream
+func (f *udpFlow) receive(opts UDPOptions) ([]byte, error) {
+	if _, err := io.ReadFull(f.stream, f.buf[:2]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(f.buf))
+	if n > opts.MaxSize {
+		return nil, fmt.Errorf("datagram of %d bytes exceeds the max size", n)
+	}
+	if _, err := io.ReadFull(f.stream, f.buf[2:2+n]); err != nil {
+		return nil, err
+	}
+	f.idle.Reset(opts.IdleTimeout)
+	return f.buf[2 : 2+n], nil
+}
+
+func (f *udpFlow) close() {
+	f.idle.Stop()
+	f.stream.Close()
+}
+
+func (p *TCPProxy) startUDP(ctx context.Context) error {
+	if err := p.UDP.Validate(); err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp4", p.remote.LocalHost+":"+p.remote.LocalPort)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p.Logger.Prefix(), err)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p.Logger.Prefix(), err)
+	}
+	go p.listenUDP(ctx, conn)
+	return nil
+}
+
+// listenUDP relays the datagrams of each source address
+// (the flows, keyed by address) over its own channel
+func (p *TCPProxy) listenUDP(ctx context.Context, conn *net.UDPConn) {
+	if p.remote.DNS {
+		p.Infof("Listening (udp)")
+	} else {
+		p.Infof("Listening")
+	}
+	var mut sync.Mutex
+	flows := map[string]*udpFlow{}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		mut.Lock()
+		for _, f := range flows {
+			f.close()
+		}
+		mut.Unlock()
+		p.Infof("Closed")
+	}()
+	//read one byte more than the max, to spot larger datagrams
+	buf := make([]byte, p.UDP.MaxSize+1)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				//listener closed
+			default:
+				p.Infof("Read error: %s", err)
+			}
+			return
+		}
+		if n > p.UDP.MaxSize {
+			p.Debugf("Dropped datagram from %s larger than %d bytes", src, p.UDP.MaxSize)
+			continue
+		}
+		key := src.String()
+		mut.Lock()
+		f, ok := flows[key]
+		mut.Unlock()
+		if !ok {
+			if f = p.openUDPFlow(conn, src); f == nil {
+				continue
+			}
+			mut.Lock()
+			flows[key] = f
+			mut.Unlock()
+			go func() {
+				p.replyUDP(conn, src, f)
+				mut.Lock()
+				delete(flows, key)
+				mut.Unlock()
+			}()
+		}
+		if err := f.send(buf[:n], p.UDP); err != nil {
+			f.close()
+		}
+	}
+}
+
+// openUDPFlow opens the channel of a new flow, or returns nil
+func (p *TCPProxy) openUDPFlow(conn *net.UDPConn, src *net.UDPAddr) *udpFlow {
+	p.count++
+	l := p.Fork("flow#%d", p.count)
+	sshConn := p.ssh()
+	if sshConn == nil {
+		l.Debugf("No remote connection")
+		return nil
+	}
+	remote := p.remote.Remote()
+	if p.remote.DNS {
+		remote += udpSuffix
+	}
+	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(remote))
+	if err != nil {
+		l.Infof("Stream error: %s", err)
+		return nil
+	}
+	go ssh.DiscardRequests(reqs)
+	l.Debugf("Open (%s)", src)
+	if p.Stats != nil {
+		p.Stats.New()
+		p.Stats.Open()
+	}
+	f := newUDPFlow(p.Bytes.Count(p.Activity.Track(LimitRate(dst, p.RateLimiters...))), p.UDP)
+	f.log = l
+	return f
+}
+
+// replyUDP relays the flow's replies to its source,
+// until the flow is closed (or is idle)
+func (p *TCPProxy) replyUDP(conn *net.UDPConn, src *net.UDPAddr, f *udpFlow) {
+	defer f.log.Debugf("Close")
+	defer f.close()
+	if p.Stats != nil {
+		defer p.Stats.Close()
+	}
+	for {
+		b, err := f.receive(p.UDP)
+		if err != nil {
+			return
+		}
+		if _, err := conn.WriteToUDP(b, src); err != nil {
+			return
+		}
+	}
+}
+
+// HandleUDPStream relays the datagrams framed on the
+// stream to the remote address (see UDPRemote), and
+// its replies back, until the stream is closed or idle
+func HandleUDPStream(l *Logger, connStats *ConnStats, src io.ReadWriteCloser, remote string, opts UDPOptions) {
+	dst, err := net.Dial("udp", remote)
+	if err != nil {
+		l.Debugf("Remote failed (%s)", err)
+		src.Close()
+		return
+	}
+	f := newUDPFlow(src, opts)
+	connStats.Open()
+	l.Debugf("%s: Open (udp)", connStats)
+	go func() {
+		buf := make([]byte, opts.MaxSize+1)
+		for {
+			n, err := dst.Read(buf)
+			if err != nil {
+				f.close()
+				return
+			}
+			if n > opts.MaxSize {
+				l.Debugf("Dropped reply larger than %d bytes", opts.MaxSize)
+				continue
+			}
+			if err := f.send(buf[:n], opts); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		b, err := f.receive(opts)
+		if err != nil {
+			break
+		}
+		dst.Write(b)
+	}
+	f.close()
+	dst.Close()
+	connStats.Close()
+	l.Debugf("%s: Close (udp)", connStats)
+}
@@ -3,9 +3,11 @@ package chshare
 import (
 	"regexp"
 	"strings"
+	"time"
 )
 
-var UserAllowAll = regexp.MustCompile("")
+// UserAllowAll is the access list entry which matches any address
+var UserAllowAll = &ACLRule{Rule: "*", re: regexp.MustCompile(""), any: true}
 
 func ParseAuth(auth string) (string, string) {
 	if strings.Contains(auth, ":") {
@@ -18,16 +20,125 @@ func ParseAuth(auth string) (string, string) {
 type User struct {
 	Name  string
 	Pass  string
-	Addrs []*regexp.Regexp
+	Addrs []*ACLRule
+	// ForwardAddrs only apply to forward remotes and ReverseBinds
+	// only to the local addresses of reverse remotes (given
+	// without the R: prefix), and are checked before Addrs
+	ForwardAddrs []*ACLRule
+	ReverseBinds []*ACLRule
+	// Vars are the values of the variables in the
+	// user's access list, in addition to ${user}
+	Vars map[string]string
+	// Groups are the auth file groups whose
+	// addresses were added to Addrs
+	Groups []string
+	// MaxSessions limits the number of concurrent
+	// sessions for this user (0 is unlimited)
+	MaxSessions int
+	// MaxChannels limits the number of open channels (tunnel
+	// connections) across the user's sessions (0 is unlimited)
+	MaxChannels int
+	// Expires is when this user may no longer
+	// authenticate (the zero time never expires)
+	Expires time.Time
+	// Bandwidth limits the bytes per second of all of the
+	// user's sessions, sent and received combined (0 is unlimited)
+	Bandwidth int64
+	// IdleTimeout closes the user's sessions once no data has
+	// passed through their tunnels for this long (0 is never)
+	IdleTimeout time.Duration
 }
 
+// Expired reports whether the user has passed their expiry time
+func (u *User) Expired() bool {
+	return !u.Expires.IsZero() && time.Now().After(u.Expires)
+}
+
+// HasAccess reports whether the first rule
+// matching the address (if any) allows access
 func (u *User) HasAccess(addr string) bool {
-	m := false
-	for _, r := range u.Addrs {
-		if r.MatchString(addr) {
-			m = true
-			break
+	r := u.MatchRule(addr)
+	return r != nil && !r.Deny
+}
+
+// HasAccessResolved is HasAccess, where rules
+// are matched with ACLRule.MatchResolved
+func (u *User) HasAccessResolved(addr string, resolve Resolver) bool {
+	r := u.MatchRuleResolved(addr, resolve)
+	return r != nil && !r.Deny
+}
+
+// Windowed reports whether any of the user's
+// access list entries have time windows
+func (u *User) Windowed() bool {
+	for _, list := range [][]*ACLRule{u.Addrs, u.ForwardAddrs, u.ReverseBinds} {
+		for _, r := range list {
+			if r.Windowed() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchRule returns the first rule in the user's access
+// list which matches the address, checking ForwardAddrs or
+// ReverseBinds (depending on the remote) before Addrs
+func (u *User) MatchRule(addr string) *ACLRule {
+	return u.matchRule(addr, nil)
+}
+
+// MatchRuleResolved is MatchRule, where rules
+// are matched with ACLRule.MatchResolved
+func (u *User) MatchRuleResolved(addr string, resolve Resolver) *ACLRule {
+	return u.matchRule(addr, resolve.cached())
+}
+
+func (u *User) matchRule(addr string, resolve Resolver) *ACLRule {
+	if strings.HasPrefix(addr, revPrefix) {
+		if r := matchRules(u.ReverseBinds, strings.TrimPrefix(addr, revPrefix), resolve); r != nil {
+			return r
 		}
+	} else if r := matchRules(u.ForwardAddrs, addr, resolve); r != nil {
+		return r
+	}
+	return matchRules(u.Addrs, addr, resolve)
+}
+
+func matchRules(rules []*ACLRule, addr string, resolve Resolver) *ACLRule {
+	for _, r := range rules {
+		if resolve == nil && r.Match(addr) || resolve != nil && r.MatchResolved(addr, resolve) {
+			return r
+		}
+	}
+	return nil
+}
+
+// AddRules appends the access lists of other to those of the user
+func (u *User) AddRules(other *User) {
+	u.Addrs = append(u.Addrs, other.Addrs...)
+	u.ForwardAddrs = append(u.ForwardAddrs, other.ForwardAddrs...)
+	u.ReverseBinds = append(u.ReverseBinds, other.ReverseBinds...)
+}
+
+// Expand returns a copy of the user where the variables in their
+// access list (like ${user}) have been replaced with their values
+func (u *User) Expand() (*User, error) {
+	vars := map[string]string{}
+	for k, v := range u.Vars {
+		vars[k] = v
+	}
+	vars["user"] = u.Name
+	e := *u
+	var err error
+	if e.Addrs, err = expandRules(u.Addrs, vars); err != nil {
+		return nil, err
+	}
+	if e.ForwardAddrs, err = expandRules(u.ForwardAddrs, vars); err != nil {
+		return nil, err
+	}
+	if e.ReverseBinds, err = expandRules(u.ReverseBinds, vars); err != nil {
+		return nil, err
 	}
-	return m
+	return &e, nil
 }
@@ -1,15 +1,18 @@
 package chshare
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
-	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/jpillora/sizestr"
 )
 
 type Users struct {
@@ -61,6 +64,15 @@ type UserIndex struct {
 	*Logger
 	*Users
 	configFile string
+	//loaded are the names of the users from the last load
+	loaded map[string]bool
+	// OnRevoke is called with each user which is removed, or whose
+	// password changes, so that their sessions may be closed
+	OnRevoke func(name string)
+	// OnReload is called after each (re)load of the users
+	OnReload func()
+	// Decrypter decrypts age-encrypted auth files
+	Decrypter *AgeDecrypter
 }
 
 // NewUserIndex creates a source for users
@@ -84,6 +96,14 @@ func (u *UserIndex) LoadUsers(configFile string) error {
 	return nil
 }
 
+// Reload re-reads the users file, if any
+func (u *UserIndex) Reload() error {
+	if u.configFile == "" {
+		return nil
+	}
+	return u.loadUserIndex()
+}
+
 // watchEvents is responsible for watching for updates to the file and reloading
 func (u *UserIndex) addWatchEvents() error {
 	watcher, err := fsnotify.NewWatcher()
@@ -94,12 +114,14 @@ func (u *UserIndex) addWatchEvents() error {
 	if err := watcher.Add(configDir); err != nil {
 		return err
 	}
+	configFile := filepath.Clean(u.configFile)
 	go func() {
 		for e := range watcher.Events {
-			if e.Name != u.configFile {
+			if filepath.Clean(e.Name) != configFile {
 				continue
 			}
-			if e.Op&fsnotify.Write != fsnotify.Write {
+			//editors often save by replacing the file
+			if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
 				continue
 			}
 			if err := u.loadUserIndex(); err != nil {
@@ -121,29 +143,165 @@ func (u *UserIndex) loadUserIndex() error {
 	if err != nil {
 		return fmt.Errorf("Failed to read auth file: %s, error: %s", u.configFile, err)
 	}
-	var raw map[string][]string
+	return u.LoadUsersJSON(b)
+}
+
+// LoadUsersJSON loads users from the contents of an auth file, which
+// may be encrypted with age. The users are replaced all at once,
+// removing those no longer present.
+func (u *UserIndex) LoadUsersJSON(b []byte) error {
+	if IsAgeEncrypted(b) {
+		if u.Decrypter == nil {
+			return errors.New("The auth file is encrypted, but no age identity or passphrase was provided")
+		}
+		plain, err := u.Decrypter.Decrypt(b)
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt auth file: %s", err)
+		}
+		b = plain
+	}
+	var raw map[string]json.RawMessage
 	if err := json.Unmarshal(b, &raw); err != nil {
 		return errors.New("Invalid JSON: " + err.Error())
 	}
-	for auth, remotes := range raw {
+	//groups are defined by "@<group>" keys
+	groups := map[string][]string{}
+	for key, value := range raw {
+		if !strings.HasPrefix(key, "@") || strings.Contains(key, ":") {
+			continue
+		}
+		entry, err := parseUserEntry(value)
+		if err != nil {
+			return fmt.Errorf("Invalid entry for group: %s (%s)", key[1:], err)
+		}
+		groups[key[1:]] = entry.Addrs
+		delete(raw, key)
+	}
+	users := map[string]*User{}
+	for auth, value := range raw {
 		user := &User{}
 		user.Name, user.Pass = ParseAuth(auth)
 		if user.Name == "" {
 			return errors.New("Invalid user:pass string")
 		}
-		for _, r := range remotes {
-			if r == "" || r == "*" {
-				user.Addrs = append(user.Addrs, UserAllowAll)
-			} else {
-				re, err := regexp.Compile(r)
-				if err != nil {
-					return errors.New("Invalid address regex")
-				}
-				user.Addrs = append(user.Addrs, re)
+		if err := ValidatePassword(user.Pass); err != nil {
+			return fmt.Errorf("Invalid password hash for user: %s (%s)", user.Name, err)
+		}
+		entry, err := parseUserEntry(value)
+		if err != nil {
+			return fmt.Errorf("Invalid entry for user: %s (%s)", user.Name, err)
+		}
+		remotes := entry.Addrs
+		for _, g := range entry.Groups {
+			addrs, ok := groups[g]
+			if !ok {
+				return fmt.Errorf("Unknown group '%s' for user: %s", g, user.Name)
 			}
-
+			remotes = append(remotes, addrs...)
+		}
+		addrs, err := ParseAddrs(remotes)
+		if err != nil {
+			return err
+		}
+		user.Addrs = addrs
+		if user.ForwardAddrs, err = ParseAddrs(entry.ForwardAddrs); err != nil {
+			return err
+		}
+		if user.ReverseBinds, err = ParseAddrs(entry.ReverseBinds); err != nil {
+			return err
+		}
+		user.Groups = entry.Groups
+		user.Vars = entry.Vars
+		user.Expires = entry.Expires
+		user.MaxSessions = entry.MaxSessions
+		user.MaxChannels = entry.MaxChannels
+		if entry.IdleTimeout != "" {
+			if user.IdleTimeout, err = time.ParseDuration(entry.IdleTimeout); err != nil {
+				return fmt.Errorf("Invalid idle timeout for user: %s (%s)", user.Name, entry.IdleTimeout)
+			}
+		}
+		if entry.Bandwidth != "" {
+			if user.Bandwidth, err = sizestr.Parse(entry.Bandwidth); err != nil {
+				return fmt.Errorf("Invalid bandwidth for user: %s (%s)", user.Name, entry.Bandwidth)
+			}
+		}
+		users[user.Name] = user
+	}
+	var removed, changed []string
+	u.Users.Lock()
+	for name := range u.loaded {
+		if _, ok := users[name]; !ok {
+			delete(u.Users.inner, name)
+			removed = append(removed, name)
 		}
-		u.Users.AddUser(user)
+	}
+	for name, user := range users {
+		if old, ok := u.Users.inner[name]; ok && u.loaded[name] && old.Pass != user.Pass {
+			changed = append(changed, name)
+		}
+	}
+	u.loaded = map[string]bool{}
+	for name, user := range users {
+		u.Users.inner[name] = user
+		u.loaded[name] = true
+	}
+	u.Users.Unlock()
+	for _, name := range removed {
+		u.Infof("Removed user: %s", name)
+		u.revoke(name)
+	}
+	for _, name := range changed {
+		u.Infof("Changed the password of user: %s", name)
+		u.revoke(name)
+	}
+	if u.OnReload != nil {
+		u.OnReload()
 	}
 	return nil
 }
+
+// RemoveUser deletes the named user, revoking their sessions
+func (u *UserIndex) RemoveUser(name string) {
+	u.Del(name)
+	u.revoke(name)
+}
+
+// UpdateUser adds or replaces the user, revoking the
+// sessions of an existing user when their password changes
+func (u *UserIndex) UpdateUser(user *User) {
+	old, found := u.Get(user.Name)
+	u.AddUser(user)
+	if found && old.Pass != user.Pass {
+		u.Infof("Changed the password of user: %s", user.Name)
+		u.revoke(user.Name)
+	}
+}
+
+func (u *UserIndex) revoke(name string) {
+	if u.OnRevoke != nil {
+		u.OnRevoke(name)
+	}
+}
+
+// userEntry is the object form of an auth file entry,
+// the array form is equivalent to {"addrs": [...]}
+type userEntry struct {
+	Addrs        []string          `json:"addrs"`
+	ForwardAddrs []string          `json:"forward_addrs"`
+	ReverseBinds []string          `json:"reverse_binds"`
+	Groups       []string          `json:"groups"`
+	Vars         map[string]string `json:"vars"`
+	Expires      time.Time         `json:"expires"`
+	MaxSessions  int               `json:"max_sessions"`
+	MaxChannels  int               `json:"max_channels"`
+	Bandwidth    string            `json:"bandwidth"`
+	IdleTimeout  string            `json:"idle_timeout"`
+}
+
+func parseUserEntry(value json.RawMessage) (*userEntry, error) {
+	entry := &userEntry{}
+	if v := bytes.TrimSpace(value); len(v) > 0 && v[0] == '[' {
+		return entry, json.Unmarshal(v, &entry.Addrs)
+	}
+	return entry, json.Unmarshal(value, entry)
+}
@@ -0,0 +1,8 @@
+//go:build !nomysql
+// +build !nomysql
+
+package main
+
+//registers the "mysql" driver of --auth-dsn,
+//which builds tagged nomysql leave out
+import _ "github.com/go-sql-driver/mysql"
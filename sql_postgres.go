@@ -0,0 +1,8 @@
+//go:build !nopostgres
+// +build !nopostgres
+
+package main
+
+//registers the "postgres" driver of --auth-dsn,
+//which builds tagged nopostgres leave out
+import _ "github.com/lib/pq"